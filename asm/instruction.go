@@ -0,0 +1,357 @@
+package asm
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Operands that are not symbols nor numbers
+var reservedOperands = []string{"I", "[I]", "DT", "ST", "K", "F", "HF", "B", "R", "LONG"}
+
+func isReservedOperand(operand string) bool {
+	for _, reserved := range reservedOperands {
+		if strings.EqualFold(operand, reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRegister parses a V0 - VF register.
+func parseRegister(operand string) (uint16, bool) {
+	if len(operand) != 2 || (operand[0] != 'V' && operand[0] != 'v') {
+		return 0, false
+	}
+	register, err := strconv.ParseUint(operand[1:], 16, 8)
+	if err != nil {
+		return 0, false
+	}
+	return uint16(register), true
+}
+
+// parseRegisterRange parses a VX-VY register range (XO-CHIP).
+func parseRegisterRange(operand string) (uint16, uint16, bool) {
+	parts := strings.Split(operand, "-")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	x, ok := parseRegister(strings.TrimSpace(parts[0]))
+	if !ok {
+		return 0, 0, false
+	}
+	y, ok := parseRegister(strings.TrimSpace(parts[1]))
+	return x, y, ok
+}
+
+// value evaluates an operand that must fit in max.
+func (a *assembler) value(st statement, operand string, max int) (uint16, error) {
+	value, err := a.evaluate(st.line, operand)
+	if err != nil {
+		return 0, err
+	}
+	// Negative bytes are allowed (ex: ADD V0, -1)
+	if max == 0xFF && value < 0 && value >= -0x80 {
+		value &= 0xFF
+	}
+	if value < 0 || value > max {
+		return 0, st.errorf("value %s (%d) is out of range (0x0 - 0x%X)", operand, value, max)
+	}
+	return uint16(value), nil
+}
+
+// encode returns the bytes of a statement.
+func (a *assembler) encode(st statement) ([]byte, error) {
+	switch st.mnemonic {
+	case "DB", ":BYTE":
+		data := []byte{}
+		for _, operand := range st.operands {
+			value, err := a.value(st, operand, 0xFF)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, byte(value))
+		}
+		return data, nil
+	case "DW":
+		data := []byte{}
+		for _, operand := range st.operands {
+			value, err := a.value(st, operand, 0xFFFF)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, byte(value>>8), byte(value))
+		}
+		return data, nil
+	case "SPRITE":
+		data := []byte{}
+		for _, operand := range st.operands {
+			// Rows are validated by the first pass
+			pixels, _ := strconv.Unquote(operand)
+			for i := 0; i < len(pixels); i += 8 {
+				row := byte(0)
+				for _, pixel := range pixels[i : i+8] {
+					row <<= 1
+					if pixel == '#' || pixel == 'X' || pixel == 'x' || pixel == '1' {
+						row |= 1
+					}
+				}
+				data = append(data, row)
+			}
+		}
+		return data, nil
+	}
+
+	words, err := a.encodeInstruction(st)
+	if err != nil {
+		return nil, err
+	}
+	data := []byte{}
+	for _, word := range words {
+		data = append(data, byte(word>>8), byte(word))
+	}
+	return data, nil
+}
+
+// encodeInstruction returns the operationCode of an instruction (and the address stored after F000).
+func (a *assembler) encodeInstruction(st statement) ([]uint16, error) {
+	operands := st.operands
+	invalid := func() ([]uint16, error) {
+		return nil, st.errorf("invalid operands for %s: %s", st.mnemonic, strings.Join(operands, ", "))
+	}
+	expect := func(count int) bool {
+		return len(operands) == count
+	}
+	register := func(i int) (uint16, bool) {
+		if i >= len(operands) {
+			return 0, false
+		}
+		return parseRegister(operands[i])
+	}
+	is := func(i int, name string) bool {
+		return i < len(operands) && strings.EqualFold(operands[i], name)
+	}
+	// XNN instructions
+	xnn := func(base uint16) ([]uint16, error) {
+		x, _ := register(0)
+		nn, err := a.value(st, operands[1], 0xFF)
+		if err != nil {
+			return nil, err
+		}
+		return []uint16{base | x<<8 | nn}, nil
+	}
+	// XY instructions
+	xy := func(base uint16) ([]uint16, error) {
+		x, okX := register(0)
+		y, okY := register(1)
+		if !expect(2) || !okX || !okY {
+			return invalid()
+		}
+		return []uint16{base | x<<8 | y<<4}, nil
+	}
+	// NNN instructions
+	nnn := func(base uint16, operand string) ([]uint16, error) {
+		address, err := a.value(st, operand, 0xFFF)
+		if err != nil {
+			return nil, err
+		}
+		return []uint16{base | address}, nil
+	}
+	// N instructions (the value is stored at the given shift)
+	n := func(base uint16, shift uint) ([]uint16, error) {
+		if !expect(1) {
+			return invalid()
+		}
+		value, err := a.value(st, operands[0], 0xF)
+		if err != nil {
+			return nil, err
+		}
+		return []uint16{base | value<<shift}, nil
+	}
+	// FX instructions
+	fx := func(base uint16, i int) ([]uint16, error) {
+		x, ok := register(i)
+		if !expect(2) || !ok {
+			return invalid()
+		}
+		return []uint16{base | x<<8}, nil
+	}
+	noOperands := func(operationCode uint16) ([]uint16, error) {
+		if !expect(0) {
+			return invalid()
+		}
+		return []uint16{operationCode}, nil
+	}
+
+	switch st.mnemonic {
+	case "CLS":
+		return noOperands(0x00E0)
+	case "RET":
+		return noOperands(0x00EE)
+	case "BRK":
+		return noOperands(0x0001)
+	case "SCD":
+		return n(0x00C0, 0)
+	case "SCU":
+		return n(0x00D0, 0)
+	case "SCR":
+		return noOperands(0x00FB)
+	case "SCL":
+		return noOperands(0x00FC)
+	case "EXIT":
+		return noOperands(0x00FD)
+	case "LOW":
+		return noOperands(0x00FE)
+	case "HIGH":
+		return noOperands(0x00FF)
+	case "AUDIO":
+		return noOperands(0xF002)
+	case "PLANE":
+		return n(0xF001, 8)
+	case "JP":
+		if expect(2) && is(0, "V0") {
+			return nnn(0xB000, operands[1])
+		}
+		if !expect(1) {
+			return invalid()
+		}
+		return nnn(0x1000, operands[0])
+	case "CALL":
+		if !expect(1) {
+			return invalid()
+		}
+		return nnn(0x2000, operands[0])
+	case "SE", "SNE":
+		if _, ok := register(0); !ok || !expect(2) {
+			return invalid()
+		}
+		if _, ok := register(1); ok {
+			if st.mnemonic == "SE" {
+				return xy(0x5000)
+			}
+			return xy(0x9000)
+		}
+		if st.mnemonic == "SE" {
+			return xnn(0x3000)
+		}
+		return xnn(0x4000)
+	case "ADD":
+		if expect(2) && is(0, "I") {
+			return fx(0xF01E, 1)
+		}
+		if _, ok := register(0); !ok || !expect(2) {
+			return invalid()
+		}
+		if _, ok := register(1); ok {
+			return xy(0x8004)
+		}
+		return xnn(0x7000)
+	case "OR":
+		return xy(0x8001)
+	case "AND":
+		return xy(0x8002)
+	case "XOR":
+		return xy(0x8003)
+	case "SUB":
+		return xy(0x8005)
+	case "SUBN":
+		return xy(0x8007)
+	case "SHR", "SHL":
+		base := uint16(0x8006)
+		if st.mnemonic == "SHL" {
+			base = 0x800E
+		}
+		// The VY operand is optional, VX is shifted in place by the CHIP-48 and SUPER-CHIP interpreters
+		if x, ok := register(0); ok && expect(1) {
+			return []uint16{base | x<<8 | x<<4}, nil
+		}
+		return xy(base)
+	case "RND":
+		if _, ok := register(0); !ok || !expect(2) {
+			return invalid()
+		}
+		return xnn(0xC000)
+	case "DRW":
+		x, okX := register(0)
+		y, okY := register(1)
+		if !expect(3) || !okX || !okY {
+			return invalid()
+		}
+		height, err := a.value(st, operands[2], 0xF)
+		if err != nil {
+			return nil, err
+		}
+		return []uint16{0xD000 | x<<8 | y<<4 | height}, nil
+	case "SKP", "SKNP":
+		x, ok := register(0)
+		if !expect(1) || !ok {
+			return invalid()
+		}
+		if st.mnemonic == "SKP" {
+			return []uint16{0xE09E | x<<8}, nil
+		}
+		return []uint16{0xE0A1 | x<<8}, nil
+	case "PITCH":
+		x, ok := register(0)
+		if !expect(1) || !ok {
+			return invalid()
+		}
+		return []uint16{0xF03A | x<<8}, nil
+	case "LD":
+		if len(operands) != 2 {
+			return invalid()
+		}
+
+		// LD VX-VY, [I] and LD [I], VX-VY (XO-CHIP)
+		if x, y, ok := parseRegisterRange(operands[0]); ok && is(1, "[I]") {
+			return []uint16{0x5003 | x<<8 | y<<4}, nil
+		}
+		if x, y, ok := parseRegisterRange(operands[1]); ok && is(0, "[I]") {
+			return []uint16{0x5002 | x<<8 | y<<4}, nil
+		}
+
+		if _, ok := register(0); ok {
+			switch {
+			case is(1, "DT"):
+				return fx(0xF007, 0)
+			case is(1, "K"):
+				return fx(0xF00A, 0)
+			case is(1, "[I]"):
+				return fx(0xF065, 0)
+			case is(1, "R"):
+				return fx(0xF085, 0)
+			}
+			if _, ok := register(1); ok {
+				return xy(0x8000)
+			}
+			return xnn(0x6000)
+		}
+
+		switch {
+		case is(0, "I"):
+			if strings.HasPrefix(strings.ToUpper(operands[1]), "LONG ") {
+				address, err := a.value(st, operands[1][len("LONG "):], 0xFFFF)
+				if err != nil {
+					return nil, err
+				}
+				return []uint16{0xF000, address}, nil
+			}
+			return nnn(0xA000, operands[1])
+		case is(0, "DT"):
+			return fx(0xF015, 1)
+		case is(0, "ST"):
+			return fx(0xF018, 1)
+		case is(0, "F"):
+			return fx(0xF029, 1)
+		case is(0, "HF"):
+			return fx(0xF030, 1)
+		case is(0, "B"):
+			return fx(0xF033, 1)
+		case is(0, "[I]"):
+			return fx(0xF055, 1)
+		case is(0, "R"):
+			return fx(0xF075, 1)
+		}
+		return invalid()
+	}
+	return nil, st.errorf("unknown instruction %s", st.mnemonic)
+}
@@ -0,0 +1,332 @@
+package asm
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Address where the ROMs are loaded and start executing
+const RomAddress = 0x200
+
+// Biggest ROM that fits in the XO-CHIP memory
+const maxRomSize = 0x10000 - RomAddress
+
+// Program is an assembled ROM
+type Program struct {
+	// Bytes of the ROM, loaded at RomAddress
+	Code []byte
+	// Addresses of the labels
+	Labels map[string]uint16
+	// Source line of every statement by its address, used to map the executed instructions back to the source
+	Lines map[uint16]SourceLine
+}
+
+// SourceLine is a line of a source file, macros are mapped to the line of their invocation
+type SourceLine struct {
+	File string
+	Line int
+}
+
+// statement is a parsed line that emits bytes
+type statement struct {
+	line
+	address  int
+	mnemonic string
+	operands []string
+}
+
+// assembler keeps the state of the 2 passes
+// -----------
+// The first pass parses the statements, computing the address of every label
+// (the size of a statement never depends on the value of its operands).
+// The second pass evaluates the operands and encodes the statements.
+// -----------
+type assembler struct {
+	statements []statement
+	labels     map[string]uint16
+	// Constants are evaluated in the order they are defined, after the labels are known
+	constantNames []string
+	constantLines map[string]line
+	constantTexts map[string]string
+	symbols       map[string]int
+}
+
+// Assemble assembles the source file at path.
+// -----------
+// Syntax (mnemonics and registers are case insensitive):
+// label:                  defines a label at the current address
+// NAME = 0x10             defines a constant (NAME EQU 0x10 also works)
+// LD V3, NAME + 1         instructions in Cowgod's syntax, as written by disasm.Disassemble with disasm.Cowgod
+// BRK                     the emulator specific breakpoint (0x0001)
+// DB 0x12, 0x34           bytes of data (:byte 0x12 0x34 also works)
+// DW 0x1234               16 bit words of data
+// SPRITE "..####.."       sprite rows, # / X / 1 are set pixels, 8 or 16 pixels wide
+// INCLUDE "file.asm"      includes another file
+// MACRO name a, b / ENDM  defines a macro
+// ; or #                  comments
+// -----------
+func Assemble(path string) (*Program, error) {
+	s := &source{macros: map[string]*macro{}}
+	if err := s.load(path, 0); err != nil {
+		return nil, err
+	}
+
+	a := &assembler{
+		labels:        map[string]uint16{},
+		constantLines: map[string]line{},
+		constantTexts: map[string]string{},
+		symbols:       map[string]int{},
+	}
+	if err := a.firstPass(s.lines); err != nil {
+		return nil, err
+	}
+	code, err := a.secondPass()
+	if err != nil {
+		return nil, err
+	}
+	lines := map[uint16]SourceLine{}
+	for _, st := range a.statements {
+		lines[uint16(st.address)] = SourceLine{File: st.file, Line: st.number}
+	}
+	return &Program{Code: code, Labels: a.labels, Lines: lines}, nil
+}
+
+func (a *assembler) defineSymbol(l line, name string) error {
+	if !isIdentifier(name) {
+		return l.errorf("invalid symbol name %q", name)
+	}
+	if _, isRegister := parseRegister(name); isRegister || isReservedOperand(name) {
+		return l.errorf("symbol name %q is reserved", name)
+	}
+	if _, ok := a.symbols[name]; ok {
+		return l.errorf("symbol %s is already defined", name)
+	}
+	a.symbols[name] = 0
+	return nil
+}
+
+func (a *assembler) firstPass(lines []line) error {
+	address := RomAddress
+	for _, l := range lines {
+		label, text := splitLabel(l.text)
+		if label != "" {
+			if err := a.defineSymbol(l, label); err != nil {
+				return err
+			}
+			a.labels[label] = uint16(address)
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// Constants
+		if len(fields) >= 3 && (fields[1] == "=" || strings.EqualFold(fields[1], "EQU")) {
+			name := fields[0]
+			if err := a.defineSymbol(l, name); err != nil {
+				return err
+			}
+			a.constantNames = append(a.constantNames, name)
+			a.constantLines[name] = l
+			a.constantTexts[name] = strings.TrimSpace(text[strings.Index(text, fields[1])+len(fields[1]):])
+			continue
+		}
+
+		st := statement{line: l, address: address, mnemonic: strings.ToUpper(fields[0])}
+		rest := strings.TrimSpace(text[len(fields[0]):])
+		switch st.mnemonic {
+		case "DB", ":BYTE", "DW", "SPRITE":
+			// Data can be separated by commas or spaces
+			st.operands = strings.FieldsFunc(rest, func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t'
+			})
+		default:
+			st.operands = splitOperands(rest)
+		}
+		size, err := st.size()
+		if err != nil {
+			return err
+		}
+		address += size
+		if address-RomAddress > maxRomSize {
+			return l.errorf("program does not fit in memory (%d bytes, max size: %d)", address-RomAddress, maxRomSize)
+		}
+		a.statements = append(a.statements, st)
+	}
+	return nil
+}
+
+func (a *assembler) secondPass() ([]byte, error) {
+	for name, address := range a.labels {
+		a.symbols[name] = int(address)
+	}
+	// Constants that are not evaluated yet can not be used
+	for _, name := range a.constantNames {
+		delete(a.symbols, name)
+	}
+	for _, name := range a.constantNames {
+		value, err := a.evaluate(a.constantLines[name], a.constantTexts[name])
+		if err != nil {
+			return nil, err
+		}
+		a.symbols[name] = value
+	}
+
+	code := []byte{}
+	for _, st := range a.statements {
+		encoded, err := a.encode(st)
+		if err != nil {
+			return nil, err
+		}
+		code = append(code, encoded...)
+	}
+	return code, nil
+}
+
+// size returns the amount of bytes emitted by a statement.
+func (st statement) size() (int, error) {
+	switch st.mnemonic {
+	case "DB", ":BYTE":
+		return len(st.operands), nil
+	case "DW":
+		return 2 * len(st.operands), nil
+	case "SPRITE":
+		size := 0
+		for _, row := range st.operands {
+			pixels, err := strconv.Unquote(row)
+			if err != nil || (len(pixels) != 8 && len(pixels) != 16) {
+				return 0, st.errorf("sprite rows must be quoted and 8 or 16 pixels wide (ex: SPRITE \"..####..\")")
+			}
+			size += len(pixels) / 8
+		}
+		return size, nil
+	case "LD":
+		if len(st.operands) == 2 && strings.HasPrefix(strings.ToUpper(st.operands[1]), "LONG ") {
+			return 4, nil
+		}
+	}
+	return 2, nil
+}
+
+// evaluate evaluates an expression, which is a sum of numbers and symbols (ex: label + 2, NAME - 0x10, label + -1).
+func (a *assembler) evaluate(l line, text string) (int, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return 0, l.errorf("missing value")
+	}
+	result := 0
+	sign := 1
+	term := ""
+	apply := func() error {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			return l.errorf("invalid expression %q", text)
+		}
+		value, err := a.evaluateTerm(l, term)
+		if err != nil {
+			return err
+		}
+		result += sign * value
+		term = ""
+		return nil
+	}
+	for _, r := range text {
+		if r == '+' || r == '-' {
+			// A sign after a term is an operator, the others are unary signs of the next term (ex: -1, label + -2)
+			if strings.TrimSpace(term) != "" {
+				if err := apply(); err != nil {
+					return 0, err
+				}
+				sign = 1
+			}
+			if r == '-' {
+				sign = -sign
+			}
+			continue
+		}
+		term += string(r)
+	}
+	if err := apply(); err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+func (a *assembler) evaluateTerm(l line, term string) (int, error) {
+	if value, ok := a.symbols[term]; ok {
+		return value, nil
+	}
+	lower := strings.ToLower(term)
+	var value int64
+	var err error
+	switch {
+	case strings.HasPrefix(lower, "0x"):
+		value, err = strconv.ParseInt(lower[2:], 16, 32)
+	case strings.HasPrefix(lower, "0b"):
+		value, err = strconv.ParseInt(lower[2:], 2, 32)
+	case strings.HasPrefix(lower, "$"):
+		value, err = strconv.ParseInt(lower[1:], 16, 32)
+	case len(lower) > 0 && lower[0] >= '0' && lower[0] <= '9':
+		value, err = strconv.ParseInt(lower, 10, 32)
+	default:
+		if _, isConstant := a.constantLines[term]; isConstant {
+			return 0, l.errorf("constant %s is used before it is defined", term)
+		}
+		return 0, l.errorf("undefined symbol %s", term)
+	}
+	if err != nil {
+		return 0, l.errorf("invalid number %s", term)
+	}
+	return int(value), nil
+}
+
+// WriteSymbols writes the symbol map of the program, one "ADDRESS LABEL" line per label sorted by address.
+func (p *Program) WriteSymbols(w io.Writer) error {
+	names := []string{}
+	for name := range p.Labels {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if p.Labels[names[i]] != p.Labels[names[j]] {
+			return p.Labels[names[i]] < p.Labels[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "0x%03X %s\n", p.Labels[name], name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFiles writes the ROM to romPath and the symbol map (see WriteSymbols) to symbolsPath.
+func (p *Program) WriteFiles(romPath string, symbolsPath string) error {
+	if err := ioutil.WriteFile(romPath, p.Code, 0644); err != nil {
+		return err
+	}
+	f, err := os.Create(symbolsPath)
+	if err != nil {
+		return err
+	}
+	if err := p.WriteSymbols(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func isIdentifier(name string) bool {
+	for i, r := range name {
+		isLetter := r == '_' || r == '.' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		if !isLetter && (i == 0 || r < '0' || r > '9') {
+			return false
+		}
+	}
+	return name != ""
+}
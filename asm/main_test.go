@@ -0,0 +1,105 @@
+package asm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/raveltan/chip-fa/disasm"
+)
+
+// assembleText assembles source code written to a temporary file.
+func assembleText(t *testing.T, text string) (*Program, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "game.asm")
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Assemble(path)
+}
+
+// roundTrip disassembles a ROM with Cowgod's syntax and assembles it back, which must give the same ROM.
+func roundTrip(t *testing.T, name string, rom []byte) {
+	t.Helper()
+	text := disasm.Disassemble(rom, disasm.Cowgod)
+	program, err := assembleText(t, text)
+	if err != nil {
+		t.Fatalf("%s: unable to assemble the disassembly, %v", name, err)
+	}
+	if !bytes.Equal(program.Code, rom) {
+		for i := range rom {
+			if i >= len(program.Code) || program.Code[i] != rom[i] {
+				t.Fatalf("%s: the assembled ROM differs at 0x%03x (%d bytes, expected %d)", name, RomAddress+i, len(program.Code), len(rom))
+			}
+		}
+		t.Fatalf("%s: the assembled ROM is %d bytes long, expected %d", name, len(program.Code), len(rom))
+	}
+}
+
+func TestRoundTripRoms(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("..", "roms", "*.ch8"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no ROMs found, %v", err)
+	}
+	for _, path := range paths {
+		rom, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, filepath.Base(path), rom)
+	}
+}
+
+func TestRoundTripInstructions(t *testing.T) {
+	// Every instruction is reached by the execution, thus none of them is written as data
+	rom := []byte{}
+	for operationCode := 0; operationCode <= 0xFFFF; operationCode += 0x13 {
+		instruction := disasm.Decode(uint16(operationCode))
+		switch instruction.Op {
+		case disasm.OpUnknown, disasm.OpJP, disasm.OpRET, disasm.OpEXIT, disasm.OpJPV0, disasm.OpLDILong:
+			continue
+		}
+		rom = append(rom, uint8(operationCode>>8), uint8(operationCode))
+	}
+	// XO-CHIP long load, then the end of the program
+	rom = append(rom, 0xF0, 0x00, 0x12, 0x34)
+	end := RomAddress + len(rom)
+	rom = append(rom, 0x10|uint8(end>>8&0xF), uint8(end))
+	roundTrip(t, "instructions", rom)
+}
+
+func TestRoundTripData(t *testing.T) {
+	// Code that points I to data, data that is never executed, and bytes that look like instructions
+	rom := []byte{0xA2, 0x08, 0xD0, 0x15, 0x12, 0x04, 0x00, 0x00, 0x3C, 0x42, 0x81, 0xFF, 0x00, 0xE0, 0x23}
+	roundTrip(t, "data", rom)
+}
+
+func TestEvaluate(t *testing.T) {
+	program, err := assembleText(t, strings.Join([]string{
+		"BASE = 0x300",
+		"NEGATIVE = -2",
+		"start:",
+		"    LD I, BASE + -1",
+		"    LD I, BASE - -1",
+		"    LD I, BASE + NEGATIVE",
+		"    LD I, -NEGATIVE + 0x10",
+		"    LD V0, +3",
+		"    LD V1, start - start + 0b101",
+		"    JP start + 2 - 2",
+	}, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0xA2, 0xFF, 0xA3, 0x01, 0xA2, 0xFE, 0xA0, 0x12, 0x60, 0x03, 0x61, 0x05, 0x12, 0x00}
+	if !bytes.Equal(program.Code, expected) {
+		t.Fatalf("assembled % x, expected % x", program.Code, expected)
+	}
+
+	for _, expression := range []string{"BASE +", "BASE + - ", "- ", "BASE * 2"} {
+		if _, err := assembleText(t, "BASE = 0x300\n    LD I, "+expression+"\n"); err == nil {
+			t.Errorf("%q was assembled, expected an error", expression)
+		}
+	}
+}
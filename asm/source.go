@@ -0,0 +1,180 @@
+package asm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Includes and macros that go deeper than this are most likely recursive
+const maxDepth = 32
+
+// line is a single line of source code after the includes and the macros are expanded
+type line struct {
+	file   string
+	number int
+	text   string
+}
+
+func (l line) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", l.file, l.number, fmt.Sprintf(format, args...))
+}
+
+type macro struct {
+	name       string
+	parameters []string
+	body       []line
+}
+
+// source loads the source files, expanding the includes and the macros
+// -----------
+// INCLUDE "file.asm" inserts the lines of another file, relative to the including file.
+// MACRO name param1, param2 starts a macro which ends with ENDM, the macro is invoked
+// by its name followed by the arguments (ex: name V0, 0x10). Parameters are replaced by
+// the arguments as whole words and \@ is replaced by a number that is unique to each invocation,
+// to be able to define labels inside of macros.
+// -----------
+type source struct {
+	lines       []line
+	macros      map[string]*macro
+	invocations int
+}
+
+func (s *source) load(path string, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("%s: includes are nested too deeply", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var current *macro
+	for i, text := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		l := line{file: path, number: i + 1, text: stripComment(text)}
+		fields := strings.Fields(l.text)
+		keyword := ""
+		if len(fields) > 0 {
+			keyword = strings.ToUpper(fields[0])
+		}
+
+		if current != nil {
+			if keyword == "ENDM" {
+				s.macros[current.name] = current
+				current = nil
+				continue
+			}
+			current.body = append(current.body, l)
+			continue
+		}
+
+		switch keyword {
+		case "MACRO":
+			if len(fields) < 2 {
+				return l.errorf("missing macro name")
+			}
+			current = &macro{name: fields[1]}
+			for _, parameter := range splitOperands(strings.Join(fields[2:], " ")) {
+				current.parameters = append(current.parameters, parameter)
+			}
+		case "ENDM":
+			return l.errorf("ENDM without MACRO")
+		case "INCLUDE":
+			included, err := strconv.Unquote(strings.TrimSpace(l.text[len(fields[0]):]))
+			if err != nil {
+				return l.errorf("include path must be quoted (ex: INCLUDE \"sprites.asm\")")
+			}
+			if !filepath.IsAbs(included) {
+				included = filepath.Join(filepath.Dir(path), included)
+			}
+			if err := s.load(included, depth+1); err != nil {
+				return err
+			}
+		default:
+			if err := s.add(l, 0); err != nil {
+				return err
+			}
+		}
+	}
+	if current != nil {
+		return fmt.Errorf("%s: macro %s is missing ENDM", path, current.name)
+	}
+	return nil
+}
+
+// add adds a line, expanding it when it invokes a macro.
+func (s *source) add(l line, depth int) error {
+	label, statement := splitLabel(l.text)
+	fields := strings.Fields(statement)
+	if len(fields) == 0 {
+		s.lines = append(s.lines, l)
+		return nil
+	}
+	m, ok := s.macros[fields[0]]
+	if !ok {
+		s.lines = append(s.lines, l)
+		return nil
+	}
+	if depth > maxDepth {
+		return l.errorf("macros are nested too deeply")
+	}
+
+	arguments := splitOperands(strings.TrimSpace(statement[len(fields[0]):]))
+	if len(arguments) != len(m.parameters) {
+		return l.errorf("macro %s expects %d arguments, got %d", m.name, len(m.parameters), len(arguments))
+	}
+	if label != "" {
+		s.lines = append(s.lines, line{file: l.file, number: l.number, text: label + ":"})
+	}
+	s.invocations++
+	for _, bodyLine := range m.body {
+		text := strings.ReplaceAll(bodyLine.text, `\@`, strconv.Itoa(s.invocations))
+		for i, parameter := range m.parameters {
+			text = regexp.MustCompile(`\b`+regexp.QuoteMeta(parameter)+`\b`).ReplaceAllLiteralString(text, arguments[i])
+		}
+		// Errors of the expanded lines are reported at the invocation
+		if err := s.add(line{file: l.file, number: l.number, text: text}, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stripComment removes the comment (; or #) of a line, ignoring the ones inside of quotes.
+func stripComment(text string) string {
+	inQuotes := false
+	for i, r := range text {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case (r == ';' || r == '#') && !inQuotes:
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// splitLabel splits the label definition (label:) from the statement of a line.
+func splitLabel(text string) (label string, statement string) {
+	trimmed := strings.TrimSpace(text)
+	index := strings.Index(trimmed, ":")
+	// Octo style directives (:byte) start with a colon, and quoted strings may contain colons
+	if index <= 0 || strings.ContainsAny(trimmed[:index], " \t\",") {
+		return "", trimmed
+	}
+	return trimmed[:index], strings.TrimSpace(trimmed[index+1:])
+}
+
+// splitOperands splits comma separated operands.
+func splitOperands(text string) (operands []string) {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	for _, operand := range strings.Split(text, ",") {
+		operands = append(operands, strings.TrimSpace(operand))
+	}
+	return
+}
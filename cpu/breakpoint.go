@@ -0,0 +1,157 @@
+package cpu
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Breakpoint stops the execution before the instruction at Address is fetched,
+// calling StopForDebuggingCallback. Conditional breakpoints only stop when their Condition is true.
+type Breakpoint struct {
+	ID      int
+	Address uint16
+	// nil when the breakpoint is unconditional
+	Condition *Condition
+	// Amount of times the breakpoint stopped the execution
+	HitCount int
+}
+
+// Condition compares 2 operands, which are either a part of the CPU state or a constant.
+// -----------
+// Operands: v0 - vf, i, pc, sp, dt (delay timer), st (sound timer) or a number (ex: 0x10, 16)
+// Operators: ==, !=, <, <=, >, >=
+// Example: v3 == 0x10
+// -----------
+type Condition struct {
+	Left     string
+	Operator string
+	Right    string
+}
+
+// Operators are matched in this order, thus the longer ones are before their prefixes
+var conditionOperators = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// ParseCondition parses a breakpoint condition, spaces between the operands are optional.
+func ParseCondition(text string) (*Condition, error) {
+	text = strings.ToLower(strings.Join(strings.Fields(text), ""))
+	for _, operator := range conditionOperators {
+		index := strings.Index(text, operator)
+		if index < 0 {
+			continue
+		}
+		condition := &Condition{Left: text[:index], Operator: operator, Right: text[index+len(operator):]}
+		// Validate the operands against a blank CPU, so invalid conditions are reported when they are created
+		for _, operand := range []string{condition.Left, condition.Right} {
+			if _, err := (&CPU{}).conditionOperand(operand); err != nil {
+				return nil, err
+			}
+		}
+		return condition, nil
+	}
+	return nil, fmt.Errorf("invalid condition %q, expected <operand> <operator> <operand> (ex: v3 == 0x10)", text)
+}
+
+func (c *Condition) String() string {
+	return c.Left + " " + c.Operator + " " + c.Right
+}
+
+// Evaluate returns whether the condition is true for the current state of the CPU.
+func (c *Condition) Evaluate(cpu *CPU) bool {
+	// Operands are validated by ParseCondition, thus the errors can be ignored
+	left, _ := cpu.conditionOperand(c.Left)
+	right, _ := cpu.conditionOperand(c.Right)
+	switch c.Operator {
+	case "==":
+		return left == right
+	case "!=":
+		return left != right
+	case "<":
+		return left < right
+	case "<=":
+		return left <= right
+	case ">":
+		return left > right
+	case ">=":
+		return left >= right
+	}
+	return false
+}
+
+func (c *CPU) conditionOperand(operand string) (uint64, error) {
+	switch operand {
+	case "i":
+		return uint64(c.IndexRegister), nil
+	case "pc":
+		return uint64(c.ProgramCounter), nil
+	case "sp":
+		return uint64(c.StackPointer), nil
+	case "dt":
+		return uint64(c.DelayTimer), nil
+	case "st":
+		return uint64(c.SoundTimer), nil
+	}
+	if len(operand) == 2 && operand[0] == 'v' {
+		if register, err := strconv.ParseUint(operand[1:], 16, 8); err == nil {
+			return uint64(c.Register[register]), nil
+		}
+	}
+	value, err := strconv.ParseUint(operand, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid operand %q, must be v0 - vf, i, pc, sp, dt, st or a number", operand)
+	}
+	return value, nil
+}
+
+// AddBreakpoint adds a breakpoint at address, condition can be nil for an unconditional breakpoint.
+func (c *CPU) AddBreakpoint(address uint16, condition *Condition) *Breakpoint {
+	c.lastBreakpointID++
+	breakpoint := &Breakpoint{ID: c.lastBreakpointID, Address: address, Condition: condition}
+	c.breakpoints = append(c.breakpoints, breakpoint)
+	return breakpoint
+}
+
+// DeleteBreakpoint removes the breakpoint with the given ID, returning false when there is none.
+func (c *CPU) DeleteBreakpoint(id int) bool {
+	for i, breakpoint := range c.breakpoints {
+		if breakpoint.ID == id {
+			c.breakpoints = append(c.breakpoints[:i], c.breakpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Breakpoints returns the breakpoints in the order they were added.
+func (c *CPU) Breakpoints() []*Breakpoint {
+	return append([]*Breakpoint{}, c.breakpoints...)
+}
+
+// checkBreakpoints returns whether the execution should stop before fetching the current instruction.
+func (c *CPU) checkBreakpoints() bool {
+	// The instruction of the breakpoint that stopped the execution is executed
+	// on the next cycle, otherwise the execution could never be resumed.
+	if c.resumingBreakpoint {
+		c.resumingBreakpoint = false
+		if c.ProgramCounter == c.resumingBreakpointAddress {
+			return false
+		}
+	}
+
+	hit := false
+	for _, breakpoint := range c.breakpoints {
+		if breakpoint.Address != c.ProgramCounter {
+			continue
+		}
+		if breakpoint.Condition != nil && !breakpoint.Condition.Evaluate(c) {
+			continue
+		}
+		breakpoint.HitCount++
+		hit = true
+	}
+	if hit {
+		c.resumingBreakpoint = true
+		c.resumingBreakpointAddress = c.ProgramCounter
+	}
+	return hit
+}
@@ -0,0 +1,68 @@
+package cpu
+
+import "testing"
+
+func TestBreakpointCondition(t *testing.T) {
+	// 0x200: 7001  ADD V0, 0x01
+	// 0x202: 1200  JP 0x200
+	c := newTestCPU(Quirks{}, 0x7001, 0x1200)
+	condition, err := ParseCondition("v0 == 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	breakpoint := c.AddBreakpoint(0x202, condition)
+	stops := 0
+	c.StopForDebuggingCallback = func() {
+		stops++
+	}
+
+	// The breakpoint is only hit once V0 reaches 3, the instruction is not executed when it stops
+	run(t, c, 6)
+	if stops != 1 || breakpoint.HitCount != 1 || c.ProgramCounter != 0x202 || c.Register[0] != 3 || c.Cycles != 5 {
+		t.Fatalf("%d stops (%d hits) at 0x%03x with V0 = %d after %d cycles, expected the stop at 0x202 with V0 = 3",
+			stops, breakpoint.HitCount, c.ProgramCounter, c.Register[0], c.Cycles)
+	}
+	// The instruction of the breakpoint is executed when resuming, the condition is false afterwards
+	run(t, c, 8)
+	if stops != 1 || c.Register[0] != 7 {
+		t.Fatalf("%d stops with V0 = %d, expected a single stop", stops, c.Register[0])
+	}
+
+	for _, text := range []string{"", "v0", "vg == 1", "v0 === 1", "x < 2"} {
+		if _, err := ParseCondition(text); err == nil {
+			t.Errorf("the condition %q was parsed", text)
+		}
+	}
+}
+
+func TestWatchpointHit(t *testing.T) {
+	// 0x200: A300  LD I, 0x300
+	// 0x202: 6042  LD V0, 0x42
+	// 0x204: F055  LD [I], V0
+	// 0x206: F065  LD V0, [I]
+	c := newTestCPU(Quirks{}, 0xA300, 0x6042, 0xF055, 0xF065)
+	write := c.AddWatchpoint(0x300, WatchWrite)
+	read := c.AddWatchpoint(0x300, WatchRead)
+	c.AddWatchpoint(0x301, WatchReadWrite)
+	hits := []WatchpointHit{}
+	c.StopForWatchpointCallback = func(instructionHits []WatchpointHit) {
+		hits = append(hits, instructionHits...)
+	}
+
+	run(t, c, 4)
+	expected := []WatchpointHit{
+		{Watchpoint: write, ProgramCounter: 0x204, OperationCode: 0xF055, Write: true, OldValue: 0x00, NewValue: 0x42},
+		{Watchpoint: read, ProgramCounter: 0x206, OperationCode: 0xF065, OldValue: 0x42, NewValue: 0x42},
+	}
+	if len(hits) != len(expected) {
+		t.Fatalf("%d watchpoint hits %+v, expected %d", len(hits), hits, len(expected))
+	}
+	for i := range expected {
+		if hits[i] != expected[i] {
+			t.Errorf("hit %d is %+v, expected %+v", i, hits[i], expected[i])
+		}
+	}
+	if write.HitCount != 1 || read.HitCount != 1 {
+		t.Errorf("hit counts %d and %d, expected 1 and 1", write.HitCount, read.HitCount)
+	}
+}
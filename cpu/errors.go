@@ -0,0 +1,39 @@
+package cpu
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// Returned by DoCycle when a subroutine is called while all of the stack entries are in use.
+	ErrStackOverflow = errors.New("stack overflow")
+	// Returned by DoCycle when returning from a subroutine while the stack is empty.
+	ErrStackUnderflow = errors.New("stack underflow")
+	// Returned by DoCycle when an instruction reads or writes outside of the Memory.
+	ErrMemoryOutOfBounds = errors.New("memory access out of bounds")
+	// Returned by DoCycle when the program exits the interpreter with 00FD (SUPER-CHIP).
+	ErrProgramExited = errors.New("program exited")
+	// Returned by LoadROM when the ROM does not fit in the program memory.
+	ErrRomTooBig = errors.New("ROM size is too big for this system")
+)
+
+// UnknownOpcodeError is returned by DoCycle when the fetched operationCode
+// does not belong to the supported instruction set.
+type UnknownOpcodeError struct {
+	// Address where the operationCode was fetched from
+	ProgramCounter uint16
+	OperationCode  uint16
+}
+
+func (e *UnknownOpcodeError) Error() string {
+	return fmt.Sprintf("unknown operationCode (0x%04x) at 0x%03x", e.OperationCode, e.ProgramCounter)
+}
+
+// checkMemoryRange makes sure that length bytes starting at address are inside the Memory.
+func (c *CPU) checkMemoryRange(address uint16, length int) error {
+	if int(address)+length > c.MemorySize() {
+		return fmt.Errorf("%w: 0x%x (+%d) at 0x%03x", ErrMemoryOutOfBounds, address, length, c.ProgramCounter)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package cpu
 
 import (
+	"fmt"
 	"math/rand"
 )
 
@@ -10,27 +11,109 @@ func (c *CPU) doAdvanceProgramCounter() {
 	c.ProgramCounter += 2
 }
 
+func (c *CPU) doSkipNextInstruction() {
+	// F000 NNNN is 4 bytes long, thus it needs to be skipped entirely (XO-CHIP)
+	// Peeking at the skipped instruction is not an access of the program, thus it is not watched
+	next := int(c.ProgramCounter) + 2
+	if next+1 < c.MemorySize() && c.Memory[next] == 0xF0 && c.Memory[next+1] == 0x00 {
+		c.ProgramCounter += 2
+	}
+	c.doAdvanceProgramCounter()
+}
+
 // 0x0*** Instructions
 func (c *CPU) do00E0() {
+	// Only the selected planes are cleared (XO-CHIP)
 	for i := range c.Screen {
-		c.Screen[i] = 0
+		c.Screen[i] &^= c.Planes
 	}
 	c.ShouldDraw = true
 	c.doAdvanceProgramCounter()
 }
 
 func (c *CPU) do0001() {
-	c.StopForDebuggingCallback()
+	if c.StopForDebuggingCallback != nil {
+		c.StopForDebuggingCallback()
+	}
+	c.doAdvanceProgramCounter()
+}
+
+func (c *CPU) do00CN(operationCode uint16) {
+	c.scrollScreen(0, int(operationCode&0x000F))
+	c.doAdvanceProgramCounter()
+}
+
+func (c *CPU) do00DN(operationCode uint16) {
+	c.scrollScreen(0, -int(operationCode&0x000F))
+	c.doAdvanceProgramCounter()
+}
+
+func (c *CPU) do00FB() {
+	c.scrollScreen(4, 0)
 	c.doAdvanceProgramCounter()
 }
 
-func (c *CPU) do000E() {
+func (c *CPU) do00FC() {
+	c.scrollScreen(-4, 0)
+	c.doAdvanceProgramCounter()
+}
+
+func (c *CPU) do00FE() {
+	c.setHighResolution(false)
+	c.doAdvanceProgramCounter()
+}
+
+func (c *CPU) do00FF() {
+	c.setHighResolution(true)
+	c.doAdvanceProgramCounter()
+}
+
+// scrollScreen moves every pixel of the selected planes by dx and dy,
+// pixels that are moved out of the screen are discarded.
+func (c *CPU) scrollScreen(dx, dy int) {
+	width, height := c.ScreenWidth(), c.ScreenHeight()
+	scrolled := [len(c.Screen)]uint8{}
+	for i := range scrolled {
+		// Unselected planes are not scrolled (XO-CHIP)
+		scrolled[i] = c.Screen[i] &^ c.Planes
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			newX, newY := x+dx, y+dy
+			if newX < 0 || newX >= width || newY < 0 || newY >= height {
+				continue
+			}
+			scrolled[newX+newY*width] |= c.Screen[x+y*width] & c.Planes
+		}
+	}
+	c.Screen = scrolled
+	c.ShouldDraw = true
+}
+
+// setHighResolution switches the screen resolution and clears the screen.
+func (c *CPU) setHighResolution(enabled bool) {
+	c.HighResolution = enabled
+	for i := range c.Screen {
+		c.Screen[i] = 0
+	}
+	c.ShouldDraw = true
+}
+
+func (c *CPU) do000E() error {
+	if c.StackPointer == 0 {
+		return fmt.Errorf("%w at 0x%03x", ErrStackUnderflow, c.ProgramCounter)
+	}
+	// The stack pointer may have been set past the stack by a debugger
+	if int(c.StackPointer) > len(c.Stack) {
+		return fmt.Errorf("%w at 0x%03x, stack pointer is 0x%x", ErrStackOverflow, c.ProgramCounter, c.StackPointer)
+	}
 	// Decrease the stack pointer to the previous one
 	c.StackPointer--
 	// Re-assign the program counter to the program counter on the previous stack
 	c.ProgramCounter = c.Stack[c.StackPointer]
 
 	c.doAdvanceProgramCounter()
+	return nil
 }
 
 // 0x1*** Instructions
@@ -39,7 +122,10 @@ func (c *CPU) do1NNN(operationCode uint16) {
 }
 
 // 0x2*** Instructions
-func (c *CPU) do2NNN(operationCode uint16) {
+func (c *CPU) do2NNN(operationCode uint16) error {
+	if int(c.StackPointer) >= len(c.Stack) {
+		return fmt.Errorf("%w at 0x%03x", ErrStackOverflow, c.ProgramCounter)
+	}
 	// Store the current location of the program counter to the stack
 	// And increment the stack pointer
 	// to insert a new entry to the stack with the last progarm counter posiiton
@@ -47,13 +133,14 @@ func (c *CPU) do2NNN(operationCode uint16) {
 	c.StackPointer++
 	// change the program counter to the current subroutine location
 	c.ProgramCounter = operationCode & 0x0FFF
+	return nil
 }
 
 // 0x3*** Instructions
 func (c *CPU) do3XNN(operationCode uint16) {
 	// If value of register X == NN skip next instruction
 	if c.Register[(operationCode&0x0F00)>>8] == (uint8(operationCode & 0x00FF)) {
-		c.doAdvanceProgramCounter()
+		c.doSkipNextInstruction()
 	}
 	c.doAdvanceProgramCounter()
 }
@@ -62,7 +149,7 @@ func (c *CPU) do3XNN(operationCode uint16) {
 func (c *CPU) do4XNN(operationCode uint16) {
 	// If value of register X != NN skip next instruction
 	if c.Register[(operationCode&0x0F00)>>8] != (uint8(operationCode & 0x00FF)) {
-		c.doAdvanceProgramCounter()
+		c.doSkipNextInstruction()
 	}
 	c.doAdvanceProgramCounter()
 }
@@ -71,11 +158,51 @@ func (c *CPU) do4XNN(operationCode uint16) {
 func (c *CPU) do5XY0(operationCode uint16) {
 	// If value of register X == value of register Y skip next instruction
 	if c.Register[(operationCode&0x0F00)>>8] == c.Register[(operationCode&0x00F0)>>4] {
-		c.doAdvanceProgramCounter()
+		c.doSkipNextInstruction()
 	}
 	c.doAdvanceProgramCounter()
 }
 
+func (c *CPU) do5XY2(operationCode uint16) error {
+	x, y := int((operationCode&0x0F00)>>8), int((operationCode&0x00F0)>>4)
+	// The registers can be stored in reverse order when X > Y
+	step := 1
+	if x > y {
+		step = -1
+	}
+	if err := c.checkMemoryRange(c.IndexRegister, (y-x)*step+1); err != nil {
+		return err
+	}
+	for i, register := 0, x; ; i, register = i+1, register+step {
+		c.writeMemory(int(c.IndexRegister)+i, c.Register[register])
+		if register == y {
+			break
+		}
+	}
+	c.doAdvanceProgramCounter()
+	return nil
+}
+
+func (c *CPU) do5XY3(operationCode uint16) error {
+	x, y := int((operationCode&0x0F00)>>8), int((operationCode&0x00F0)>>4)
+	// The registers can be loaded in reverse order when X > Y
+	step := 1
+	if x > y {
+		step = -1
+	}
+	if err := c.checkMemoryRange(c.IndexRegister, (y-x)*step+1); err != nil {
+		return err
+	}
+	for i, register := 0, x; ; i, register = i+1, register+step {
+		c.Register[register] = c.readMemory(int(c.IndexRegister) + i)
+		if register == y {
+			break
+		}
+	}
+	c.doAdvanceProgramCounter()
+	return nil
+}
+
 // 0x6*** Instructions
 func (c *CPU) do6XNN(operationCode uint16) {
 	c.Register[(operationCode&0x0F00)>>8] = uint8(operationCode & 0x00FF)
@@ -96,16 +223,25 @@ func (c *CPU) do8XY0(operationCode uint16) {
 
 func (c *CPU) do8XY1(operationCode uint16) {
 	c.Register[(operationCode&0x0F00)>>8] = c.Register[(operationCode&0x0F00)>>8] | c.Register[(operationCode&0x00F0)>>4]
+	if c.Quirks.VFReset {
+		c.Register[0xF] = 0
+	}
 	c.doAdvanceProgramCounter()
 }
 
 func (c *CPU) do8XY2(operationCode uint16) {
 	c.Register[(operationCode&0x0F00)>>8] = c.Register[(operationCode&0x0F00)>>8] & c.Register[(operationCode&0x00F0)>>4]
+	if c.Quirks.VFReset {
+		c.Register[0xF] = 0
+	}
 	c.doAdvanceProgramCounter()
 }
 
 func (c *CPU) do8XY3(operationCode uint16) {
 	c.Register[(operationCode&0x0F00)>>8] = c.Register[(operationCode&0x0F00)>>8] ^ c.Register[(operationCode&0x00F0)>>4]
+	if c.Quirks.VFReset {
+		c.Register[0xF] = 0
+	}
 	c.doAdvanceProgramCounter()
 }
 
@@ -113,52 +249,63 @@ func (c *CPU) do8XY4(operationCode uint16) {
 	// Get the value of X and Y from the operationCode
 	registerXLocation, registerYLocation := (operationCode&0x0F00)>>8, (operationCode&0x00F0)>>4
 	// Get the value of X + Y
-	result := c.Register[registerXLocation] + c.Register[registerYLocation]
+	result := uint16(c.Register[registerXLocation]) + uint16(c.Register[registerYLocation])
+	// Set the result
+	// VF is set after the result, so that the flag wins when X is VF
+	c.Register[registerXLocation] = uint8(result)
 	// If there is an overflow, set the overflow flag on register VF (0xF) to 1
-	if c.Register[registerXLocation]+c.Register[registerYLocation] > 0xFF {
+	if result > 0xFF {
 		c.Register[0xF] = 1
 	} else {
 		c.Register[0xF] = 0
 	}
-	// Set the result
-	c.Register[registerXLocation] = result
 	c.doAdvanceProgramCounter()
 }
 
 func (c *CPU) do8XY5(operationCode uint16) {
-	if c.Register[(operationCode&0x0F00)>>8] < c.Register[(operationCode&0x00F0)>>4] {
+	x, y := c.Register[(operationCode&0x0F00)>>8], c.Register[(operationCode&0x00F0)>>4]
+	c.Register[(operationCode&0x0F00)>>8] = x - y
+	if x < y {
 		c.Register[0xF] = 0
 	} else {
 		c.Register[0xF] = 1
 	}
-	c.Register[(operationCode&0x0F00)>>8] -= c.Register[(operationCode&0x00F0)>>4]
 	c.doAdvanceProgramCounter()
 }
 func (c *CPU) do8XY6(operationCode uint16) {
-	c.Register[0xF] = c.Register[(operationCode&0x0F00)>>8] & 0x1
-	c.Register[(operationCode&0x0F00)>>8] >>= 1
+	value := c.Register[(operationCode&0x00F0)>>4]
+	if c.Quirks.ShiftVX {
+		value = c.Register[(operationCode&0x0F00)>>8]
+	}
+	c.Register[(operationCode&0x0F00)>>8] = value >> 1
+	c.Register[0xF] = value & 0x1
 	c.doAdvanceProgramCounter()
 }
 
 func (c *CPU) do8XY7(operationCode uint16) {
-	if c.Register[(operationCode&0x0F00)>>8] > c.Register[(operationCode&0x00F0)>>4] {
+	x, y := c.Register[(operationCode&0x0F00)>>8], c.Register[(operationCode&0x00F0)>>4]
+	c.Register[(operationCode&0x0F00)>>8] = y - x
+	if x > y {
 		c.Register[0xF] = 0
 	} else {
 		c.Register[0xF] = 1
 	}
-	c.Register[(operationCode&0x0F00)>>8] = c.Register[(operationCode&0x00F0)>>4] - c.Register[(operationCode&0x0F00)>>8]
 	c.doAdvanceProgramCounter()
 }
 func (c *CPU) do8XYE(operationCode uint16) {
-	c.Register[0xF] = c.Register[(operationCode&0x0F00)>>8] >> 7
-	c.Register[(operationCode&0x0F00)<<8] <<= 1
+	value := c.Register[(operationCode&0x00F0)>>4]
+	if c.Quirks.ShiftVX {
+		value = c.Register[(operationCode&0x0F00)>>8]
+	}
+	c.Register[(operationCode&0x0F00)>>8] = value << 1
+	c.Register[0xF] = value >> 7
 	c.doAdvanceProgramCounter()
 }
 
 // 0x9*** Instructions
 func (c *CPU) do9XY0(operationCode uint16) {
 	if c.Register[(operationCode&0x0F00)>>8] != c.Register[(operationCode&0x00F0)>>4] {
-		c.doAdvanceProgramCounter()
+		c.doSkipNextInstruction()
 	}
 	c.doAdvanceProgramCounter()
 }
@@ -172,6 +319,11 @@ func (c *CPU) doANNN(operationCode uint16) {
 
 // 0xB*** Instructions
 func (c *CPU) doBNNN(operationCode uint16) {
+	if c.Quirks.JumpVX {
+		// BXNN: Jumps to the address XNN plus VX.
+		c.ProgramCounter = (operationCode & 0x0FFF) + uint16(c.Register[(operationCode&0x0F00)>>8])
+		return
+	}
 	c.ProgramCounter = (operationCode & 0x0FFF) + uint16(c.Register[0])
 }
 
@@ -182,51 +334,119 @@ func (c *CPU) doCXNN(operationCode uint16) {
 }
 
 // 0xD*** Instructions
-func (c *CPU) doDXYN(operationCode uint16) {
-	x, y, h := uint16(c.Register[(operationCode&0x0F00)>>8]), uint16(c.Register[(operationCode&0x00F0)>>4]), operationCode&0x000F
-	pixelData := uint16(0)
+func (c *CPU) doDXYN(operationCode uint16) error {
+	width, height := c.ScreenWidth(), c.ScreenHeight()
+	// The starting position always wraps around the screen
+	x, y := int(c.Register[(operationCode&0x0F00)>>8])%width, int(c.Register[(operationCode&0x00F0)>>4])%height
+	// Sprites are 8 pixels wide, with the exception of DXY0 that draws 16x16 sprites (SUPER-CHIP)
+	spriteWidth, spriteHeight := 8, int(operationCode&0x000F)
+	if spriteHeight == 0 {
+		spriteWidth, spriteHeight = 16, 16
+	}
+	bytesPerRow := spriteWidth / 8
+	spriteSize := spriteHeight * bytesPerRow
+
+	// Sprite data of each selected plane is stored one after another (XO-CHIP)
+	selectedPlanes := 0
+	for plane := uint8(1); plane <= 2; plane <<= 1 {
+		if c.Planes&plane != 0 {
+			selectedPlanes++
+		}
+	}
+	if err := c.checkMemoryRange(c.IndexRegister, spriteSize*selectedPlanes); err != nil {
+		return err
+	}
 
 	// Track if any pixels are flipped from set to unset.
 
 	c.Register[0xF] = 0
-	for yline := uint16(0); yline < h; yline++ {
-		pixelData = uint16(c.Memory[c.IndexRegister+uint16(yline)])
-
-		for xline := uint16(0); xline < 8; xline++ {
-
-			index := (x + xline + ((y + yline) * 64))
-			// Fix for offscreen rendering
-			if index >= uint16(len(c.Screen)) {
-				continue
+	spriteAddress := int(c.IndexRegister)
+	for plane := uint8(1); plane <= 2; plane <<= 1 {
+		if c.Planes&plane == 0 {
+			continue
+		}
+		for yline := 0; yline < spriteHeight; yline++ {
+			// Pixel data is aligned to the left of a 16 bit row
+			rowAddress := spriteAddress + yline*bytesPerRow
+			pixelData := uint16(c.readMemory(rowAddress)) << 8
+			if bytesPerRow == 2 {
+				pixelData |= uint16(c.readMemory(rowAddress + 1))
 			}
-			if (pixelData & (0x80 >> xline)) != 0 {
-				if c.Screen[index] == 1 {
-					c.Register[0xF] = 1
+			pixelY := y + yline
+			if pixelY >= height {
+				if c.Quirks.Clipping {
+					break
+				}
+				pixelY %= height
+			}
+
+			for xline := 0; xline < spriteWidth; xline++ {
+				pixelX := x + xline
+				if pixelX >= width {
+					if c.Quirks.Clipping {
+						break
+					}
+					pixelX %= width
+				}
+				index := pixelX + pixelY*width
+				if (pixelData & (0x8000 >> xline)) != 0 {
+					if c.Screen[index]&plane != 0 {
+						c.Register[0xF] = 1
+					}
+					c.Screen[index] ^= plane
 				}
-				c.Screen[index] ^= 1
 			}
 		}
+		spriteAddress += spriteSize
 	}
 
 	c.ShouldDraw = true
 	c.doAdvanceProgramCounter()
+	return nil
 }
 
 // 0xE*** Instructions
 func (c *CPU) doEX9E(operationCode uint16) {
-	if c.KeypadStates[c.Register[(operationCode&0x0F00)>>8]] != 0 {
-		c.doAdvanceProgramCounter()
+	if c.KeypadStates[c.Register[(operationCode&0x0F00)>>8]&0xF] != 0 {
+		c.doSkipNextInstruction()
 	}
 	c.doAdvanceProgramCounter()
 }
 func (c *CPU) doEXA1(operationCode uint16) {
-	if c.KeypadStates[c.Register[(operationCode&0x0F00)>>8]] == 0 {
-		c.doAdvanceProgramCounter()
+	if c.KeypadStates[c.Register[(operationCode&0x0F00)>>8]&0xF] == 0 {
+		c.doSkipNextInstruction()
 	}
 	c.doAdvanceProgramCounter()
 }
 
 // 0xF*** Instructions
+func (c *CPU) doF000() error {
+	if err := c.checkMemoryRange(c.ProgramCounter, 4); err != nil {
+		return err
+	}
+	// The address is stored on the 2 bytes after the operationCode
+	c.IndexRegister = uint16(c.readMemory(int(c.ProgramCounter)+2))<<8 | uint16(c.readMemory(int(c.ProgramCounter)+3))
+	c.ProgramCounter += 4
+	return nil
+}
+
+func (c *CPU) doFN01(operationCode uint16) {
+	c.Planes = uint8((operationCode&0x0F00)>>8) & 0x3
+	c.doAdvanceProgramCounter()
+}
+
+func (c *CPU) doF002() error {
+	if err := c.checkMemoryRange(c.IndexRegister, len(c.AudioPattern)); err != nil {
+		return err
+	}
+	for i := range c.AudioPattern {
+		c.AudioPattern[i] = c.readMemory(int(c.IndexRegister) + i)
+	}
+	c.AudioPatternLoaded = true
+	c.doAdvanceProgramCounter()
+	return nil
+}
+
 func (c *CPU) doFX07(operationCode uint16) {
 	c.Register[(operationCode&0x0F00)>>8] = c.DelayTimer
 	c.doAdvanceProgramCounter()
@@ -256,50 +476,91 @@ func (c *CPU) doFX18(operationCode uint16) {
 	c.doAdvanceProgramCounter()
 }
 func (c *CPU) doFX1E(operationCode uint16) {
-	if c.IndexRegister+uint16(c.Register[(operationCode&0x0F00)>>8]) > 0xFFF {
-		c.Register[0xF] = 1
-	} else {
-		c.Register[0xF] = 0
+	if c.Quirks.IndexOverflow {
+		if c.IndexRegister+uint16(c.Register[(operationCode&0x0F00)>>8]) > 0xFFF {
+			c.Register[0xF] = 1
+		} else {
+			c.Register[0xF] = 0
+		}
 	}
 	c.IndexRegister += uint16(c.Register[(operationCode&0x0F00)>>8])
 	c.doAdvanceProgramCounter()
 }
 
 func (c *CPU) doFX29(operationCode uint16) {
-	c.IndexRegister = uint16(c.Register[(operationCode&0x0F00)>>8]) * 0x5
+	c.IndexRegister = fontsetAddress + uint16(c.Register[(operationCode&0x0F00)>>8]&0xF)*0x5
 	c.doAdvanceProgramCounter()
 }
-func (c *CPU) doFX33(operationCode uint16) {
+
+func (c *CPU) doFX3A(operationCode uint16) {
+	c.Pitch = c.Register[(operationCode&0x0F00)>>8]
+	c.doAdvanceProgramCounter()
+}
+
+func (c *CPU) doFX30(operationCode uint16) {
+	c.IndexRegister = bigFontsetAddress + uint16(c.Register[(operationCode&0x0F00)>>8]&0xF)*0xA
+	c.doAdvanceProgramCounter()
+}
+func (c *CPU) doFX33(operationCode uint16) error {
+	if err := c.checkMemoryRange(c.IndexRegister, 3); err != nil {
+		return err
+	}
 	// Get the value at register X
 	registerXValue := c.Register[(operationCode&0x0F00)>>8]
 	// Set the hundred's value of x to memory[I]
-	c.Memory[c.IndexRegister] = registerXValue / 100
+	c.writeMemory(int(c.IndexRegister), registerXValue/100)
 	// Set the ten's value of x to memory[I+1]
-	c.Memory[c.IndexRegister+1] = (registerXValue / 10) % 10
+	c.writeMemory(int(c.IndexRegister)+1, (registerXValue/10)%10)
 	// Set the one's value of x to memory[I+2]
-	c.Memory[c.IndexRegister+2] = (registerXValue % 100) % 10
+	c.writeMemory(int(c.IndexRegister)+2, (registerXValue%100)%10)
 	c.doAdvanceProgramCounter()
+	return nil
 }
 
-func (c *CPU) doFX55(operationCode uint16) {
+func (c *CPU) doFX55(operationCode uint16) error {
+	if err := c.checkMemoryRange(c.IndexRegister, int((operationCode&0x0F00)>>8)+1); err != nil {
+		return err
+	}
 	for i := 0; i <= int((operationCode&0x0F00)>>8); i++ {
-		c.Memory[int(c.IndexRegister)+i] = c.Register[i]
+		c.writeMemory(int(c.IndexRegister)+i, c.Register[i])
 	}
 
 	// On the original system
 	// When the operation is done
 	// indexRegistered += X + 1
-
-	c.IndexRegister += (operationCode&0x0F00)>>8 + 1
+	if c.Quirks.IncrementIndex {
+		c.IndexRegister += (operationCode&0x0F00)>>8 + 1
+	}
 	c.doAdvanceProgramCounter()
+	return nil
 }
 
-func (c *CPU) doFX65(operationCode uint16) {
+func (c *CPU) doFX65(operationCode uint16) error {
+	if err := c.checkMemoryRange(c.IndexRegister, int((operationCode&0x0F00)>>8)+1); err != nil {
+		return err
+	}
 	for i := 0; i <= int((operationCode&0x0F00)>>8); i++ {
-		c.Register[i] = c.Memory[int(c.IndexRegister)+i]
+		c.Register[i] = c.readMemory(int(c.IndexRegister) + i)
 	}
 
 	// On the original interpreter, when the operation is done, I = I + X + 1.
-	c.IndexRegister += (operationCode&0x0F00)>>8 + 1
+	if c.Quirks.IncrementIndex {
+		c.IndexRegister += (operationCode&0x0F00)>>8 + 1
+	}
+	c.doAdvanceProgramCounter()
+	return nil
+}
+
+func (c *CPU) doFX75(operationCode uint16) {
+	for i := 0; i <= int((operationCode&0x0F00)>>8); i++ {
+		c.RPLFlags[i] = c.Register[i]
+	}
+	c.doAdvanceProgramCounter()
+}
+
+func (c *CPU) doFX85(operationCode uint16) {
+	for i := 0; i <= int((operationCode&0x0F00)>>8); i++ {
+		c.Register[i] = c.RPLFlags[i]
+	}
 	c.doAdvanceProgramCounter()
 }
@@ -1,14 +1,19 @@
 package cpu
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
+
+	"github.com/raveltan/chip-fa/disasm"
 )
 
 type CPU struct {
 	// Most common implementation of Chip8 uses 4k of Memory
 	// https://en.wikipedia.org/wiki/CHIP-8#Memory
-	Memory [4096]uint8
+	// XO-CHIP extends the address space to 64k, thus the Memory is allocated for the biggest size
+	// and only the first MemorySize() bytes are used.
+	Memory [0x10000]uint8
 
 	// Chip8's Register is a 1 byte general purpose Register V0,V1...VE.
 	Register [16]uint8
@@ -20,12 +25,30 @@ type CPU struct {
 	ProgramCounter uint16
 
 	// Chip8's screen is 64 x 32 black and white screen.
-	Screen [64 * 32]uint8
+	// SUPER-CHIP adds a 128 x 64 high resolution mode, thus the Screen is allocated for the biggest resolution
+	// and only the first ScreenWidth() * ScreenHeight() pixels are used.
+	Screen [128 * 64]uint8
+	// Whether the 128 x 64 high resolution mode is active (SUPER-CHIP)
+	HighResolution bool
+
+	// Bitmask of the planes used by the drawing instructions (XO-CHIP)
+	// Each pixel of the Screen stores plane 1 on bit 0 and plane 2 on bit 1
+	Planes uint8
+
+	// SUPER-CHIP's RPL user flags, used by FX75 and FX85
+	RPLFlags [16]uint8
+
+	// XO-CHIP's 1 bit audio pattern of 128 samples, played while the sound timer is active
+	AudioPattern [16]uint8
+	// Whether the audio pattern has been loaded by F002, otherwise the default buzzer is used
+	AudioPatternLoaded bool
+	// Playback rate of the audio pattern, 4000 * 2^((Pitch - 64) / 48) samples per second
+	Pitch uint8
 
 	// Timers (60Hz)
 	DelayTimer uint8
-	// Will buzz the system when it reaches 0
-	// Updated on the rendering side
+	// The system buzzes while it is not 0
+	// Both timers are decremented by UpdateTimers
 	SoundTimer uint8
 
 	// Chip8's Stack
@@ -42,7 +65,31 @@ type CPU struct {
 	// that always draws 60Hz thus this flag is ignored.
 	ShouldDraw bool
 
+	// Behaviors of the emulated interpreter, see QuirksPresets
+	Quirks Quirks
+
+	// Called when the execution is stopped by a breakpoint (see AddBreakpoint) or by 0001
 	StopForDebuggingCallback func()
+	breakpoints              []*Breakpoint
+	lastBreakpointID         int
+	// Set after a breakpoint stops the execution, to execute the instruction at the breakpoint when resuming
+	resumingBreakpoint        bool
+	resumingBreakpointAddress uint16
+
+	// Called after an instruction that triggered watchpoints (see AddWatchpoint) is executed
+	StopForWatchpointCallback func([]WatchpointHit)
+	watchpoints               []*Watchpoint
+	// Watchpoints triggered by the current instruction
+	watchpointHits []WatchpointHit
+
+	// Amount of instructions executed by DoCycle since the CPU booted
+	Cycles uint64
+	// Called after each executed instruction with its address and operationCode,
+	// the CPU state is already updated by the instruction (see the trace package)
+	TraceCallback func(programCounter uint16, operationCode uint16)
+
+	// SHA-256 of the loaded ROM, used to match save states with their ROM
+	romHash [32]byte
 }
 
 func (c *CPU) Boot() {
@@ -50,11 +97,40 @@ func (c *CPU) Boot() {
 	// Program counter should start at application entry point
 	// Adreesses before 0x200 is commonly used by the interpreter
 	c.ProgramCounter = 0x200
+	c.Planes = 1
+	c.Pitch = 64
 
 	// Load fontset to memory
 	for i, v := range fontset {
-		c.Memory[i] = v
+		c.Memory[fontsetAddress+i] = v
+	}
+	for i, v := range bigFontset {
+		c.Memory[bigFontsetAddress+i] = v
+	}
+}
+
+// MemorySize returns the size of the memory of the emulated interpreter, see Quirks.MemorySize.
+func (c *CPU) MemorySize() int {
+	if c.Quirks.MemorySize != 0 {
+		return c.Quirks.MemorySize
 	}
+	return defaultMemorySize
+}
+
+// ScreenWidth returns the width of the current screen resolution.
+func (c *CPU) ScreenWidth() int {
+	if c.HighResolution {
+		return 128
+	}
+	return 64
+}
+
+// ScreenHeight returns the height of the current screen resolution.
+func (c *CPU) ScreenHeight() int {
+	if c.HighResolution {
+		return 64
+	}
+	return 32
 }
 
 func (c *CPU) LoadROM(file string) error {
@@ -62,18 +138,26 @@ func (c *CPU) LoadROM(file string) error {
 	if err != nil {
 		return err
 	}
-	if len(rom) > maxRomSize {
-		panic("error: ROM size is too big for this system. Max size: 3232 (0xEA0 - 0x200)")
+	maxSize := maxRomSize
+	if c.Quirks.MaxRomSize != 0 {
+		maxSize = c.Quirks.MaxRomSize
+	}
+	if len(rom) > maxSize {
+		return fmt.Errorf("%w: %d bytes, max size: %d", ErrRomTooBig, len(rom), maxSize)
 	}
 
 	for i := 0; i < len(rom); i++ {
 		c.Memory[0x200+i] = rom[i]
 	}
+	c.romHash = sha256.Sum256(rom)
 
 	return nil
 }
 
-func (c *CPU) DoCycle() {
+// DoCycle fetches, decodes and executes a single instruction.
+// Errors are returned before the faulty instruction changes the CPU state,
+// thus the program counter still points to the instruction that caused it.
+func (c *CPU) DoCycle() error {
 	// Fetch operationCode
 	// gets opCode on the memory address specified by the programCounter
 	// memory is one byte while program counter is 2 bytes, thus we need to fetch [addr] and [addr+1]
@@ -89,182 +173,250 @@ func (c *CPU) DoCycle() {
 	// Resulting 0xFF10 as the operationCode
 	// -----------
 
-	currentOperationCode := uint16(c.Memory[c.ProgramCounter])<<8 | uint16(c.Memory[c.ProgramCounter+1])
+	// Breakpoints stop the execution before the instruction is fetched,
+	// the cycle is not executed as the debugger may change the CPU state.
+	if len(c.breakpoints) > 0 && c.checkBreakpoints() {
+		if c.StopForDebuggingCallback != nil {
+			c.StopForDebuggingCallback()
+		}
+		return nil
+	}
+
+	if err := c.checkMemoryRange(c.ProgramCounter, 2); err != nil {
+		return err
+	}
+	c.watchpointHits = c.watchpointHits[:0]
+	currentOperationCode := uint16(c.readMemory(int(c.ProgramCounter)))<<8 | uint16(c.readMemory(int(c.ProgramCounter)+1))
+	// The instructions change the program counter, it is kept for the trace
+	programCounter := c.ProgramCounter
+	var err error
 
 	// Decode operationCode
 	// operationCode table: https://en.wikipedia.org/wiki/CHIP-8#Opcode_table
 
-	// Check for the first 4 bit of the operationCode by using bitwise
-	// and branch out for each.
+	// The operationCode is decoded by the disasm package, which is also used by the debugger
+	// and the disassembler, thus the executed and the disassembled instructions always match.
+	// -----------
 	// Example
 	// 0x8123
-	// Get operationCode by doing operationCode & 0xF000
-	// 0x8123 & 0xF000
-	// => 0x8000
-	// Which is the first 4 bit of the operationCode
-	switch currentOperationCode & 0xF000 {
-	case 0x0000:
-		switch currentOperationCode & 0x000F {
-		// 0NNN: Call machine code routine (not used in most ROMS). (NOT IMPLEMENTED)
-		case 0x0000:
-			// 00E0: Clear Screen.
-			c.do00E0()
-		case 0x0001:
-			// 0001: PROGRAM BREAKPOINT
-			// TODO: Add to documentation
-			c.do0001()
-		case 0x000E:
-			// 00EE: Retrun from subroutine.
-			c.do000E()
-		default:
-			panic(fmt.Sprintf("error: Unknown operationCode (0x%x)", currentOperationCode))
-		}
-	case 0x1000:
+	// disasm.Decode(0x8123)
+	// => Op: disasm.OpOR (8XY1), X: 0x1, Y: 0x2
+	// -----------
+	switch disasm.Decode(currentOperationCode).Op {
+	// 0NNN: Call machine code routine (not used in most ROMS). (NOT IMPLEMENTED)
+	case disasm.OpCLS:
+		// 00E0: Clear Screen.
+		c.do00E0()
+	case disasm.OpBRK:
+		// 0001: PROGRAM BREAKPOINT
+		c.do0001()
+	case disasm.OpRET:
+		// 00EE: Retrun from subroutine.
+		err = c.do000E()
+	case disasm.OpSCD:
+		// 00CN: Scrolls the screen down by N pixels. (SUPER-CHIP)
+		c.do00CN(currentOperationCode)
+	case disasm.OpSCU:
+		// 00DN: Scrolls the selected planes up by N pixels. (XO-CHIP)
+		c.do00DN(currentOperationCode)
+	case disasm.OpSCR:
+		// 00FB: Scrolls the screen right by 4 pixels. (SUPER-CHIP)
+		c.do00FB()
+	case disasm.OpSCL:
+		// 00FC: Scrolls the screen left by 4 pixels. (SUPER-CHIP)
+		c.do00FC()
+	case disasm.OpEXIT:
+		// 00FD: Exits the interpreter. (SUPER-CHIP)
+		return ErrProgramExited
+	case disasm.OpLOW:
+		// 00FE: Switches to the 64x32 low resolution mode. (SUPER-CHIP)
+		c.do00FE()
+	case disasm.OpHIGH:
+		// 00FF: Switches to the 128x64 high resolution mode. (SUPER-CHIP)
+		c.do00FF()
+	case disasm.OpJP:
 		// 1NNN: Jumps to address NNN.
 		c.do1NNN(currentOperationCode)
-	case 0x2000:
+	case disasm.OpCALL:
 		// 2NNN: Call subroutine at NNN.
-		c.do2NNN(currentOperationCode)
-	case 0x3000:
+		err = c.do2NNN(currentOperationCode)
+	case disasm.OpSEByte:
 		// 3XNN: Skips the next instruction if VX equals NN.
 		// (Usually the next instruction is a jump to skip a code block)
 		c.do3XNN(currentOperationCode)
-	case 0x4000:
+	case disasm.OpSNEByte:
 		// 4XNN: Skips the next instruction if VX doesn't equal NN.
 		// (Usually the next instruction is a jump to skip a code block)
 		c.do4XNN(currentOperationCode)
-	case 0x5000:
+	case disasm.OpSEReg:
 		// 5XY0: Skips the next instruction if VX equals VY.
 		// (Usually the next instruction is a jump to skip a code block)
 		c.do5XY0(currentOperationCode)
-	case 0x6000:
+	case disasm.OpSaveRange:
+		// 5XY2: Stores VX to VY (including VY) in memory starting at address I. (XO-CHIP)
+		// I itself is left unmodified.
+		err = c.do5XY2(currentOperationCode)
+	case disasm.OpLoadRange:
+		// 5XY3: Fills VX to VY (including VY) with values from memory starting at address I. (XO-CHIP)
+		// I itself is left unmodified.
+		err = c.do5XY3(currentOperationCode)
+	case disasm.OpLDByte:
 		// 6XNN: Sets VX to NN.
 		c.do6XNN(currentOperationCode)
-	case 0x7000:
+	case disasm.OpADDByte:
 		// 7XNN: Adds NN to VX. (Carry flag is not changed)
 		c.do7XNN(currentOperationCode)
-	case 0x8000:
-		switch currentOperationCode & 0x000F {
-		case 0x0000:
-			// 8XY0: Sets VX to the value of VY.
-			c.do8XY0(currentOperationCode)
-		case 0x0001:
-			// 8XY1: Sets VX to VX or VY. (Bitwise OR operation)
-			c.do8XY1(currentOperationCode)
-		case 0x0002:
-			// 8XY2: Sets VX to VX and VY. (Bitwise AND operation)
-			c.do8XY2(currentOperationCode)
-		case 0x0003:
-			// 8XY3: Sets VX to VX xor VY.
-			c.do8XY3(currentOperationCode)
-		case 0x0004:
-			// 8XY4: Adds VY to VX. VF is set to 1 when there's a carry, and to 0 when there isn't.
-			c.do8XY4(currentOperationCode)
-		case 0x0005:
-			// 8XY5: VY is subtracted from VX. VF is set to 0 when there's a borrow, and 1 when there isn't.
-			c.do8XY5(currentOperationCode)
-		case 0x0006:
-			// 8XY6: Stores the least significant bit of VX in VF and then shifts VX to the right by 1.
-			c.do8XY6(currentOperationCode)
-		case 0x0007:
-			// 8XY7: Sets VX to VY minus VX. VF is set to 0 when there's a borrow, and 1 when there isn't.
-			c.do8XY7(currentOperationCode)
-		case 0x000E:
-			// 8XYE: Stores the most significant bit of VX in VF and then shifts VX to the left by 1.
-			c.do8XYE(currentOperationCode)
-		default:
-			panic(fmt.Sprintf("error: Unknown operationCode (0x%x)", currentOperationCode))
-		}
-
-	case 0x9000:
+	case disasm.OpLDReg:
+		// 8XY0: Sets VX to the value of VY.
+		c.do8XY0(currentOperationCode)
+	case disasm.OpOR:
+		// 8XY1: Sets VX to VX or VY. (Bitwise OR operation)
+		c.do8XY1(currentOperationCode)
+	case disasm.OpAND:
+		// 8XY2: Sets VX to VX and VY. (Bitwise AND operation)
+		c.do8XY2(currentOperationCode)
+	case disasm.OpXOR:
+		// 8XY3: Sets VX to VX xor VY.
+		c.do8XY3(currentOperationCode)
+	case disasm.OpADDReg:
+		// 8XY4: Adds VY to VX. VF is set to 1 when there's a carry, and to 0 when there isn't.
+		c.do8XY4(currentOperationCode)
+	case disasm.OpSUB:
+		// 8XY5: VY is subtracted from VX. VF is set to 0 when there's a borrow, and 1 when there isn't.
+		c.do8XY5(currentOperationCode)
+	case disasm.OpSHR:
+		// 8XY6: Stores the least significant bit of VX in VF and then shifts VX to the right by 1.
+		c.do8XY6(currentOperationCode)
+	case disasm.OpSUBN:
+		// 8XY7: Sets VX to VY minus VX. VF is set to 0 when there's a borrow, and 1 when there isn't.
+		c.do8XY7(currentOperationCode)
+	case disasm.OpSHL:
+		// 8XYE: Stores the most significant bit of VX in VF and then shifts VX to the left by 1.
+		c.do8XYE(currentOperationCode)
+	case disasm.OpSNEReg:
 		// 9XY0: Skips the next instruction if VX doesn't equal VY.
 		// (Usually the next instruction is a jump to skip a code block)
 		c.do9XY0(currentOperationCode)
-	case 0xA000:
+	case disasm.OpLDI:
 		// ANNN: Sets I to the address NNN.
 		c.doANNN(currentOperationCode)
-
-	case 0xB000:
+	case disasm.OpJPV0:
 		// BNNN: Jumps to the address NNN plus V0.
 		c.doBNNN(currentOperationCode)
-	case 0xC000:
+	case disasm.OpRND:
 		// CXNN: Sets VX to the result of a bitwise and operation on a random number.
 		// (Typically: 0 to 255) and NN.
 		c.doCXNN(currentOperationCode)
-	case 0xD000:
+	case disasm.OpDRW:
 		// DXYN: Draws a sprite at coordinate (VX, VY) that has a width of 8 pixels and a height of N+1 pixels.
+		// DXY0 draws a 16x16 sprite instead. (SUPER-CHIP)
 		// Each row of 8 pixels is read as bit-coded starting from memory location I;
 		// I value doesn’t change after the execution of this instruction. As described above,
 		// VF is set to 1 if any screen pixels are flipped from set to unset when the sprite is drawn,
 		// and to 0 if that doesn’t happen
-		c.doDXYN(currentOperationCode)
-	case 0xE000:
-		switch currentOperationCode & 0x000F {
-		case 0x000E:
-			// EX9E: Skips the next instruction if the key stored in VX is pressed.
-			// (Usually the next instruction is a jump to skip a code block)
-			c.doEX9E(currentOperationCode)
-		case 0x0001:
-			// EXA1: Skips the next instruction if the key stored in VX isn't pressed.
-			// (Usually the next instruction is a jump to skip a code block)
-			c.doEXA1(currentOperationCode)
-		default:
-			panic(fmt.Sprintf("error: Unknown operationCode (0x%x)", currentOperationCode))
-		}
-	case 0xF000:
-		switch currentOperationCode & 0x000F {
-		case 0x0007:
-			// FX07: Sets VX to the value of the delay timer.
-			c.doFX07(currentOperationCode)
-		case 0x000A:
-			// FX0A: A key press is awaited, and then stored in VX.
-			// (Blocking Operation. All instruction halted until next key event)
-			c.doFX0A(currentOperationCode)
-		case 0x0005:
-			switch currentOperationCode & 0x00F0 {
-			case 0x0010:
-				// FX15: Sets the delay timer to VX.
-				c.doFX15(currentOperationCode)
-			case 0x0050:
-				// FX55: Stores V0 to VX (including VX) in memory starting at address I.
-				// The offset from I is increased by 1 for each value written, but I itself is left unmodified.
-				c.doFX55(currentOperationCode)
-			case 0x0060:
-				// FX65: Fills V0 to VX (including VX) with values from memory starting at address I.
-				// The offset from I is increased by 1 for each value written, but I itself is left unmodified.
-				c.doFX65(currentOperationCode)
-			default:
-				panic(fmt.Sprintf("error: Unknown operationCode (0x%x)", currentOperationCode))
-			}
-		case 0x0008:
-			// FX18: Sets the sound timer to VX.
-			c.doFX18(currentOperationCode)
-		case 0x000E:
-			// FX1E: Adds VX to I. VF is not affected.
-			c.doFX1E(currentOperationCode)
-		case 0x0009:
-			// FX29: Sets I to the location of the sprite for the character in VX.
-			//  Characters 0-F (in hexadecimal) are represented by a 4x5 font.
-			c.doFX29(currentOperationCode)
-		case 0x0003:
-			// FX33: Stores the binary-coded decimal representation of VX,
-			// with the most significant of three digits at the address in I,
-			// the middle digit at I plus 1, and the least significant digit at I plus 2.
-			// (In other words, take the decimal representation of VX,
-			// place the hundreds digit in memory at location in I, the tens digit at location I+1,
-			// and the ones digit at location I+2.)
-			c.doFX33(currentOperationCode)
-		default:
-			panic(fmt.Sprintf("error: Unknown operationCode (0x%x)", currentOperationCode))
-
-		}
+		err = c.doDXYN(currentOperationCode)
+	case disasm.OpSKP:
+		// EX9E: Skips the next instruction if the key stored in VX is pressed.
+		// (Usually the next instruction is a jump to skip a code block)
+		c.doEX9E(currentOperationCode)
+	case disasm.OpSKNP:
+		// EXA1: Skips the next instruction if the key stored in VX isn't pressed.
+		// (Usually the next instruction is a jump to skip a code block)
+		c.doEXA1(currentOperationCode)
+	case disasm.OpLDILong:
+		// F000 NNNN: Sets I to the 16 bit address NNNN stored after the operationCode. (XO-CHIP)
+		err = c.doF000()
+	case disasm.OpPLANE:
+		// FN01: Selects the drawing planes by the bitmask N. (XO-CHIP)
+		c.doFN01(currentOperationCode)
+	case disasm.OpAUDIO:
+		// F002: Loads 16 bytes starting at address I to the audio pattern buffer. (XO-CHIP)
+		err = c.doF002()
+	case disasm.OpLDVxDT:
+		// FX07: Sets VX to the value of the delay timer.
+		c.doFX07(currentOperationCode)
+	case disasm.OpLDVxK:
+		// FX0A: A key press is awaited, and then stored in VX.
+		// (Blocking Operation. All instruction halted until next key event)
+		c.doFX0A(currentOperationCode)
+	case disasm.OpLDDTVx:
+		// FX15: Sets the delay timer to VX.
+		c.doFX15(currentOperationCode)
+	case disasm.OpLDSTVx:
+		// FX18: Sets the sound timer to VX.
+		c.doFX18(currentOperationCode)
+	case disasm.OpADDIVx:
+		// FX1E: Adds VX to I. VF is not affected, unless the IndexOverflow quirk is enabled.
+		c.doFX1E(currentOperationCode)
+	case disasm.OpLDFVx:
+		// FX29: Sets I to the location of the sprite for the character in VX.
+		//  Characters 0-F (in hexadecimal) are represented by a 4x5 font.
+		c.doFX29(currentOperationCode)
+	case disasm.OpLDHFVx:
+		// FX30: Sets I to the location of the big sprite for the character in VX.
+		// Characters 0-F (in hexadecimal) are represented by a 8x10 font. (SUPER-CHIP)
+		c.doFX30(currentOperationCode)
+	case disasm.OpPITCH:
+		// FX3A: Sets the audio pattern playback pitch to VX. (XO-CHIP)
+		c.doFX3A(currentOperationCode)
+	case disasm.OpLDBVx:
+		// FX33: Stores the binary-coded decimal representation of VX,
+		// with the most significant of three digits at the address in I,
+		// the middle digit at I plus 1, and the least significant digit at I plus 2.
+		// (In other words, take the decimal representation of VX,
+		// place the hundreds digit in memory at location in I, the tens digit at location I+1,
+		// and the ones digit at location I+2.)
+		err = c.doFX33(currentOperationCode)
+	case disasm.OpLDIVx:
+		// FX55: Stores V0 to VX (including VX) in memory starting at address I.
+		// The offset from I is increased by 1 for each value written, but I itself is left unmodified.
+		err = c.doFX55(currentOperationCode)
+	case disasm.OpLDVxI:
+		// FX65: Fills V0 to VX (including VX) with values from memory starting at address I.
+		// The offset from I is increased by 1 for each value written, but I itself is left unmodified.
+		err = c.doFX65(currentOperationCode)
+	case disasm.OpLDRVx:
+		// FX75: Stores V0 to VX (including VX) in the RPL user flags. (SUPER-CHIP)
+		c.doFX75(currentOperationCode)
+	case disasm.OpLDVxR:
+		// FX85: Fills V0 to VX (including VX) with values from the RPL user flags. (SUPER-CHIP)
+		c.doFX85(currentOperationCode)
 	default:
-		panic(fmt.Sprintf("error: Unknown operationCode (0x%x)", currentOperationCode))
+		// The operation code may have been read by a watchpoint, which is reported before the error
+		err = &UnknownOpcodeError{ProgramCounter: c.ProgramCounter, OperationCode: currentOperationCode}
+	}
+
+	if err != nil {
+		// The accesses done before the error are reported first, the error halts the emulation afterwards
+		c.reportWatchpointHits()
+		return err
 	}
 
-	// Sound timer is updated on the rendering side
+	c.Cycles++
+	if c.TraceCallback != nil {
+		c.TraceCallback(programCounter, currentOperationCode)
+	}
+
+	// Watchpoints stop the execution after the instruction, to report the values it has written
+	c.reportWatchpointHits()
+
+	return nil
+}
+
+// reportWatchpointHits calls StopForWatchpointCallback with the watchpoints triggered by the current instruction.
+func (c *CPU) reportWatchpointHits() {
+	if len(c.watchpointHits) > 0 && c.StopForWatchpointCallback != nil {
+		c.StopForWatchpointCallback(c.watchpointHits)
+	}
+}
 
+// UpdateTimers decrements the delay and sound timers,
+// it should be called 60 times per second regardless of the amount of executed cycles.
+func (c *CPU) UpdateTimers() {
 	if c.DelayTimer > 0 {
 		c.DelayTimer--
 	}
+	if c.SoundTimer > 0 {
+		c.SoundTimer--
+	}
 }
@@ -0,0 +1,75 @@
+package cpu
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Quirks describes the behaviors that differ between the CHIP-8 interpreters.
+// Most ROMs are written against a specific interpreter and will misbehave
+// when they are run with a different set of quirks.
+// https://github.com/Timendus/chip8-test-suite#quirks-test
+type Quirks struct {
+	// 8XY1, 8XY2 and 8XY3 reset VF to 0 after the operation (COSMAC VIP).
+	VFReset bool
+	// FX55 and FX65 increment I by X + 1 (COSMAC VIP),
+	// otherwise I is left unmodified (CHIP-48, SUPER-CHIP).
+	IncrementIndex bool
+	// 8XY6 and 8XYE shift VX in place and ignore VY (CHIP-48, SUPER-CHIP),
+	// otherwise VY is shifted and stored into VX (COSMAC VIP).
+	ShiftVX bool
+	// BNNN behaves as BXNN and jumps to XNN + VX (CHIP-48, SUPER-CHIP),
+	// otherwise it jumps to NNN + V0 (COSMAC VIP).
+	JumpVX bool
+	// FX1E sets VF to 1 when I goes past 0xFFF and to 0 otherwise (CHIP-8 for the Amiga),
+	// otherwise VF is not affected. XO-CHIP programs use the whole 64k of memory thus it must be disabled.
+	IndexOverflow bool
+	// Sprites that are drawn past the edge of the screen are clipped,
+	// otherwise they wrap around to the opposite side of the screen (XO-CHIP, earlier versions of Chip-Fa).
+	Clipping bool
+	// Biggest ROM that can be loaded, as the interpreters reserve different amount of memory.
+	// Zero means the original CHIP-8 limit of 3232 bytes (0xEA0 - 0x200).
+	MaxRomSize int
+	// Size of the memory, accesses past its end fail with ErrMemoryOutOfBounds.
+	// Zero means the original 4k of memory (0x1000), XO-CHIP extends it to 64k.
+	MemorySize int
+}
+
+// Name of the quirks preset that is used when none is specified, it keeps the behavior of the
+// emulator from before the presets were added so that the ROMs that worked keep working.
+const DefaultQuirksPreset = "legacy"
+
+// Named quirks presets of the common CHIP-8 interpreters.
+var QuirksPresets = map[string]Quirks{
+	// Earlier versions of Chip-Fa, VX is shifted in place, VF is never reset by 8XY1, 8XY2 and 8XY3,
+	// it is set by FX1E when I goes past 0xFFF and the sprites that go past the right edge wrap around
+	"legacy": {IncrementIndex: true, ShiftVX: true, IndexOverflow: true},
+	// COSMAC VIP, the original CHIP-8 interpreter
+	"chip8": {VFReset: true, IncrementIndex: true, Clipping: true},
+	"vip":   {VFReset: true, IncrementIndex: true, Clipping: true},
+	// CHIP-48 for the HP-48 calculators
+	"chip48": {ShiftVX: true, JumpVX: true, Clipping: true, MaxRomSize: 0x1000 - 0x200},
+	// SUPER-CHIP 1.1
+	"schip": {ShiftVX: true, JumpVX: true, Clipping: true, MaxRomSize: 0x1000 - 0x200},
+	// XO-CHIP as implemented by Octo, which is able to use the whole 64k of memory
+	"xochip": {IncrementIndex: true, MaxRomSize: 0x10000 - 0x200, MemorySize: 0x10000},
+}
+
+// QuirksPreset returns the quirks preset with the given name.
+func QuirksPreset(name string) (Quirks, error) {
+	quirks, ok := QuirksPresets[strings.ToLower(name)]
+	if !ok {
+		return Quirks{}, fmt.Errorf("unknown quirks preset %q, available presets: %s", name, strings.Join(QuirksPresetNames(), ", "))
+	}
+	return quirks, nil
+}
+
+// QuirksPresetNames returns the sorted names of all of the quirks presets.
+func QuirksPresetNames() (names []string) {
+	for name := range QuirksPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
@@ -0,0 +1,146 @@
+package cpu
+
+import (
+	"errors"
+	"testing"
+)
+
+// newTestCPU returns a booted CPU with the given quirks and program at 0x200.
+func newTestCPU(quirks Quirks, program ...uint16) *CPU {
+	c := &CPU{Quirks: quirks}
+	c.Boot()
+	for i, operationCode := range program {
+		c.Memory[0x200+2*i] = uint8(operationCode >> 8)
+		c.Memory[0x200+2*i+1] = uint8(operationCode)
+	}
+	return c
+}
+
+// run executes count instructions, failing the test on the first error.
+func run(t *testing.T, c *CPU, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		if err := c.DoCycle(); err != nil {
+			t.Fatalf("instruction %d returned %v", i, err)
+		}
+	}
+}
+
+func TestShiftQuirk(t *testing.T) {
+	tests := []struct {
+		name          string
+		quirks        Quirks
+		operationCode uint16
+		expected      uint8
+		flag          uint8
+	}{
+		// V1 = 0x81 is shifted in place, V2 = 0x06 is shifted into V1 otherwise
+		{"8XY6 shift VX", Quirks{ShiftVX: true}, 0x8126, 0x40, 1},
+		{"8XY6 shift VY", Quirks{}, 0x8126, 0x03, 0},
+		{"8XYE shift VX", Quirks{ShiftVX: true}, 0x812E, 0x02, 1},
+		{"8XYE shift VY", Quirks{}, 0x812E, 0x0C, 0},
+	}
+	for _, test := range tests {
+		c := newTestCPU(test.quirks, test.operationCode)
+		c.Register[1], c.Register[2] = 0x81, 0x06
+		run(t, c, 1)
+		if c.Register[1] != test.expected || c.Register[0xF] != test.flag {
+			t.Errorf("%s: V1 = 0x%02x, VF = %d, expected 0x%02x and %d", test.name, c.Register[1], c.Register[0xF], test.expected, test.flag)
+		}
+	}
+}
+
+func TestIncrementIndexQuirk(t *testing.T) {
+	tests := []struct {
+		name          string
+		quirks        Quirks
+		operationCode uint16
+		expected      uint16
+	}{
+		{"FX55 increment", Quirks{IncrementIndex: true}, 0xF255, 0x303},
+		{"FX55 unmodified", Quirks{}, 0xF255, 0x300},
+		{"FX65 increment", Quirks{IncrementIndex: true}, 0xF265, 0x303},
+		{"FX65 unmodified", Quirks{}, 0xF265, 0x300},
+	}
+	for _, test := range tests {
+		c := newTestCPU(test.quirks, test.operationCode)
+		c.IndexRegister = 0x300
+		run(t, c, 1)
+		if c.IndexRegister != test.expected {
+			t.Errorf("%s: I = 0x%03x, expected 0x%03x", test.name, c.IndexRegister, test.expected)
+		}
+	}
+}
+
+func TestJumpQuirk(t *testing.T) {
+	tests := []struct {
+		name     string
+		quirks   Quirks
+		expected uint16
+	}{
+		// B310 with V0 = 0x01 and V3 = 0x20
+		{"BNNN", Quirks{}, 0x311},
+		{"BXNN", Quirks{JumpVX: true}, 0x330},
+	}
+	for _, test := range tests {
+		c := newTestCPU(test.quirks, 0xB310)
+		c.Register[0], c.Register[3] = 0x01, 0x20
+		run(t, c, 1)
+		if c.ProgramCounter != test.expected {
+			t.Errorf("%s: jumped to 0x%03x, expected 0x%03x", test.name, c.ProgramCounter, test.expected)
+		}
+	}
+}
+
+func TestClippingQuirk(t *testing.T) {
+	tests := []struct {
+		name   string
+		quirks Quirks
+		// Whether the part of the sprite past the right and the bottom edges is drawn on the opposite side
+		wrapped bool
+	}{
+		{"clipping", Quirks{Clipping: true}, false},
+		{"wrapping", Quirks{}, true},
+	}
+	for _, test := range tests {
+		// 8x2 sprite of set pixels drawn at (60, 31), D122
+		c := newTestCPU(test.quirks, 0xD122)
+		c.Register[1], c.Register[2] = 60, 31
+		c.IndexRegister = 0x300
+		c.Memory[0x300], c.Memory[0x301] = 0xFF, 0xFF
+		run(t, c, 1)
+		if c.Screen[63+31*64] != 1 {
+			t.Errorf("%s: the part of the sprite on the screen is not drawn", test.name)
+		}
+		// Pixels 64 - 67 of the first row wrap to 0 - 3, the second row wraps to the top
+		for _, index := range []int{0 + 31*64, 3 + 31*64, 60, 3} {
+			if set := c.Screen[index] == 1; set != test.wrapped {
+				t.Errorf("%s: pixel (%d, %d) set: %v, expected %v", test.name, index%64, index/64, set, test.wrapped)
+			}
+		}
+	}
+}
+
+func TestMemorySize(t *testing.T) {
+	tests := []struct {
+		preset string
+		// Whether FX65 is able to read past 0xFFF
+		fits bool
+	}{
+		{"legacy", false},
+		{"chip8", false},
+		{"schip", false},
+		{"xochip", true},
+	}
+	for _, test := range tests {
+		// F165 reads 0xFFF and 0x1000
+		c := newTestCPU(QuirksPresets[test.preset], 0xF165)
+		c.IndexRegister = 0xFFF
+		err := c.DoCycle()
+		if test.fits && err != nil {
+			t.Errorf("%s: reading 0x1000 returned %v", test.preset, err)
+		} else if !test.fits && !errors.Is(err, ErrMemoryOutOfBounds) {
+			t.Errorf("%s: reading 0x1000 returned %v, expected %v", test.preset, err, ErrMemoryOutOfBounds)
+		}
+	}
+}
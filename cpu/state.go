@@ -0,0 +1,149 @@
+package cpu
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Save state format
+// -----------
+// header    : magic "CFST", format version (uint16), SHA-256 of the loaded ROM, memory size (uint32)
+// registers : stateRegisters, big endian
+// memory    : Memory, MemorySize() bytes (4096, or 65536 for XO-CHIP)
+// screen    : Screen, 8192 bytes
+// -----------
+// Quirks and callbacks are not part of the state, only the size of the memory they select is recorded
+// as the state can only be loaded with quirks that have the same memory.
+
+// Version of the save state format, should be increased whenever the format changes.
+const stateVersion uint16 = 2
+
+var stateMagic = [4]byte{'C', 'F', 'S', 'T'}
+
+var (
+	// Returned by LoadState when the data is not a save state.
+	ErrInvalidState = errors.New("invalid save state")
+	// Returned by LoadState when the save state was created by an incompatible version.
+	ErrUnsupportedStateVersion = errors.New("unsupported save state version")
+	// Returned by LoadState when the save state was created while running a different ROM.
+	ErrStateRomMismatch = errors.New("save state was created from a different ROM")
+	// Returned by LoadState when the save state was created with quirks that have a different memory size.
+	ErrStateMemoryMismatch = errors.New("save state was created with a different memory size")
+)
+
+type stateHeader struct {
+	Magic      [4]byte
+	Version    uint16
+	RomHash    [32]byte
+	MemorySize uint32
+}
+
+// Every field of the CPU state except Memory and Screen,
+// which are written as is to avoid encoding them byte by byte.
+type stateRegisters struct {
+	Register           [16]uint8
+	IndexRegister      uint16
+	ProgramCounter     uint16
+	Stack              [16]uint16
+	StackPointer       uint16
+	DelayTimer         uint8
+	SoundTimer         uint8
+	KeypadStates       [16]uint8
+	HighResolution     bool
+	Planes             uint8
+	RPLFlags           [16]uint8
+	AudioPattern       [16]uint8
+	AudioPatternLoaded bool
+	Pitch              uint8
+}
+
+// SaveState writes the whole machine state to w.
+func (c *CPU) SaveState(w io.Writer) error {
+	header := stateHeader{Magic: stateMagic, Version: stateVersion, RomHash: c.romHash, MemorySize: uint32(c.MemorySize())}
+	if err := binary.Write(w, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	registers := stateRegisters{
+		Register:           c.Register,
+		IndexRegister:      c.IndexRegister,
+		ProgramCounter:     c.ProgramCounter,
+		Stack:              c.Stack,
+		StackPointer:       c.StackPointer,
+		DelayTimer:         c.DelayTimer,
+		SoundTimer:         c.SoundTimer,
+		KeypadStates:       c.KeypadStates,
+		HighResolution:     c.HighResolution,
+		Planes:             c.Planes,
+		RPLFlags:           c.RPLFlags,
+		AudioPattern:       c.AudioPattern,
+		AudioPatternLoaded: c.AudioPatternLoaded,
+		Pitch:              c.Pitch,
+	}
+	if err := binary.Write(w, binary.BigEndian, &registers); err != nil {
+		return err
+	}
+	if _, err := w.Write(c.Memory[:c.MemorySize()]); err != nil {
+		return err
+	}
+	_, err := w.Write(c.Screen[:])
+	return err
+}
+
+// LoadState restores the machine state written by SaveState.
+// The save state must be created from the currently loaded ROM,
+// the CPU is left untouched when an error is returned.
+func (c *CPU) LoadState(r io.Reader) error {
+	header := stateHeader{}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+	if header.Magic != stateMagic {
+		return ErrInvalidState
+	}
+	if header.Version != stateVersion {
+		return fmt.Errorf("%w: %d, expected %d", ErrUnsupportedStateVersion, header.Version, stateVersion)
+	}
+	if header.RomHash != c.romHash {
+		return ErrStateRomMismatch
+	}
+	if int(header.MemorySize) != c.MemorySize() {
+		return fmt.Errorf("%w: %d bytes, expected %d", ErrStateMemoryMismatch, header.MemorySize, c.MemorySize())
+	}
+
+	registers := stateRegisters{}
+	if err := binary.Read(r, binary.BigEndian, &registers); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+	memory := make([]uint8, c.MemorySize())
+	if _, err := io.ReadFull(r, memory); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+	screen := make([]uint8, len(c.Screen))
+	if _, err := io.ReadFull(r, screen); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+	if int(registers.StackPointer) > len(c.Stack) {
+		return fmt.Errorf("%w: stack pointer out of range", ErrInvalidState)
+	}
+
+	copy(c.Memory[:], memory)
+	copy(c.Screen[:], screen)
+	c.Register = registers.Register
+	c.IndexRegister = registers.IndexRegister
+	c.ProgramCounter = registers.ProgramCounter
+	c.Stack = registers.Stack
+	c.StackPointer = registers.StackPointer
+	c.DelayTimer = registers.DelayTimer
+	c.SoundTimer = registers.SoundTimer
+	c.KeypadStates = registers.KeypadStates
+	c.HighResolution = registers.HighResolution
+	c.Planes = registers.Planes
+	c.RPLFlags = registers.RPLFlags
+	c.AudioPattern = registers.AudioPattern
+	c.AudioPatternLoaded = registers.AudioPatternLoaded
+	c.Pitch = registers.Pitch
+	c.ShouldDraw = true
+	return nil
+}
@@ -0,0 +1,95 @@
+package cpu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// loadTestROM loads a ROM written to a temporary file, so the save states are bound to it.
+func loadTestROM(t *testing.T, c *CPU, rom []uint8) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.ch8")
+	if err := ioutil.WriteFile(path, rom, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LoadROM(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	rom := []uint8{0x60, 0x12, 0xA3, 0x00, 0xF0, 0x55, 0xD0, 0x01}
+	tests := []struct {
+		name   string
+		quirks Quirks
+	}{
+		{"4k memory", QuirksPresets["chip8"]},
+		{"64k memory", QuirksPresets["xochip"]},
+	}
+	for _, test := range tests {
+		c := &CPU{Quirks: test.quirks}
+		c.Boot()
+		loadTestROM(t, c, rom)
+		run(t, c, 4)
+		c.DelayTimer, c.Stack[0], c.StackPointer = 0x20, 0x204, 1
+		state := &bytes.Buffer{}
+		if err := c.SaveState(state); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if size := binary.Size(stateHeader{}) + binary.Size(stateRegisters{}) + c.MemorySize() + len(c.Screen); state.Len() != size {
+			t.Errorf("%s: save state of %d bytes, expected %d", test.name, state.Len(), size)
+		}
+
+		restored := &CPU{Quirks: test.quirks}
+		restored.Boot()
+		loadTestROM(t, restored, rom)
+		if err := restored.LoadState(bytes.NewReader(state.Bytes())); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if restored.Register != c.Register || restored.IndexRegister != c.IndexRegister || restored.ProgramCounter != c.ProgramCounter ||
+			restored.Stack != c.Stack || restored.StackPointer != c.StackPointer || restored.DelayTimer != c.DelayTimer ||
+			restored.Memory != c.Memory || restored.Screen != c.Screen {
+			t.Errorf("%s: the restored state is different", test.name)
+		}
+	}
+}
+
+func TestStateMismatch(t *testing.T) {
+	c := &CPU{}
+	c.Boot()
+	loadTestROM(t, c, []uint8{0x60, 0x12})
+	state := &bytes.Buffer{}
+	if err := c.SaveState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		quirks   Quirks
+		rom      []uint8
+		data     []byte
+		expected error
+	}{
+		{"different ROM", Quirks{}, []uint8{0x60, 0x13}, state.Bytes(), ErrStateRomMismatch},
+		{"different memory size", QuirksPresets["xochip"], []uint8{0x60, 0x12}, state.Bytes(), ErrStateMemoryMismatch},
+		{"truncated", Quirks{}, []uint8{0x60, 0x12}, state.Bytes()[:state.Len()-1], ErrInvalidState},
+		{"not a state", Quirks{}, []uint8{0x60, 0x12}, []byte("CHIP-8 ROM"), ErrInvalidState},
+	}
+	for _, test := range tests {
+		other := &CPU{Quirks: test.quirks}
+		other.Boot()
+		loadTestROM(t, other, test.rom)
+		other.Register[0] = 0x42
+		if err := other.LoadState(bytes.NewReader(test.data)); !errors.Is(err, test.expected) {
+			t.Errorf("%s: LoadState returned %v, expected %v", test.name, err, test.expected)
+		}
+		// The CPU is left untouched
+		if other.Register[0] != 0x42 {
+			t.Errorf("%s: the CPU was changed by a rejected save state", test.name)
+		}
+	}
+}
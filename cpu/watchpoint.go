@@ -0,0 +1,105 @@
+package cpu
+
+// WatchKind selects the memory accesses that trigger a watchpoint
+type WatchKind int
+
+const (
+	WatchRead WatchKind = 1 << iota
+	WatchWrite
+	WatchReadWrite = WatchRead | WatchWrite
+)
+
+func (k WatchKind) String() string {
+	switch k {
+	case WatchRead:
+		return "read"
+	case WatchWrite:
+		return "write"
+	}
+	return "rw"
+}
+
+// Watchpoint stops the execution after an instruction accesses the memory at Address.
+type Watchpoint struct {
+	ID      int
+	Address uint16
+	Kind    WatchKind
+	// Amount of accesses that triggered the watchpoint
+	HitCount int
+}
+
+// WatchpointHit describes the access that triggered a watchpoint
+type WatchpointHit struct {
+	Watchpoint *Watchpoint
+	// Address and operationCode of the instruction that accessed the memory
+	ProgramCounter uint16
+	OperationCode  uint16
+	Write          bool
+	// Value of the memory before and after the access, both are the same for reads
+	OldValue uint8
+	NewValue uint8
+}
+
+// AddWatchpoint adds a watchpoint on the memory at address.
+// Watchpoints and breakpoints share their IDs, thus an ID never refers to both of them.
+func (c *CPU) AddWatchpoint(address uint16, kind WatchKind) *Watchpoint {
+	c.lastBreakpointID++
+	watchpoint := &Watchpoint{ID: c.lastBreakpointID, Address: address, Kind: kind}
+	c.watchpoints = append(c.watchpoints, watchpoint)
+	return watchpoint
+}
+
+// DeleteWatchpoint removes the watchpoint with the given ID, returning false when there is none.
+func (c *CPU) DeleteWatchpoint(id int) bool {
+	for i, watchpoint := range c.watchpoints {
+		if watchpoint.ID == id {
+			c.watchpoints = append(c.watchpoints[:i], c.watchpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Watchpoints returns the watchpoints in the order they were added.
+func (c *CPU) Watchpoints() []*Watchpoint {
+	return append([]*Watchpoint{}, c.watchpoints...)
+}
+
+// readMemory reads a byte of memory for the executed instruction,
+// every read of the instructions goes through it to be able to watch the memory.
+// The address must be checked by checkMemoryRange beforehand.
+func (c *CPU) readMemory(address int) uint8 {
+	value := c.Memory[address]
+	if len(c.watchpoints) > 0 {
+		c.checkWatchpoints(address, WatchRead, value, value)
+	}
+	return value
+}
+
+// writeMemory writes a byte of memory for the executed instruction,
+// every write of the instructions goes through it to be able to watch the memory.
+// The address must be checked by checkMemoryRange beforehand.
+func (c *CPU) writeMemory(address int, value uint8) {
+	if len(c.watchpoints) > 0 {
+		c.checkWatchpoints(address, WatchWrite, c.Memory[address], value)
+	}
+	c.Memory[address] = value
+}
+
+func (c *CPU) checkWatchpoints(address int, kind WatchKind, oldValue uint8, newValue uint8) {
+	for _, watchpoint := range c.watchpoints {
+		if int(watchpoint.Address) != address || watchpoint.Kind&kind == 0 {
+			continue
+		}
+		watchpoint.HitCount++
+		c.watchpointHits = append(c.watchpointHits, WatchpointHit{
+			Watchpoint:     watchpoint,
+			ProgramCounter: c.ProgramCounter,
+			// Read directly, as reading it through readMemory would trigger the watchpoints again
+			OperationCode: uint16(c.Memory[c.ProgramCounter])<<8 | uint16(c.Memory[(int(c.ProgramCounter)+1)%c.MemorySize()]),
+			Write:         kind == WatchWrite,
+			OldValue:      oldValue,
+			NewValue:      newValue,
+		})
+	}
+}
@@ -0,0 +1,592 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/raveltan/chip-fa/asm"
+	"github.com/raveltan/chip-fa/cpu"
+	"github.com/raveltan/chip-fa/debugger"
+)
+
+// ID of the only thread, the CHIP-8 has a single program counter
+const threadID = 1
+
+// References of the variable scopes
+const (
+	registersReference = 1
+	stackReference     = 2
+)
+
+// Launch is the configuration of the emulation requested by the editor
+type Launch struct {
+	// Path of the ROM, the source is assembled next to itself when the program is a .asm or .s file
+	Rom string
+	// Path of the symbol file, empty when there is none
+	Symbols string
+	Quirks  cpu.Quirks
+	// Path of the keymap file, empty to use the default keymap
+	Keymap         string
+	CyclePerSecond int
+	DisplayScale   float64
+	// Whether the emulation is paused on the first instruction
+	StopOnEntry bool
+}
+
+// launchArguments are the arguments of the launch request (launch.json in VS Code)
+type launchArguments struct {
+	Program     string  `json:"program"`
+	Symbols     string  `json:"symbols"`
+	Quirks      string  `json:"quirks"`
+	Keymap      string  `json:"keymap"`
+	Cycle       int     `json:"cycle"`
+	Scale       float64 `json:"scale"`
+	StopOnEntry bool    `json:"stopOnEntry"`
+}
+
+// lineKey is a line of a source file, used to find the address of a breakpoint
+type lineKey struct {
+	file string
+	line int
+}
+
+// Session is a connection to an editor
+// -----------
+// The session is started before the emulation, as the ROM is given by the launch request:
+// 1. Serve handles the requests in the background, until the launch request is received
+// 2. WaitForLaunch returns the launch configuration, which is used to start the emulation
+// 3. The emulation calls Attach with its debugger, then the editor sends the breakpoints and resumes the emulation
+// -----------
+type Session struct {
+	r          *bufio.Reader
+	w          io.Writer
+	writeMutex sync.Mutex
+	seq        int
+
+	launches chan Launch
+	// Closed when the connection is closed before the emulation started
+	closed chan struct{}
+	// Closed by Attach once the debugger of the emulation is available
+	attached chan struct{}
+	d        *debugger.Debugger
+	launch   Launch
+
+	// Source line of the addresses, empty when the ROM was not assembled by chip-fa
+	lines map[uint16]asm.SourceLine
+	// Lowest address of every source line
+	addresses map[lineKey]uint16
+	// Breakpoint IDs by source path, replaced on each setBreakpoints request
+	sourceBreakpoints   map[string][]int
+	functionBreakpoints []int
+
+	runMutex sync.Mutex
+	// Set while Continue or a step is running
+	running bool
+	// Set by the pause request, to report why the emulation stopped
+	pauseRequested bool
+}
+
+// NewSession returns a session that reads the requests from r and writes the responses and events to w.
+func NewSession(r io.Reader, w io.Writer) *Session {
+	return &Session{
+		r:                 bufio.NewReader(r),
+		w:                 w,
+		launches:          make(chan Launch),
+		closed:            make(chan struct{}),
+		attached:          make(chan struct{}),
+		sourceBreakpoints: map[string][]int{},
+	}
+}
+
+// WaitForLaunch blocks until the editor sends a valid launch request, Serve must be running.
+func (s *Session) WaitForLaunch() (Launch, error) {
+	select {
+	case launch := <-s.launches:
+		return launch, nil
+	case <-s.closed:
+		return Launch{}, errors.New("the editor disconnected before launching a ROM")
+	}
+}
+
+// Attach gives the debugger of the started emulation to the session,
+// the emulation must be paused until the editor resumes it.
+func (s *Session) Attach(d *debugger.Debugger) {
+	s.d = d
+	close(s.attached)
+}
+
+// Serve handles the requests until the connection is closed, the emulation is exited when it is closed.
+func (s *Session) Serve() error {
+	for {
+		content, err := readMessage(s.r)
+		if err != nil {
+			if s.d != nil {
+				s.d.ExitCallback()
+			}
+			close(s.closed)
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		r := request{}
+		if err := json.Unmarshal(content, &r); err != nil || r.Type != "request" {
+			continue
+		}
+		if err := s.handle(r); err != nil {
+			s.respondError(r, err)
+		}
+	}
+}
+
+func (s *Session) send(message interface{}) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.seq++
+	switch m := message.(type) {
+	case *response:
+		m.Seq = s.seq
+	case *event:
+		m.Seq = s.seq
+	}
+	// Write errors are detected by the reads of the same connection
+	writeMessage(s.w, message)
+}
+
+func (s *Session) respond(r request, body interface{}) {
+	s.send(&response{Type: "response", RequestSeq: r.Seq, Success: true, Command: r.Command, Body: body})
+}
+
+func (s *Session) respondError(r request, err error) {
+	s.send(&response{Type: "response", RequestSeq: r.Seq, Success: false, Command: r.Command, Message: err.Error()})
+}
+
+func (s *Session) sendEvent(name string, body interface{}) {
+	s.send(&event{Type: "event", Event: name, Body: body})
+}
+
+// output shows a message in the debug console of the editor.
+func (s *Session) output(text string) {
+	s.sendEvent("output", map[string]string{"category": "console", "output": text + "\n"})
+}
+
+// handle handles a request, returning an error to respond with a failure.
+func (s *Session) handle(r request) error {
+	switch r.Command {
+	case "initialize":
+		s.respond(r, capabilities{
+			SupportsConfigurationDoneRequest: true,
+			SupportsConditionalBreakpoints:   true,
+			SupportsFunctionBreakpoints:      true,
+			SupportsSetVariable:              true,
+			SupportsTerminateRequest:         true,
+		})
+		return nil
+	case "launch":
+		return s.handleLaunch(r)
+	case "disconnect", "terminate":
+		s.respond(r, nil)
+		if s.d != nil {
+			s.d.ExitCallback()
+		}
+		return nil
+	}
+
+	// The other requests need the emulation to be started
+	if s.d == nil {
+		return errors.New("no ROM has been launched")
+	}
+	switch r.Command {
+	case "configurationDone":
+		if s.launch.StopOnEntry {
+			s.respond(r, nil)
+			s.sendEvent("stopped", map[string]interface{}{"reason": "entry", "threadId": threadID, "allThreadsStopped": true})
+			return nil
+		}
+		return s.run(r, nil, func(debugger.CPUState) bool { return false })
+	case "setBreakpoints":
+		return s.handleSetBreakpoints(r)
+	case "setFunctionBreakpoints":
+		return s.handleSetFunctionBreakpoints(r)
+	case "setExceptionBreakpoints":
+		// CPU errors always stop the emulation
+		s.respond(r, map[string]interface{}{"breakpoints": []breakpoint{}})
+		return nil
+	case "threads":
+		s.respond(r, map[string]interface{}{"threads": []thread{{ID: threadID, Name: "CHIP-8"}}})
+		return nil
+	case "stackTrace":
+		frames := s.stackTrace()
+		s.respond(r, map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)})
+		return nil
+	case "scopes":
+		s.respond(r, map[string]interface{}{"scopes": []scope{
+			{Name: "Registers", VariablesReference: registersReference},
+			{Name: "Stack", VariablesReference: stackReference},
+		}})
+		return nil
+	case "variables":
+		return s.handleVariables(r)
+	case "setVariable":
+		return s.handleSetVariable(r)
+	case "continue":
+		return s.run(r, map[string]interface{}{"allThreadsContinued": true}, func(debugger.CPUState) bool { return false })
+	case "next":
+		return s.run(r, nil, s.d.NextCondition())
+	case "stepIn":
+		return s.run(r, nil, func(debugger.CPUState) bool { return true })
+	case "stepOut":
+		stop, ok := s.d.FinishCondition()
+		if !ok {
+			return errors.New("unable to step out as the program is not in a subroutine")
+		}
+		return s.run(r, nil, stop)
+	case "pause":
+		s.runMutex.Lock()
+		s.pauseRequested = s.running
+		s.runMutex.Unlock()
+		s.d.PauseEmulationCallback()
+		s.respond(r, nil)
+		return nil
+	}
+	return fmt.Errorf("unsupported request %s", r.Command)
+}
+
+// handleLaunch prepares the ROM of the launch request and waits until the emulation is started.
+func (s *Session) handleLaunch(r request) error {
+	if s.d != nil {
+		return errors.New("a ROM has already been launched")
+	}
+	arguments := launchArguments{Quirks: cpu.DefaultQuirksPreset, Cycle: 60, Scale: 1}
+	if err := json.Unmarshal(r.Arguments, &arguments); err != nil {
+		return fmt.Errorf("invalid launch arguments, %v", err)
+	}
+	if arguments.Program == "" {
+		return errors.New("missing program in the launch arguments")
+	}
+	quirks, err := cpu.QuirksPreset(arguments.Quirks)
+	if err != nil {
+		return err
+	}
+	launch := Launch{
+		Rom:            arguments.Program,
+		Symbols:        arguments.Symbols,
+		Quirks:         quirks,
+		Keymap:         arguments.Keymap,
+		CyclePerSecond: arguments.Cycle,
+		DisplayScale:   arguments.Scale,
+		StopOnEntry:    arguments.StopOnEntry,
+	}
+
+	// Sources are assembled the same way as chip-fa asm, which gives the line of every address
+	extension := strings.ToLower(filepath.Ext(arguments.Program))
+	if extension == ".asm" || extension == ".s" {
+		program, err := asm.Assemble(arguments.Program)
+		if err != nil {
+			return err
+		}
+		launch.Rom = strings.TrimSuffix(arguments.Program, filepath.Ext(arguments.Program)) + ".ch8"
+		if launch.Symbols == "" {
+			launch.Symbols = strings.TrimSuffix(launch.Rom, ".ch8") + ".sym"
+		}
+		if err := program.WriteFiles(launch.Rom, launch.Symbols); err != nil {
+			return err
+		}
+		s.setLines(program.Lines)
+		s.output(fmt.Sprintf("Assembled %d bytes to %s (symbols: %s)", len(program.Code), launch.Rom, launch.Symbols))
+	}
+
+	s.launch = launch
+	s.launches <- launch
+	<-s.attached
+	s.respond(r, nil)
+	// The editor sends the breakpoints and configurationDone once it is initialized
+	s.sendEvent("initialized", nil)
+	return nil
+}
+
+// setLines sets the line map of the assembled ROM, the paths are made absolute to match the paths of the editor.
+func (s *Session) setLines(lines map[uint16]asm.SourceLine) {
+	s.lines = map[uint16]asm.SourceLine{}
+	s.addresses = map[lineKey]uint16{}
+	for address, line := range lines {
+		if absolute, err := filepath.Abs(line.File); err == nil {
+			line.File = absolute
+		}
+		s.lines[address] = line
+		key := lineKey{file: line.File, line: line.Line}
+		if existing, ok := s.addresses[key]; !ok || address < existing {
+			s.addresses[key] = address
+		}
+	}
+}
+
+// findLine returns the address of a source line, or of the next line that has an address.
+func (s *Session) findLine(file string, line int) (uint16, int, bool) {
+	found := false
+	var address uint16
+	foundLine := 0
+	for key, candidate := range s.addresses {
+		if key.file != file || key.line < line {
+			continue
+		}
+		if !found || key.line < foundLine {
+			found, address, foundLine = true, candidate, key.line
+		}
+	}
+	return address, foundLine, found
+}
+
+func (s *Session) handleSetBreakpoints(r request) error {
+	arguments := struct {
+		Source      source             `json:"source"`
+		Breakpoints []sourceBreakpoint `json:"breakpoints"`
+	}{}
+	if err := json.Unmarshal(r.Arguments, &arguments); err != nil {
+		return fmt.Errorf("invalid setBreakpoints arguments, %v", err)
+	}
+	path := arguments.Source.Path
+	if absolute, err := filepath.Abs(path); err == nil {
+		path = absolute
+	}
+
+	// The breakpoints of a source are replaced by each request
+	for _, id := range s.sourceBreakpoints[path] {
+		s.d.DeleteBreakpointCallback(id)
+	}
+	s.sourceBreakpoints[path] = nil
+	breakpoints := []breakpoint{}
+	for _, requested := range arguments.Breakpoints {
+		address, line, ok := s.findLine(path, requested.Line)
+		if !ok {
+			message := "No instruction at this line"
+			if s.lines == nil {
+				message = "No line map, the program must be a source assembled by chip-fa"
+			}
+			breakpoints = append(breakpoints, breakpoint{Verified: false, Message: message, Line: requested.Line})
+			continue
+		}
+		id, err := s.d.AddBreakpointCallback(address, requested.Condition)
+		if err != nil {
+			breakpoints = append(breakpoints, breakpoint{Verified: false, Message: err.Error(), Line: requested.Line})
+			continue
+		}
+		s.sourceBreakpoints[path] = append(s.sourceBreakpoints[path], id)
+		breakpoints = append(breakpoints, breakpoint{ID: id, Verified: true, Line: line, Source: &arguments.Source})
+	}
+	s.respond(r, map[string]interface{}{"breakpoints": breakpoints})
+	return nil
+}
+
+func (s *Session) handleSetFunctionBreakpoints(r request) error {
+	arguments := struct {
+		Breakpoints []functionBreakpoint `json:"breakpoints"`
+	}{}
+	if err := json.Unmarshal(r.Arguments, &arguments); err != nil {
+		return fmt.Errorf("invalid setFunctionBreakpoints arguments, %v", err)
+	}
+	for _, id := range s.functionBreakpoints {
+		s.d.DeleteBreakpointCallback(id)
+	}
+	s.functionBreakpoints = nil
+	breakpoints := []breakpoint{}
+	for _, requested := range arguments.Breakpoints {
+		// Functions are labels of the symbol file, or addresses
+		address, ok := s.d.Symbols.Address(requested.Name)
+		if !ok {
+			value, err := strconv.ParseUint(requested.Name, 0, 16)
+			if err != nil {
+				breakpoints = append(breakpoints, breakpoint{Verified: false, Message: fmt.Sprintf("Unknown label %s", requested.Name)})
+				continue
+			}
+			address = uint16(value)
+		}
+		id, err := s.d.AddBreakpointCallback(address, requested.Condition)
+		if err != nil {
+			breakpoints = append(breakpoints, breakpoint{Verified: false, Message: err.Error()})
+			continue
+		}
+		s.functionBreakpoints = append(s.functionBreakpoints, id)
+		breakpoints = append(breakpoints, breakpoint{ID: id, Verified: true})
+	}
+	s.respond(r, map[string]interface{}{"breakpoints": breakpoints})
+	return nil
+}
+
+// describeAddress returns an address with its closest label (ex: 0x2a4 <draw+0x4>).
+func (s *Session) describeAddress(address uint16) string {
+	if label := s.d.Symbols.Describe(address); label != "" {
+		return fmt.Sprintf("0x%03x <%s>", address, label)
+	}
+	return fmt.Sprintf("0x%03x", address)
+}
+
+// frame returns the stack frame of an instruction, with its source line when the ROM has a line map.
+func (s *Session) frame(id int, address uint16) stackFrame {
+	name := s.d.Symbols.Describe(address)
+	if name == "" {
+		name = fmt.Sprintf("0x%03x", address)
+	}
+	frame := stackFrame{ID: id, Name: name, InstructionPointerReference: fmt.Sprintf("0x%03x", address)}
+	if line, ok := s.lines[address]; ok {
+		frame.Source = &source{Name: filepath.Base(line.File), Path: line.File}
+		frame.Line, frame.Column = line.Line, 1
+	}
+	return frame
+}
+
+// stackTrace returns the current instruction followed by the subroutine calls, the innermost first.
+func (s *Session) stackTrace() []stackFrame {
+	state := s.d.GetStateCallback()
+	frames := []stackFrame{s.frame(0, state.ProgramCounter)}
+	// The stack stores the address of the calls (2NNN)
+	for i := int(state.StackPointer) - 1; i >= 0 && i < len(state.Stack); i-- {
+		frames = append(frames, s.frame(len(frames), state.Stack[i]))
+	}
+	return frames
+}
+
+func (s *Session) handleVariables(r request) error {
+	arguments := struct {
+		VariablesReference int `json:"variablesReference"`
+	}{}
+	if err := json.Unmarshal(r.Arguments, &arguments); err != nil {
+		return fmt.Errorf("invalid variables arguments, %v", err)
+	}
+	state := s.d.GetStateCallback()
+	variables := []variable{}
+	switch arguments.VariablesReference {
+	case registersReference:
+		for i, v := range state.Register {
+			variables = append(variables, variable{Name: fmt.Sprintf("V%X", i), Value: fmt.Sprintf("0x%02x (%d)", v, v)})
+		}
+		variables = append(variables,
+			variable{Name: "I", Value: s.describeAddress(state.IndexRegister)},
+			variable{Name: "PC", Value: s.describeAddress(state.ProgramCounter)},
+			variable{Name: "SP", Value: fmt.Sprintf("0x%x", state.StackPointer)},
+			variable{Name: "DT", Value: fmt.Sprintf("0x%02x (%d)", state.DelayTimer, state.DelayTimer)},
+			variable{Name: "ST", Value: fmt.Sprintf("0x%02x (%d)", state.SoundTimer, state.SoundTimer)},
+		)
+	case stackReference:
+		for i := 0; i < int(state.StackPointer) && i < len(state.Stack); i++ {
+			variables = append(variables, variable{Name: fmt.Sprintf("[%d]", i), Value: s.describeAddress(state.Stack[i])})
+		}
+	}
+	s.respond(r, map[string]interface{}{"variables": variables})
+	return nil
+}
+
+func (s *Session) handleSetVariable(r request) error {
+	arguments := struct {
+		VariablesReference int    `json:"variablesReference"`
+		Name               string `json:"name"`
+		Value              string `json:"value"`
+	}{}
+	if err := json.Unmarshal(r.Arguments, &arguments); err != nil {
+		return fmt.Errorf("invalid setVariable arguments, %v", err)
+	}
+	if arguments.VariablesReference != registersReference {
+		return errors.New("only the registers can be changed")
+	}
+	// Values are decimal, or hexadecimal with the 0x prefix. Addresses can also be labels
+	value, err := strconv.ParseUint(strings.TrimSpace(arguments.Value), 0, 16)
+	if address, ok := s.d.Symbols.Address(strings.TrimSpace(arguments.Value)); ok {
+		value, err = uint64(address), nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q", arguments.Value)
+	}
+	name := strings.ToUpper(arguments.Name)
+	result := ""
+	switch {
+	case len(name) == 2 && name[0] == 'V':
+		register, err := strconv.ParseUint(name[1:], 16, 8)
+		if err != nil || value > 0xFF {
+			return fmt.Errorf("invalid value %q for %s, must be (0x00-0xFF)", arguments.Value, arguments.Name)
+		}
+		s.d.SetRegisterCallback(uint8(register), uint8(value))
+		result = fmt.Sprintf("0x%02x (%d)", value, value)
+	case name == "I":
+		s.d.SetICallback(uint16(value))
+		result = s.describeAddress(uint16(value))
+	case name == "PC":
+		s.d.SetPcCallback(uint16(value))
+		result = s.describeAddress(uint16(value))
+	case name == "DT" || name == "ST":
+		if value > 0xFF {
+			return fmt.Errorf("invalid value %q for %s, must be (0x00-0xFF)", arguments.Value, arguments.Name)
+		}
+		s.d.SetTimerCallback(name == "DT", uint8(value))
+		result = fmt.Sprintf("0x%02x (%d)", value, value)
+	default:
+		return fmt.Errorf("%s can not be changed", arguments.Name)
+	}
+	s.respond(r, map[string]string{"value": result})
+	return nil
+}
+
+// run responds to a request that resumes the emulation, then runs it until stop returns true
+// in the background and reports why it stopped.
+func (s *Session) run(r request, body interface{}, stop func(debugger.CPUState) bool) error {
+	s.runMutex.Lock()
+	if s.running {
+		s.runMutex.Unlock()
+		return errors.New("the emulation is already running")
+	}
+	s.running = true
+	s.pauseRequested = false
+	s.runMutex.Unlock()
+	s.respond(r, body)
+
+	go func() {
+		stopped := false
+		last, ok := s.d.RunUntilCallback(func(state debugger.CPUState) bool {
+			stopped = stop(state)
+			return stopped
+		})
+		s.runMutex.Lock()
+		s.running = false
+		pauseRequested := s.pauseRequested
+		s.runMutex.Unlock()
+		if !ok {
+			s.output("Unable to resume as the emulation is not paused")
+			return
+		}
+
+		body := map[string]interface{}{"threadId": threadID, "allThreadsStopped": true}
+		state := s.d.GetStateCallback()
+		switch err := s.d.GetErrorCallback(); {
+		case err != nil:
+			body["reason"], body["description"], body["text"] = "exception", "CPU error", err.Error()
+		case stopped:
+			body["reason"] = "step"
+		case pauseRequested:
+			body["reason"] = "pause"
+		default:
+			// Breakpoints, 0001 or the pause hotkey of the window
+			body["reason"] = "pause"
+			ids := []int{}
+			for _, breakpoint := range s.d.GetBreakpointsCallback() {
+				if breakpoint.Address == state.ProgramCounter {
+					ids = append(ids, breakpoint.ID)
+				}
+			}
+			sort.Ints(ids)
+			if len(ids) > 0 {
+				body["reason"], body["hitBreakpointIds"] = "breakpoint", ids
+			} else if last.OperationCode == 0x0001 {
+				body["reason"] = "breakpoint"
+			}
+		}
+		s.sendEvent("stopped", body)
+	}()
+	return nil
+}
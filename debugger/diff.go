@@ -0,0 +1,162 @@
+package debugger
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fatih/color"
+	"gopkg.in/abiosoft/ishell.v2"
+)
+
+// Amount of modified memory ranges printed by the diff command, the others are only counted
+const maxDiffRanges = 16
+
+// Modified memory ranges up to this length are printed with their bytes
+const maxDiffRangeBytes = 8
+
+var (
+	oldValue = color.New(color.FgRed).SprintFunc()
+	newValue = color.New(color.FgGreen).SprintFunc()
+)
+
+// snapshot is the state of the emulation when it stopped, compared by the diff command
+type snapshot struct {
+	state  CPUState
+	memory []uint8
+}
+
+// memoryRange is a range of consecutive bytes that have been modified
+type memoryRange struct {
+	start  uint16
+	before []uint8
+	after  []uint8
+}
+
+func (d *Debugger) takeSnapshot() *snapshot {
+	return &snapshot{state: d.GetStateCallback(), memory: d.ReadMemoryCallback(0, memorySize)}
+}
+
+// recordStop remembers the state of the emulation each time it stops, then prints a summary of what changed since the previous stop.
+func (d *Debugger) recordStop() {
+	current := d.takeSnapshot()
+	d.stopMutex.Lock()
+	previous := d.lastStop
+	d.previousStop, d.lastStop = previous, current
+	d.stopMutex.Unlock()
+	if previous == nil {
+		return
+	}
+	changes, ranges := diffSnapshots(previous, current)
+	if len(changes) == 0 && len(ranges) == 0 {
+		d.shell.Println("Nothing changed since the last stop")
+		return
+	}
+	names := []string{}
+	for _, change := range changes {
+		names = append(names, change.name)
+	}
+	modified := 0
+	for _, r := range ranges {
+		modified += len(r.after)
+	}
+	if modified > 0 {
+		names = append(names, fmt.Sprintf("%d bytes of memory", modified))
+	}
+	d.shell.Println(fmt.Sprintf("Changed since the last stop: %s (see diff)", strings.Join(names, ", ")))
+}
+
+// change is a register (or I, PC, stack entry...) that is different between 2 snapshots
+type change struct {
+	name   string
+	before string
+	after  string
+}
+
+// diffSnapshots returns the registers and the memory ranges that are different between 2 snapshots.
+func diffSnapshots(before *snapshot, after *snapshot) (changes []change, ranges []memoryRange) {
+	add := func(name string, format string, old uint16, new uint16) {
+		if old != new {
+			changes = append(changes, change{name, fmt.Sprintf(format, old), fmt.Sprintf(format, new)})
+		}
+	}
+	for i := range before.state.Register {
+		add(fmt.Sprintf("v%x", i), "0x%02x", uint16(before.state.Register[i]), uint16(after.state.Register[i]))
+	}
+	add("I", "0x%03x", before.state.IndexRegister, after.state.IndexRegister)
+	add("PC", "0x%03x", before.state.ProgramCounter, after.state.ProgramCounter)
+	add("SP", "0x%x", before.state.StackPointer, after.state.StackPointer)
+	for i := range before.state.Stack {
+		add(fmt.Sprintf("Stack[%d]", i), "0x%03x", before.state.Stack[i], after.state.Stack[i])
+	}
+	add("Delay", "0x%02x", uint16(before.state.DelayTimer), uint16(after.state.DelayTimer))
+	add("Sound", "0x%02x", uint16(before.state.SoundTimer), uint16(after.state.SoundTimer))
+
+	// Consecutive modified bytes are grouped in a single range
+	for i := 0; i < len(before.memory) && i < len(after.memory); i++ {
+		if before.memory[i] == after.memory[i] {
+			continue
+		}
+		start := i
+		for i < len(before.memory) && i < len(after.memory) && before.memory[i] != after.memory[i] {
+			i++
+		}
+		ranges = append(ranges, memoryRange{uint16(start), before.memory[start:i], after.memory[start:i]})
+	}
+	return
+}
+
+func formatBytes(data []uint8) string {
+	bytes := []string{}
+	for _, b := range data {
+		bytes = append(bytes, fmt.Sprintf("%02x", b))
+	}
+	return strings.Join(bytes, " ")
+}
+
+// formatDiff returns the changes between 2 snapshots, one per line, with the old values in red and the new values in green.
+func (d *Debugger) formatDiff(changes []change, ranges []memoryRange) (r string) {
+	for _, change := range changes {
+		r += fmt.Sprintf("%s: %s -> %s\n", change.name, oldValue(change.before), newValue(change.after))
+	}
+	for i, memory := range ranges {
+		if i == maxDiffRanges {
+			r += fmt.Sprintf("... and %d more modified memory ranges\n", len(ranges)-maxDiffRanges)
+			break
+		}
+		location := d.describeAddress(memory.start)
+		if len(memory.after) > 1 {
+			location += fmt.Sprintf(" - 0x%03x", int(memory.start)+len(memory.after)-1)
+		}
+		if len(memory.after) > maxDiffRangeBytes {
+			r += fmt.Sprintf("Memory %s: %d bytes modified\n", location, len(memory.after))
+			continue
+		}
+		r += fmt.Sprintf("Memory %s: %s -> %s\n", location, oldValue(formatBytes(memory.before)), newValue(formatBytes(memory.after)))
+	}
+	return
+}
+
+func (d *Debugger) addDiffCmds() {
+	d.shell.AddCmd(&ishell.Cmd{
+		Name: "diff",
+		Help: "Show the registers, stack, timers and memory ranges that changed between the previous stop and the last stop (breakpoint, watchpoint, error or debugger key)",
+		Func: func(c *ishell.Context) {
+			d.stopMutex.Lock()
+			previous, last := d.previousStop, d.lastStop
+			d.stopMutex.Unlock()
+			if previous == nil {
+				c.Println("Nothing to compare, the emulation has not stopped twice yet")
+				return
+			}
+			// The stops are compared as recorded, the changes made by the commands since the last stop are not included
+			changes, ranges := diffSnapshots(previous, last)
+			if len(changes) == 0 && len(ranges) == 0 {
+				c.Println("Nothing changed between the previous stop and the last stop")
+				return
+			}
+			c.Println(fmt.Sprintf("Changes from the stop at %s to the stop at %s:", d.describeAddress(previous.state.ProgramCounter),
+				d.describeAddress(last.state.ProgramCounter)))
+			c.Print(d.formatDiff(changes, ranges))
+		},
+	})
+}
@@ -0,0 +1,35 @@
+package debugger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/raveltan/chip-fa/cpu"
+)
+
+func TestDiffBetweenStops(t *testing.T) {
+	c := &cpu.CPU{ProgramCounter: 0x200}
+	d := newTestDebugger(c)
+	d.initShell()
+	output := &bytes.Buffer{}
+	d.shell.SetOut(output)
+
+	d.recordStop()
+	c.Register[0x3] = 0x10
+	c.Memory[0x300] = 0xAB
+	c.ProgramCounter = 0x204
+	d.recordStop()
+	// Changed by a command after the last stop
+	c.Register[0x4] = 0x20
+
+	output.Reset()
+	if err := d.RunScript(writeScript(t, "diff")); err != nil {
+		t.Fatal(err)
+	}
+	text := output.String()
+	if !strings.Contains(text, "from the stop at 0x200 to the stop at 0x204") || !strings.Contains(text, "v3: ") ||
+		!strings.Contains(text, "Memory 0x300: ") || strings.Contains(text, "v4: ") {
+		t.Fatalf("diff printed %q, expected the changes between the 2 stops", text)
+	}
+}
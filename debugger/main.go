@@ -1,10 +1,13 @@
 package debugger
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/raveltan/chip-fa/symbols"
 	"gopkg.in/abiosoft/ishell.v2"
 )
 
@@ -20,7 +23,85 @@ type Debugger struct {
 	GetSpecialCallback      func() string
 	SetICallback            func(uint16)
 	SetPcCallback           func(uint16)
-	GetMemoryViewCallback   func() []uint8
+	// Reads length bytes of memory starting at an address, the result is shorter when it goes past the end of the memory
+	ReadMemoryCallback func(uint16, int) []uint8
+	// Writes bytes to the memory starting at an address, failing when they do not fit in the memory
+	WriteMemoryCallback func(uint16, []uint8) error
+	// Returns the memory from PC - 120 to PC + 121, it is not used by the debugger anymore.
+	//
+	// Deprecated: Use ReadMemoryCallback, which GetMemoryViewCallback is built upon.
+	GetMemoryViewCallback func() []uint8
+	// Adds a breakpoint with an optional condition (empty when unconditional), returning its ID
+	AddBreakpointCallback    func(uint16, string) (int, error)
+	DeleteBreakpointCallback func(int) bool
+	GetBreakpointsCallback   func() []Breakpoint
+	// Adds a watchpoint on an address, the kind is either read, write or rw. Returns its ID (shared with the breakpoints)
+	AddWatchpointCallback    func(uint16, string) (int, error)
+	DeleteWatchpointCallback func(int) bool
+	GetWatchpointsCallback   func() []Watchpoint
+	GetStateCallback         func() CPUState
+	// Resumes the emulation until stop returns true after an instruction is executed,
+	// or until the emulation is paused by something else (breakpoint, error, pause hotkey).
+	// Blocks until the emulation is paused again and returns the state before the last executed instruction,
+	// returns false when the emulation was not paused.
+	RunUntilCallback func(stop func(CPUState) bool) (CPUState, bool)
+	// Returns the CPU error that halted the emulation, nil when it is not halted
+	GetErrorCallback func() error
+	// Evaluates a condition (see cpu.ParseCondition) against the current CPU state
+	EvaluateConditionCallback func(string) (bool, error)
+	// Starts (true) or stops (false) tracing the executed instructions. When starting, a new trace file
+	// is created when the path is not empty (format is text or binary), otherwise the last one is resumed
+	SetTraceCallback func(bool, string, string) error
+	// Labels of the ROM, used to annotate the addresses and accepted as addresses by the commands (nil when there is none)
+	Symbols *symbols.Table
+	// The shell is created once, it may exist before the interactive shell is started for the scripts and the hooks
+	shellOnce sync.Once
+	// Hooks added by the on command, see script.go
+	hooks hooks
+	// Guards the fields below, StartDebugShell is called from different goroutines on every stop
+	stopMutex sync.Mutex
+	// Set once the interactive shell is started
+	shellRunning bool
+	// State of the emulation at the last stop and at the stop before it, compared by the diff command
+	lastStop     *snapshot
+	previousStop *snapshot
+}
+
+// Watchpoint describes a watchpoint for the "info watchpoints" command
+type Watchpoint struct {
+	ID       int
+	Address  uint16
+	Kind     string
+	HitCount int
+}
+
+// parseAddress parses an address argument, which is either a hexadecimal number or a label of Symbols.
+func (d *Debugger) parseAddress(text string) (uint16, error) {
+	if address, ok := d.Symbols.Address(text); ok {
+		return address, nil
+	}
+	addressString := strings.Replace(text, "0x", "", -1)
+	address, err := strconv.ParseUint(addressString, 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse address: [%v], make sure that it is an unsigned 16bit integer or a label", text)
+	}
+	return uint16(address), nil
+}
+
+// describeAddress returns an address with its closest label (ex: 0x2a4 <draw+0x4>).
+func (d *Debugger) describeAddress(address uint16) string {
+	if label := d.Symbols.Describe(address); label != "" {
+		return fmt.Sprintf("0x%03x <%s>", address, label)
+	}
+	return fmt.Sprintf("0x%03x", address)
+}
+
+// Breakpoint describes a breakpoint for the "info breakpoints" command
+type Breakpoint struct {
+	ID        int
+	Address   uint16
+	Condition string
+	HitCount  int
 }
 
 func buildHorizontalTable(data [][]string) (header string, content string) {
@@ -56,14 +137,32 @@ func buildHorizontalTable(data [][]string) (header string, content string) {
 }
 
 func (d *Debugger) StartDebugShell() {
-	if d.shell != nil {
+	d.initShell()
+	// Every stop is recorded for the diff command, even when the shell is already running
+	d.recordStop()
+	d.stopMutex.Lock()
+	running := d.shellRunning
+	d.shellRunning = true
+	d.stopMutex.Unlock()
+	if running {
 		return
 	}
-	d.shell = ishell.New()
 
 	// display welcome info.
 	d.shell.Println("Chip-fa Interactive Debugger Shell")
 
+	// run shell
+	d.shell.Run()
+}
+
+// initShell creates the shell and its commands, which are also used by the scripts and the hooks without running the shell.
+func (d *Debugger) initShell() {
+	d.shellOnce.Do(d.createShell)
+}
+
+func (d *Debugger) createShell() {
+	d.shell = ishell.New()
+
 	d.shell.AddCmd(&ishell.Cmd{
 		Name:    "resume",
 		Aliases: []string{"r"},
@@ -73,7 +172,7 @@ func (d *Debugger) StartDebugShell() {
 				c.Println("Resumed Emulation")
 				return
 			}
-			c.Println("Unable to resume as emulation is not paused")
+			c.Err(errors.New("unable to resume as emulation is not paused"))
 		},
 	})
 	d.shell.AddCmd(&ishell.Cmd{
@@ -85,7 +184,7 @@ func (d *Debugger) StartDebugShell() {
 				c.Println("Paused Emulation")
 				return
 			}
-			c.Println("Unable to pause emulation as it yet is not running")
+			c.Err(errors.New("unable to pause emulation as it yet is not running"))
 		},
 	})
 	d.shell.AddCmd(&ishell.Cmd{
@@ -118,20 +217,24 @@ func (d *Debugger) StartDebugShell() {
 		Name: "sv",
 		Help: "Set a value to a specific register (ex: sv 0xF 0xFF)",
 		Func: func(c *ishell.Context) {
+			if len(c.Args) != 2 {
+				c.Err(errors.New("missing register or value (ex: sv 0xF 0xFF)"))
+				return
+			}
 			addressString := strings.Replace(c.Args[0], "0x", "", -1)
 			address, err := strconv.ParseUint(addressString, 16, 8)
 			if err != nil {
-				c.Println(fmt.Sprintf("Unable to parse register location data: [0x%v], make sure that it is (0x0-0xF)", addressString))
+				c.Err(fmt.Errorf("unable to parse register location data: [0x%v], make sure that it is (0x0-0xF)", addressString))
 				return
 			}
 			if address > 0xF {
-				c.Println("Register location must be between 0x0 - 0xF (V0-VF)")
+				c.Err(errors.New("register location must be between 0x0 - 0xF (V0-VF)"))
 				return
 			}
 			dataString := strings.Replace(c.Args[1], "0x", "", -1)
 			data, err := strconv.ParseUint(dataString, 16, 8)
 			if err != nil {
-				c.Println(fmt.Sprintf("Unable to parse new value data [0x%v], make sure that it is (0x00-0xFF)", dataString))
+				c.Err(fmt.Errorf("unable to parse new value data [0x%v], make sure that it is (0x00-0xFF)", dataString))
 				return
 			}
 			d.SetRegisterCallback(uint8(address), uint8(data))
@@ -142,20 +245,24 @@ func (d *Debugger) StartDebugShell() {
 		Name: "st",
 		Help: "Set a value to a specific timer (ex: st 0x0 0xFF, where 0x0 means delay timer and 0x1 means sound timer)",
 		Func: func(c *ishell.Context) {
+			if len(c.Args) != 2 {
+				c.Err(errors.New("missing timer or value (ex: st 0x0 0xFF)"))
+				return
+			}
 			addressString := strings.Replace(c.Args[0], "0x", "", -1)
 			address, err := strconv.ParseUint(addressString, 16, 8)
 			if err != nil {
-				c.Println(fmt.Sprintf("Unable to parse register location data: [0x%v], make sure that it is either 0x0 or 0x1", addressString))
+				c.Err(fmt.Errorf("unable to parse register location data: [0x%v], make sure that it is either 0x0 or 0x1", addressString))
 				return
 			}
 			if address > 0x1 {
-				c.Println("Timer should be either 0x0 (delay timer) or 0x1 (sound timer)")
+				c.Err(errors.New("timer should be either 0x0 (delay timer) or 0x1 (sound timer)"))
 				return
 			}
 			dataString := strings.Replace(c.Args[1], "0x", "", -1)
 			data, err := strconv.ParseUint(dataString, 16, 8)
 			if err != nil {
-				c.Println(fmt.Sprintf("Unable to parse new value data [0x%v], make sure that it is (0x00-0xFF)", dataString))
+				c.Err(fmt.Errorf("unable to parse new value data [0x%v], make sure that it is (0x00-0xFF)", dataString))
 				return
 			}
 			d.SetTimerCallback(uint8(address) == 0, uint8(data))
@@ -196,53 +303,204 @@ func (d *Debugger) StartDebugShell() {
 
 	d.shell.AddCmd(&ishell.Cmd{
 		Name: "si",
-		Help: "Set 16 bit unsigned value to the I (IndexRegister) (ex: si 0xFFF)",
+		Help: "Set 16 bit unsigned value or a label to the I (IndexRegister) (ex: si 0xFFF, si player_sprite)",
 		Func: func(c *ishell.Context) {
-			valueString := strings.Replace(c.Args[0], "0x", "", -1)
-			value, err := strconv.ParseUint(valueString, 16, 16)
+			if len(c.Args) == 0 {
+				c.Err(errors.New("missing value (ex: si 0xFFF)"))
+				return
+			}
+			value, err := d.parseAddress(c.Args[0])
 			if err != nil {
-				c.Println(fmt.Sprintf("Unable to parse value data: [0x%v], make sure that it is an unsigned 16bit integer", valueString))
+				c.Err(err)
 				return
 			}
-			d.SetICallback(uint16(value))
+			d.SetICallback(value)
 		},
 	})
 
 	d.shell.AddCmd(&ishell.Cmd{
 		Name: "spc",
-		Help: "Set a 16 bit unsigned value to the PC (ProgarmCounter) (ex: spc 0xFFF) ",
+		Help: "Set a 16 bit unsigned value or a label to the PC (ProgarmCounter) (ex: spc 0xFFF, spc main_loop)",
 		Func: func(c *ishell.Context) {
-			valueString := strings.Replace(c.Args[0], "0x", "", -1)
-			value, err := strconv.ParseUint(valueString, 16, 16)
+			if len(c.Args) == 0 {
+				c.Err(errors.New("missing address (ex: spc 0xFFF)"))
+				return
+			}
+			value, err := d.parseAddress(c.Args[0])
 			if err != nil {
-				c.Println(fmt.Sprintf("Unable to parse value data: [0x%v], make sure that it is an unsigned 16bit integer", valueString))
+				c.Err(err)
 				return
 			}
-			d.SetPcCallback(uint16(value))
+			d.SetPcCallback(value)
 		},
 	})
 
 	d.shell.AddCmd(&ishell.Cmd{
 		Name:    "instruction-view",
 		Aliases: []string{"iv"},
-		Help:    "View current instruction data of Program counter +- 30 entries",
-		Func: func(c *ishell.Context) {
-			result := d.GetMemoryViewCallback()
-			text := ""
-			prevData := uint8(0)
-			for i, v := range result {
-				if i == 121 {
-					text += fmt.Sprintf("{[0x%x}]\t", uint16(prevData)<<8|uint16(v))
-				} else if i%2 == 0 {
-					prevData = v
-				} else {
-					text += fmt.Sprintf("0x%x\t", uint16(prevData)<<8|uint16(v))
+		Help:    "View the disassembled instructions around the Program counter +- 30 entries",
+		Func: func(c *ishell.Context) {
+			c.Print(d.InstructionsAround(d.GetStateCallback().ProgramCounter, viewInstructions))
+		},
+	})
+
+	d.addStepCmds()
+	d.addMemoryCmds()
+	d.addDiffCmds()
+	d.addStackCmds()
+
+	d.shell.AddCmd(&ishell.Cmd{
+		Name:    "break",
+		Aliases: []string{"b"},
+		Help:    "[b] Stop the emulation before the instruction at an address is executed, optionally only when a condition is true (ex: break 0x2A4, break draw_player, break 0x2A4 if v3 == 0x10)",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) == 0 {
+				c.Err(errors.New("missing breakpoint address (ex: break 0x2A4)"))
+				return
+			}
+			address, err := d.parseAddress(c.Args[0])
+			if err != nil {
+				c.Err(err)
+				return
+			}
+			condition := ""
+			if len(c.Args) > 1 {
+				if c.Args[1] != "if" || len(c.Args) == 2 {
+					c.Err(errors.New("conditions must be written after if (ex: break 0x2A4 if v3 == 0x10)"))
+					return
 				}
+				condition = strings.Join(c.Args[2:], " ")
+			}
+			id, err := d.AddBreakpointCallback(address, condition)
+			if err != nil {
+				c.Err(fmt.Errorf("unable to add breakpoint, %w", err))
+				return
 			}
-			c.Println(text)
+			c.Println(fmt.Sprintf("Breakpoint %d at %s", id, d.describeAddress(address)))
 		},
 	})
 
-	// run shell
-	d.shell.Run()
+	d.shell.AddCmd(&ishell.Cmd{
+		Name: "delete",
+		Help: "Delete a breakpoint or a watchpoint by its number, or every one of them when no number is given (ex: delete 1)",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) == 0 {
+				for _, breakpoint := range d.GetBreakpointsCallback() {
+					d.DeleteBreakpointCallback(breakpoint.ID)
+				}
+				for _, watchpoint := range d.GetWatchpointsCallback() {
+					d.DeleteWatchpointCallback(watchpoint.ID)
+				}
+				c.Println("Deleted all breakpoints and watchpoints")
+				return
+			}
+			for _, arg := range c.Args {
+				id, err := strconv.Atoi(arg)
+				if err != nil {
+					c.Err(fmt.Errorf("unable to parse breakpoint number: [%v]", arg))
+					return
+				}
+				if !d.DeleteBreakpointCallback(id) && !d.DeleteWatchpointCallback(id) {
+					c.Err(fmt.Errorf("no breakpoint or watchpoint number %d", id))
+					return
+				}
+			}
+		},
+	})
+
+	d.shell.AddCmd(&ishell.Cmd{
+		Name: "watch",
+		Help: "Stop the emulation after an instruction reads or writes the memory at an address, writes are watched by default (ex: watch 0x300, watch score read, watch score rw)",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) == 0 {
+				c.Err(errors.New("missing watchpoint address (ex: watch 0x300)"))
+				return
+			}
+			address, err := d.parseAddress(c.Args[0])
+			if err != nil {
+				c.Err(err)
+				return
+			}
+			kind := "write"
+			if len(c.Args) > 1 {
+				kind = strings.ToLower(c.Args[1])
+			}
+			id, err := d.AddWatchpointCallback(address, kind)
+			if err != nil {
+				c.Err(fmt.Errorf("unable to add watchpoint, %w", err))
+				return
+			}
+			c.Println(fmt.Sprintf("Watchpoint %d (%s) at %s", id, kind, d.describeAddress(address)))
+		},
+	})
+
+	infoCmd := &ishell.Cmd{
+		Name: "info",
+		Help: "Get information about the debugger (ex: info breakpoints)",
+	}
+	infoCmd.AddCmd(&ishell.Cmd{
+		Name:    "breakpoints",
+		Aliases: []string{"b", "break"},
+		Help:    "Get list of the breakpoints with their conditions and hit counts",
+		Func: func(c *ishell.Context) {
+			breakpoints := d.GetBreakpointsCallback()
+			if len(breakpoints) == 0 {
+				c.Println("No breakpoints")
+				return
+			}
+			c.Println("Num\tAddress\tHits\tCondition")
+			for _, breakpoint := range breakpoints {
+				c.Println(fmt.Sprintf("%d\t%s\t%d\t%s", breakpoint.ID, d.describeAddress(breakpoint.Address), breakpoint.HitCount, breakpoint.Condition))
+			}
+		},
+	})
+	infoCmd.AddCmd(&ishell.Cmd{
+		Name:    "watchpoints",
+		Aliases: []string{"w", "watch"},
+		Help:    "Get list of the watchpoints with their hit counts",
+		Func: func(c *ishell.Context) {
+			watchpoints := d.GetWatchpointsCallback()
+			if len(watchpoints) == 0 {
+				c.Println("No watchpoints")
+				return
+			}
+			c.Println("Num\tAddress\tHits\tKind")
+			for _, watchpoint := range watchpoints {
+				c.Println(fmt.Sprintf("%d\t%s\t%d\t%s", watchpoint.ID, d.describeAddress(watchpoint.Address), watchpoint.HitCount, watchpoint.Kind))
+			}
+		},
+	})
+	d.addScriptCmds(infoCmd)
+	d.shell.AddCmd(infoCmd)
+
+	d.shell.AddCmd(&ishell.Cmd{
+		Name: "trace",
+		Help: "Start or stop writing the executed instructions to a trace file, the last trace file (or --trace) is resumed when no path is given (ex: trace on, trace on run.trace, trace on run.bin binary, trace off)",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) == 0 || (c.Args[0] != "on" && c.Args[0] != "off") {
+				c.Err(errors.New("expected on or off (ex: trace on run.trace, trace off)"))
+				return
+			}
+			if c.Args[0] == "off" {
+				if err := d.SetTraceCallback(false, "", ""); err != nil {
+					c.Err(fmt.Errorf("unable to stop tracing, %w", err))
+					return
+				}
+				c.Println("Stopped tracing")
+				return
+			}
+			path, format := "", "text"
+			if len(c.Args) > 1 {
+				path = c.Args[1]
+			}
+			if len(c.Args) > 2 {
+				format = c.Args[2]
+			}
+			if err := d.SetTraceCallback(true, path, format); err != nil {
+				c.Err(fmt.Errorf("unable to start tracing, %w", err))
+				return
+			}
+			c.Println("Started tracing")
+		},
+	})
 }
@@ -0,0 +1,348 @@
+package debugger
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/raveltan/chip-fa/disasm"
+	"gopkg.in/abiosoft/ishell.v2"
+)
+
+// Size of the biggest addressable memory (XO-CHIP), every memory command is checked against it.
+// The memory of the other quirks presets is 4k, the callbacks stop at its end.
+const memorySize = 0x10000
+
+// Bytes shown on each line of the hexadecimal and decimal dumps
+const bytesPerLine = 16
+
+// parseByte parses a hexadecimal byte with or without the 0x prefix.
+func parseByte(text string) (uint8, bool) {
+	value, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(text), "0x"), 16, 8)
+	return uint8(value), err == nil
+}
+
+// parseLength parses an amount of bytes, which is decimal or hexadecimal with the 0x prefix.
+func parseLength(text string) (int, bool) {
+	value, err := strconv.ParseUint(text, 0, 32)
+	if err != nil || value == 0 || value > memorySize {
+		return 0, false
+	}
+	return int(value), true
+}
+
+// checkRange makes sure that length bytes starting at address are inside the memory.
+func checkRange(address uint16, length int) error {
+	if int(address)+length > memorySize {
+		return fmt.Errorf("out of bounds: 0x%x bytes at 0x%03x go past the end of the memory (0x%x)", length, address, memorySize-1)
+	}
+	return nil
+}
+
+// dumpHex returns the hexadecimal and ASCII representation of the memory, 16 bytes per line.
+func dumpHex(address uint16, data []uint8) (r string) {
+	for i := 0; i < len(data); i += bytesPerLine {
+		line := data[i:]
+		if len(line) > bytesPerLine {
+			line = line[:bytesPerLine]
+		}
+		hex := ""
+		ascii := ""
+		for _, v := range line {
+			hex += fmt.Sprintf("%02x ", v)
+			if v >= 0x20 && v < 0x7F {
+				ascii += string(rune(v))
+			} else {
+				ascii += "."
+			}
+		}
+		r += fmt.Sprintf("0x%03x: %-48s |%s|\n", int(address)+i, hex, ascii)
+	}
+	return
+}
+
+// MemoryView returns the hexadecimal and ASCII representation of length bytes of memory starting at an address, 16 bytes per line.
+func (d *Debugger) MemoryView(address uint16, length int) string {
+	return dumpHex(address, d.ReadMemoryCallback(address, length))
+}
+
+// dumpDecimal returns the decimal representation of the memory, 16 bytes per line.
+func dumpDecimal(address uint16, data []uint8) (r string) {
+	for i := 0; i < len(data); i += bytesPerLine {
+		r += fmt.Sprintf("0x%03x:", int(address)+i)
+		for j := i; j < len(data) && j < i+bytesPerLine; j++ {
+			r += fmt.Sprintf(" %3d", data[j])
+		}
+		r += "\n"
+	}
+	return
+}
+
+// dumpBitmap returns each byte as a row of a sprite, where the set bits are # and the others are .
+func dumpBitmap(address uint16, data []uint8) (r string) {
+	for i, v := range data {
+		row := ""
+		for bit := 7; bit >= 0; bit-- {
+			if v&(1<<uint(bit)) != 0 {
+				row += "#"
+			} else {
+				row += "."
+			}
+		}
+		r += fmt.Sprintf("0x%03x: %02x  %s\n", int(address)+i, v, row)
+	}
+	return
+}
+
+// examine runs the x command, spec is the part after the slash (ex: 16x, 8b, 5i).
+// -----------
+// Formats:
+// x  hexadecimal and ASCII (default)
+// d  decimal
+// b  sprite bitmap, one byte per row
+// i  disassembled instructions, the count is in instructions instead of bytes
+// -----------
+func (d *Debugger) examine(c *ishell.Context, spec string, args []string) {
+	digits := strings.TrimRightFunc(spec, func(r rune) bool { return r < '0' || r > '9' })
+	format := spec[len(digits):]
+	if format == "" {
+		format = "x"
+	}
+	count := 16
+	if format == "b" {
+		// Tallest sprite that can be drawn by DXYN
+		count = 15
+	}
+	if format == "i" {
+		count = 10
+	}
+	if digits != "" {
+		var ok bool
+		if count, ok = parseLength(digits); !ok {
+			c.Err(fmt.Errorf("unable to parse count: [%v], make sure that it is between 1 and %d", digits, memorySize))
+			return
+		}
+	}
+	if format != "x" && format != "d" && format != "b" && format != "i" {
+		c.Err(fmt.Errorf("unknown format: [%v], make sure that it is x (hex), d (decimal), b (bitmap) or i (instructions)", format))
+		return
+	}
+
+	// The I register is used when no address is given, as it usually points to the sprite being drawn
+	address := d.GetStateCallback().IndexRegister
+	if len(args) > 0 {
+		var err error
+		if address, err = d.parseAddress(args[0]); err != nil {
+			c.Err(err)
+			return
+		}
+	}
+
+	if format == "i" {
+		// Long instructions use 4 bytes, the reads are clamped to the end of the memory
+		data := d.ReadMemoryCallback(address, count*4)
+		text := ""
+		for i, offset := 0, 0; i < count && offset+1 < len(data); i++ {
+			instruction := disasm.DecodeAt(data, offset)
+			current := address + uint16(offset)
+			if label, ok := d.Symbols.Labels()[current]; ok {
+				text += label + ":\n"
+			}
+			text += d.formatInstruction(current, instruction) + "\n"
+			offset += instruction.Size()
+		}
+		c.Print(text)
+		return
+	}
+
+	data := d.ReadMemoryCallback(address, count)
+	switch format {
+	case "x":
+		c.Print(dumpHex(address, data))
+	case "d":
+		c.Print(dumpDecimal(address, data))
+	case "b":
+		c.Print(dumpBitmap(address, data))
+	}
+	if len(data) < count {
+		c.Println("Reached the end of the memory")
+	}
+}
+
+func (d *Debugger) addMemoryCmds() {
+	d.shell.AddCmd(&ishell.Cmd{
+		Name: "x",
+		Help: "Examine the memory at an address (or I), as x/<count><format> where format is x (hex), d (decimal), b (sprite bitmap) or i (instructions) (ex: x 0x200, x/32x 0x200, x/5b player_sprite, x/10i main_loop)",
+		Func: func(c *ishell.Context) {
+			d.examine(c, "", c.Args)
+		},
+	})
+	// x/<count><format> is a single word that does not match any command, thus it is handled as a generic input
+	d.shell.NotFound(func(c *ishell.Context) {
+		if len(c.Args) > 0 && strings.HasPrefix(c.Args[0], "x/") {
+			d.examine(c, c.Args[0][len("x/"):], c.Args[1:])
+			return
+		}
+		c.Err(errors.New("incorrect input, try 'help'"))
+	})
+
+	setCmd := &ishell.Cmd{
+		Name: "set",
+		Help: "Set a value in the emulator (ex: set mem 0x300 0x12 0x34)",
+	}
+	setCmd.AddCmd(&ishell.Cmd{
+		Name: "mem",
+		Help: "Write hexadecimal bytes to the memory starting at an address (ex: set mem 0x300 0x12 0x34, set mem score 0)",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) < 2 {
+				c.Err(errors.New("missing address or bytes (ex: set mem 0x300 0x12 0x34)"))
+				return
+			}
+			address, err := d.parseAddress(c.Args[0])
+			if err != nil {
+				c.Err(err)
+				return
+			}
+			data := []uint8{}
+			for _, arg := range c.Args[1:] {
+				value, ok := parseByte(arg)
+				if !ok {
+					c.Err(fmt.Errorf("unable to parse byte: [%v], make sure that it is (0x00-0xFF)", arg))
+					return
+				}
+				data = append(data, value)
+			}
+			if err := checkRange(address, len(data)); err != nil {
+				c.Err(err)
+				return
+			}
+			if err := d.WriteMemoryCallback(address, data); err != nil {
+				c.Err(fmt.Errorf("unable to write memory, %w", err))
+				return
+			}
+			c.Println(fmt.Sprintf("Wrote %d bytes at %s", len(data), d.describeAddress(address)))
+		},
+	})
+	d.shell.AddCmd(setCmd)
+
+	d.shell.AddCmd(&ishell.Cmd{
+		Name: "fill",
+		Help: "Fill an amount of bytes of the memory starting at an address with a hexadecimal byte (ex: fill 0x300 16 0xFF, fill 0x300 0x100 0)",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) != 3 {
+				c.Err(errors.New("missing address, length or byte (ex: fill 0x300 16 0xFF)"))
+				return
+			}
+			address, err := d.parseAddress(c.Args[0])
+			if err != nil {
+				c.Err(err)
+				return
+			}
+			length, ok := parseLength(c.Args[1])
+			if !ok {
+				c.Err(fmt.Errorf("unable to parse length: [%v], make sure that it is between 1 and %d", c.Args[1], memorySize))
+				return
+			}
+			value, ok := parseByte(c.Args[2])
+			if !ok {
+				c.Err(fmt.Errorf("unable to parse byte: [%v], make sure that it is (0x00-0xFF)", c.Args[2]))
+				return
+			}
+			if err := checkRange(address, length); err != nil {
+				c.Err(err)
+				return
+			}
+			data := make([]uint8, length)
+			for i := range data {
+				data[i] = value
+			}
+			if err := d.WriteMemoryCallback(address, data); err != nil {
+				c.Err(fmt.Errorf("unable to write memory, %w", err))
+				return
+			}
+			c.Println(fmt.Sprintf("Filled %d bytes at %s with 0x%02x", length, d.describeAddress(address), value))
+		},
+	})
+
+	d.shell.AddCmd(&ishell.Cmd{
+		Name: "search",
+		Help: "Search the memory for hexadecimal bytes, ?? matches any byte (ex: search 0xA2 ?? 0xD0)",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) == 0 {
+				c.Err(errors.New("missing bytes to search (ex: search 0xA2 ?? 0xD0)"))
+				return
+			}
+			// Wildcards are stored as -1
+			pattern := []int{}
+			for _, arg := range c.Args {
+				if arg == "??" {
+					pattern = append(pattern, -1)
+					continue
+				}
+				value, ok := parseByte(arg)
+				if !ok {
+					c.Err(fmt.Errorf("unable to parse byte: [%v], make sure that it is (0x00-0xFF) or ??", arg))
+					return
+				}
+				pattern = append(pattern, int(value))
+			}
+
+			memory := d.ReadMemoryCallback(0, memorySize)
+			matches := 0
+			for address := 0; address+len(pattern) <= len(memory); address++ {
+				found := true
+				for i, value := range pattern {
+					if value != -1 && int(memory[address+i]) != value {
+						found = false
+						break
+					}
+				}
+				if found {
+					matches++
+					c.Println(d.describeAddress(uint16(address)))
+				}
+			}
+			if matches == 0 {
+				c.Println("No matches")
+				return
+			}
+			c.Println(fmt.Sprintf("%d matches", matches))
+		},
+	})
+
+	d.shell.AddCmd(&ishell.Cmd{
+		Name: "load",
+		Help: "Load the content of a file to the memory starting at an address (ex: load sprites.bin 0x300)",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) != 2 {
+				c.Err(errors.New("missing file or address (ex: load sprites.bin 0x300)"))
+				return
+			}
+			address, err := d.parseAddress(c.Args[1])
+			if err != nil {
+				c.Err(err)
+				return
+			}
+			data, err := ioutil.ReadFile(c.Args[0])
+			if err != nil {
+				c.Err(fmt.Errorf("unable to read file, %w", err))
+				return
+			}
+			if len(data) == 0 {
+				c.Err(errors.New("nothing to load, the file is empty"))
+				return
+			}
+			if err := checkRange(address, len(data)); err != nil {
+				c.Err(err)
+				return
+			}
+			if err := d.WriteMemoryCallback(address, data); err != nil {
+				c.Err(fmt.Errorf("unable to write memory, %w", err))
+				return
+			}
+			c.Println(fmt.Sprintf("Loaded %d bytes at %s", len(data), d.describeAddress(address)))
+		},
+	})
+}
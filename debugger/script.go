@@ -0,0 +1,297 @@
+package debugger
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/abiosoft/ishell.v2"
+)
+
+// hooks are debugger commands that are run automatically, added by the on command.
+// They are run from the emulator while the shell may be used, thus they are guarded by a mutex.
+type hooks struct {
+	mutex sync.Mutex
+	// Commands run when a breakpoint added by "on break" stops the emulation, by address
+	breaks map[uint16]*breakHook
+	// Commands run after every frame
+	frame [][]string
+}
+
+type breakHook struct {
+	// Breakpoints added for the hook, deleted by "on clear"
+	breakpointIDs []int
+	commands      [][]string
+}
+
+// parseHookCommands splits the commands of a hook, which are separated by ";" (ex: register; x 0x300).
+func parseHookCommands(args []string) [][]string {
+	commands := [][]string{}
+	for _, command := range strings.Split(strings.Join(args, " "), ";") {
+		if fields := strings.Fields(command); len(fields) > 0 {
+			commands = append(commands, fields)
+		}
+	}
+	return commands
+}
+
+// splitHook separates the arguments of the on command at do, returning false when there is no command after it.
+func splitHook(args []string) (before []string, commands [][]string, ok bool) {
+	for i, arg := range args {
+		if arg == "do" {
+			commands = parseHookCommands(args[i+1:])
+			return args[:i], commands, len(commands) > 0
+		}
+	}
+	return args, nil, false
+}
+
+// runCommands runs commands in the shell, stopping at the first one that fails.
+func (d *Debugger) runCommands(commands [][]string) error {
+	d.initShell()
+	for _, command := range commands {
+		if err := d.shell.Process(command...); err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(command, " "), err)
+		}
+	}
+	return nil
+}
+
+// RunScript runs the debugger commands of a file, one per line. Empty lines and lines starting with # are skipped.
+// The script stops at the first command that fails (unknown command, invalid argument, failed assertion...).
+func (d *Debugger) RunScript(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	d.initShell()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if err := d.shell.Process(fields...); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// HasBreakHooks returns whether "on break" hooks were added at an address.
+func (d *Debugger) HasBreakHooks(address uint16) bool {
+	d.hooks.mutex.Lock()
+	defer d.hooks.mutex.Unlock()
+	_, ok := d.hooks.breaks[address]
+	return ok
+}
+
+// IsHookBreakpoint returns whether a breakpoint was added by an "on break" hook.
+func (d *Debugger) IsHookBreakpoint(id int) bool {
+	d.hooks.mutex.Lock()
+	defer d.hooks.mutex.Unlock()
+	for _, hook := range d.hooks.breaks {
+		for _, hookID := range hook.breakpointIDs {
+			if hookID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RunBreakHooks runs the commands of the hooks at an address, the emulation must be paused on its breakpoint.
+// Returns false when a command failed, the error is printed to the shell.
+func (d *Debugger) RunBreakHooks(address uint16) bool {
+	d.hooks.mutex.Lock()
+	hook, ok := d.hooks.breaks[address]
+	commands := [][]string{}
+	if ok {
+		commands = append(commands, hook.commands...)
+	}
+	d.hooks.mutex.Unlock()
+	return d.runHook(fmt.Sprintf("break %s", d.describeAddress(address)), commands)
+}
+
+// HasFrameHooks returns whether there are "on frame" hooks, the emulator only runs them when there are.
+func (d *Debugger) HasFrameHooks() bool {
+	d.hooks.mutex.Lock()
+	defer d.hooks.mutex.Unlock()
+	return len(d.hooks.frame) > 0
+}
+
+// RunFrameHooks runs the commands of the "on frame" hooks, called by the emulator after every frame.
+// Returns false when a command failed, the error is printed to the shell.
+func (d *Debugger) RunFrameHooks() bool {
+	d.hooks.mutex.Lock()
+	commands := append([][]string{}, d.hooks.frame...)
+	d.hooks.mutex.Unlock()
+	if len(commands) == 0 {
+		return true
+	}
+	return d.runHook("frame", commands)
+}
+
+func (d *Debugger) runHook(name string, commands [][]string) bool {
+	if err := d.runCommands(commands); err != nil {
+		d.shell.Println(fmt.Sprintf("Hook on %s failed, %v", name, err))
+		return false
+	}
+	return true
+}
+
+func (d *Debugger) addScriptCmds(infoCmd *ishell.Cmd) {
+	d.shell.AddCmd(&ishell.Cmd{
+		Name: "source",
+		Help: "Run the debugger commands of a file, one per line, lines starting with # are comments (ex: source checks.txt)",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) != 1 {
+				c.Err(errors.New("missing script file (ex: source checks.txt)"))
+				return
+			}
+			if err := d.RunScript(c.Args[0]); err != nil {
+				// Returned to stop the script that sourced this one
+				c.Err(fmt.Errorf("script stopped, %w", err))
+			}
+		},
+	})
+
+	d.shell.AddCmd(&ishell.Cmd{
+		Name: "assert",
+		Help: "Fail when a condition is false, stopping the script or the hook that runs it (ex: assert v3 == 0x10, assert i < 0x1000)",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) == 0 {
+				c.Err(errors.New("missing condition (ex: assert v3 == 0x10)"))
+				return
+			}
+			condition := strings.Join(c.Args, " ")
+			ok, err := d.EvaluateConditionCallback(condition)
+			if err != nil {
+				c.Err(fmt.Errorf("unable to evaluate condition, %w", err))
+				return
+			}
+			if !ok {
+				c.Err(fmt.Errorf("assertion failed: %s", condition))
+			}
+		},
+	})
+
+	onCmd := &ishell.Cmd{
+		Name: "on",
+		Help: "Run debugger commands automatically, separated by ; (ex: on break 0x300 do register; x 0x300, on frame do assert v0 < 10)",
+	}
+	onCmd.AddCmd(&ishell.Cmd{
+		Name: "break",
+		Help: "Run commands when the instruction at an address is reached, optionally only when a condition is true, then resume the emulation (ex: on break draw if v3 == 0x10 do register)",
+		Func: func(c *ishell.Context) {
+			args, commands, ok := splitHook(c.Args)
+			if !ok || len(args) == 0 {
+				c.Err(errors.New("missing address or commands (ex: on break 0x300 do register; x 0x300)"))
+				return
+			}
+			address, err := d.parseAddress(args[0])
+			if err != nil {
+				c.Err(err)
+				return
+			}
+			condition := ""
+			if len(args) > 1 {
+				if args[1] != "if" || len(args) == 2 {
+					c.Err(errors.New("conditions must be written after if (ex: on break 0x300 if v3 == 0x10 do register)"))
+					return
+				}
+				condition = strings.Join(args[2:], " ")
+			}
+			id, err := d.AddBreakpointCallback(address, condition)
+			if err != nil {
+				c.Err(fmt.Errorf("unable to add breakpoint, %w", err))
+				return
+			}
+			d.hooks.mutex.Lock()
+			if d.hooks.breaks == nil {
+				d.hooks.breaks = map[uint16]*breakHook{}
+			}
+			hook, exists := d.hooks.breaks[address]
+			if !exists {
+				hook = &breakHook{}
+				d.hooks.breaks[address] = hook
+			}
+			hook.breakpointIDs = append(hook.breakpointIDs, id)
+			hook.commands = append(hook.commands, commands...)
+			d.hooks.mutex.Unlock()
+			c.Println(fmt.Sprintf("Hook on breakpoint %d at %s", id, d.describeAddress(address)))
+		},
+	})
+	onCmd.AddCmd(&ishell.Cmd{
+		Name: "frame",
+		Help: "Run commands after every frame (ex: on frame do assert sp < 16)",
+		Func: func(c *ishell.Context) {
+			args, commands, ok := splitHook(c.Args)
+			if !ok || len(args) > 0 {
+				c.Err(errors.New("missing commands (ex: on frame do assert sp < 16)"))
+				return
+			}
+			d.hooks.mutex.Lock()
+			d.hooks.frame = append(d.hooks.frame, commands...)
+			d.hooks.mutex.Unlock()
+			c.Println("Hook on frame added")
+		},
+	})
+	onCmd.AddCmd(&ishell.Cmd{
+		Name: "clear",
+		Help: "Delete every hook, with the breakpoints added for them",
+		Func: func(c *ishell.Context) {
+			d.hooks.mutex.Lock()
+			breaks := d.hooks.breaks
+			d.hooks.breaks = nil
+			d.hooks.frame = nil
+			d.hooks.mutex.Unlock()
+			// Deleted without holding the mutex, the callbacks wait for the emulator which takes it on every frame
+			for _, hook := range breaks {
+				for _, id := range hook.breakpointIDs {
+					d.DeleteBreakpointCallback(id)
+				}
+			}
+			c.Println("Deleted all hooks")
+		},
+	})
+	d.shell.AddCmd(onCmd)
+
+	infoCmd.AddCmd(&ishell.Cmd{
+		Name: "hooks",
+		Help: "List the commands run by the on command",
+		Func: func(c *ishell.Context) {
+			d.hooks.mutex.Lock()
+			defer d.hooks.mutex.Unlock()
+			if len(d.hooks.breaks) == 0 && len(d.hooks.frame) == 0 {
+				c.Println("No hooks")
+				return
+			}
+			addresses := []int{}
+			for address := range d.hooks.breaks {
+				addresses = append(addresses, int(address))
+			}
+			sort.Ints(addresses)
+			for _, address := range addresses {
+				c.Println(fmt.Sprintf("break %s: %s", d.describeAddress(uint16(address)), formatHookCommands(d.hooks.breaks[uint16(address)].commands)))
+			}
+			if len(d.hooks.frame) > 0 {
+				c.Println(fmt.Sprintf("frame: %s", formatHookCommands(d.hooks.frame)))
+			}
+		},
+	})
+}
+
+func formatHookCommands(commands [][]string) string {
+	joined := []string{}
+	for _, command := range commands {
+		joined = append(joined, strings.Join(command, " "))
+	}
+	return strings.Join(joined, "; ")
+}
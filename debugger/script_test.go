@@ -0,0 +1,211 @@
+package debugger
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/raveltan/chip-fa/cpu"
+)
+
+// newTestDebugger returns a debugger whose callbacks use c directly, as done by the emulator from the game loop.
+// The emulation is paused, a stepping command executes a single instruction unless it starts at a breakpoint.
+func newTestDebugger(c *cpu.CPU) *Debugger {
+	paused := true
+	state := func() CPUState {
+		return CPUState{Register: c.Register, IndexRegister: c.IndexRegister, ProgramCounter: c.ProgramCounter,
+			Stack: c.Stack, StackPointer: c.StackPointer, DelayTimer: c.DelayTimer, SoundTimer: c.SoundTimer, Cycles: c.Cycles,
+			OperationCode: uint16(c.Memory[c.ProgramCounter])<<8 | uint16(c.Memory[c.ProgramCounter+1])}
+	}
+	return &Debugger{
+		ResumeEmulationCallback: func() bool {
+			resumed := paused
+			paused = false
+			return resumed
+		},
+		PauseEmulationCallback: func() bool {
+			wasRunning := !paused
+			paused = true
+			return wasRunning
+		},
+		GetRegisterCallback: func() [16]uint8 { return c.Register },
+		SetRegisterCallback: func(register uint8, value uint8) { c.Register[register] = value },
+		SetICallback:        func(value uint16) { c.IndexRegister = value },
+		SetPcCallback:       func(value uint16) { c.ProgramCounter = value },
+		ReadMemoryCallback: func(address uint16, length int) []uint8 {
+			end := int(address) + length
+			if end > len(c.Memory) {
+				end = len(c.Memory)
+			}
+			return append([]uint8{}, c.Memory[address:end]...)
+		},
+		WriteMemoryCallback: func(address uint16, data []uint8) error {
+			copy(c.Memory[address:], data)
+			return nil
+		},
+		AddBreakpointCallback: func(address uint16, text string) (int, error) {
+			var condition *cpu.Condition
+			if text != "" {
+				var err error
+				if condition, err = cpu.ParseCondition(text); err != nil {
+					return 0, err
+				}
+			}
+			return c.AddBreakpoint(address, condition).ID, nil
+		},
+		DeleteBreakpointCallback: c.DeleteBreakpoint,
+		DeleteWatchpointCallback: func(int) bool { return false },
+		GetStateCallback:         state,
+		RunUntilCallback: func(stop func(CPUState) bool) (CPUState, bool) {
+			if !paused {
+				return CPUState{}, false
+			}
+			last := state()
+			for _, breakpoint := range c.Breakpoints() {
+				if breakpoint.Address == c.ProgramCounter {
+					return last, true
+				}
+			}
+			c.ProgramCounter += 2
+			c.Cycles++
+			return last, true
+		},
+		GetErrorCallback: func() error { return nil },
+		EvaluateConditionCallback: func(text string) (bool, error) {
+			condition, err := cpu.ParseCondition(text)
+			if err != nil {
+				return false, err
+			}
+			return condition.Evaluate(c), nil
+		},
+	}
+}
+
+// writeScript writes the lines of a script to a temporary file, returning its path.
+func writeScript(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "script.txt")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunScript(t *testing.T) {
+	c := &cpu.CPU{ProgramCounter: 0x200}
+	d := newTestDebugger(c)
+	path := writeScript(t,
+		"# Comments and empty lines are skipped",
+		"",
+		"sv 0x3 0x10",
+		"set mem 0x300 0x12 0x34",
+		"fill 0x310 4 0xFF",
+		"si 0x300",
+		"break 0x2A4 if v3 == 0x10",
+		"step",
+		"assert v3 == 0x10",
+		"assert pc == 0x202",
+		"assert i == 0x300",
+	)
+	if err := d.RunScript(path); err != nil {
+		t.Fatalf("RunScript returned %v", err)
+	}
+	if c.Memory[0x301] != 0x34 || c.Memory[0x313] != 0xFF || len(c.Breakpoints()) != 1 {
+		t.Fatalf("memory 0x%02x 0x%02x, %d breakpoints after the script", c.Memory[0x301], c.Memory[0x313], len(c.Breakpoints()))
+	}
+}
+
+func TestRunScriptStopsAtFailedCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		// Part of the error returned by RunScript
+		err string
+	}{
+		{"unknown command", "frobnicate", "incorrect input"},
+		{"bad address", "break zz", "unable to parse address: [zz]"},
+		{"bad condition", "break 0x200 if v3 ~ 1", "unable to add breakpoint"},
+		{"bad examine address", "x/4x zz", "unable to parse address"},
+		{"bad examine format", "x/4q 0x200", "unknown format"},
+		{"bad byte", "set mem 0x300 0x1FF", "unable to parse byte"},
+		{"out of bounds", "fill 0xFFFF 16 0", "out of bounds"},
+		{"missing file", "load missing.bin 0x300", "unable to read file"},
+		{"missing arguments", "sv 0x1", "missing register or value"},
+		{"delete unknown breakpoint", "delete 42", "no breakpoint or watchpoint number 42"},
+		{"pause while paused", "pause", "unable to pause emulation"},
+		{"finish outside a subroutine", "finish", "unable to finish"},
+		{"failed assertion", "assert v0 == 1", "assertion failed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &cpu.CPU{ProgramCounter: 0x200}
+			d := newTestDebugger(c)
+			path := writeScript(t, "sv 0x1 0x1", test.command, "sv 0x2 0x1")
+			err := d.RunScript(path)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("RunScript returned %v, expected an error containing %q", err, test.err)
+			}
+			if !strings.HasPrefix(err.Error(), path+":2: ") {
+				t.Fatalf("RunScript returned %v, expected the line of the failed command", err)
+			}
+			// The commands after the failed one are not run
+			if c.Register[1] != 1 || c.Register[2] != 0 {
+				t.Fatalf("v1 = %d, v2 = %d after the script", c.Register[1], c.Register[2])
+			}
+		})
+	}
+}
+
+func TestStepFailsWhileRunning(t *testing.T) {
+	c := &cpu.CPU{ProgramCounter: 0x200}
+	d := newTestDebugger(c)
+	err := d.RunScript(writeScript(t, "resume", "step", "sv 0x2 0x1"))
+	if err == nil || !strings.Contains(err.Error(), "unable to step as emulation is not paused") {
+		t.Fatalf("RunScript returned %v, expected the step to fail", err)
+	}
+	if c.ProgramCounter != 0x200 || c.Register[2] != 0 {
+		t.Fatalf("PC = 0x%x, v2 = %d after the script", c.ProgramCounter, c.Register[2])
+	}
+	// The emulation is no longer paused, thus resume fails too
+	if err := d.RunScript(writeScript(t, "resume")); err == nil {
+		t.Fatal("resume succeeded while the emulation is running")
+	}
+}
+
+func TestSourceStopsTheScript(t *testing.T) {
+	c := &cpu.CPU{ProgramCounter: 0x200}
+	d := newTestDebugger(c)
+	nested := writeScript(t, "x zz")
+	err := d.RunScript(writeScript(t, "source "+nested, "sv 0x2 0x1"))
+	if err == nil || !strings.Contains(err.Error(), "script stopped") || !strings.Contains(err.Error(), nested+":1: ") {
+		t.Fatalf("RunScript returned %v, expected the error of the sourced script", err)
+	}
+	if c.Register[2] != 0 {
+		t.Fatal("the commands after source were run")
+	}
+}
+
+func TestHookStopsAtFailedCommand(t *testing.T) {
+	c := &cpu.CPU{ProgramCounter: 0x200}
+	d := newTestDebugger(c)
+	if err := d.RunScript(writeScript(t, "on frame do sv 0x1 0x1; break zz; sv 0x2 0x1")); err != nil {
+		t.Fatalf("RunScript returned %v", err)
+	}
+	if !d.HasFrameHooks() || d.RunFrameHooks() {
+		t.Fatal("RunFrameHooks succeeded with a failed command")
+	}
+	if c.Register[1] != 1 || c.Register[2] != 0 {
+		t.Fatalf("v1 = %d, v2 = %d after the hook", c.Register[1], c.Register[2])
+	}
+
+	if err := d.RunScript(writeScript(t, "on clear", "on break 0x200 do sv 0x3 0x1; assert v3 == 0x2")); err != nil {
+		t.Fatalf("RunScript returned %v", err)
+	}
+	if !d.HasBreakHooks(0x200) || d.RunBreakHooks(0x200) {
+		t.Fatal("RunBreakHooks succeeded with a failed assertion")
+	}
+	if d.HasFrameHooks() || !d.RunFrameHooks() {
+		t.Fatal("RunFrameHooks failed without hooks")
+	}
+}
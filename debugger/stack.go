@@ -0,0 +1,126 @@
+package debugger
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/raveltan/chip-fa/disasm"
+	"gopkg.in/abiosoft/ishell.v2"
+)
+
+// Amount of instructions shown before and after the address by instruction-view and frame
+const viewInstructions = 30
+
+// stackFrame is a subroutine that has not returned yet, frame 0 is the one being executed
+type stackFrame struct {
+	// Address of the instruction being executed, which is the call of the inner frame for the callers
+	address uint16
+	// Entry point of the subroutine, recovered from the call (2NNN) stored on the stack. hasEntry is false for the
+	// outermost frame, or when the instruction at the call site is not a call
+	entry    uint16
+	hasEntry bool
+	// Address the subroutine returns to, hasReturn is false for the outermost frame
+	returnAddress uint16
+	hasReturn     bool
+}
+
+// backtrace returns the frames of the call stack, innermost first.
+func (d *Debugger) backtrace() []stackFrame {
+	state := d.GetStateCallback()
+	depth := int(state.StackPointer)
+	if depth > len(state.Stack) {
+		// Corrupted stack pointer, only the entries of the stack are shown
+		depth = len(state.Stack)
+	}
+	frames := []stackFrame{{address: state.ProgramCounter}}
+	// The stack stores the address of the call instructions (2NNN), from the outermost to the innermost call
+	for i := depth - 1; i >= 0; i-- {
+		callSite := state.Stack[i]
+		frame := &frames[len(frames)-1]
+		frame.returnAddress, frame.hasReturn = callSite+2, true
+		if code := d.ReadMemoryCallback(callSite, 2); len(code) == 2 {
+			instruction := disasm.Decode(uint16(code[0])<<8 | uint16(code[1]))
+			if instruction.Op == disasm.OpCALL {
+				frame.entry, frame.hasEntry = instruction.NNN, true
+			}
+		}
+		frames = append(frames, stackFrame{address: callSite})
+	}
+	return frames
+}
+
+// formatFrame returns a frame of the backtrace (ex: #1  0x214 <main+0x14> in 0x2a4 <draw>, returns to 0x216 <main+0x16>).
+func (d *Debugger) formatFrame(index int, frame stackFrame) string {
+	r := fmt.Sprintf("#%-2d %s", index, d.describeAddress(frame.address))
+	if frame.hasEntry {
+		r += " in " + d.describeAddress(frame.entry)
+	} else if frame.hasReturn {
+		r += " in unknown subroutine (no call at the call site)"
+	}
+	if frame.hasReturn {
+		r += ", returns to " + d.describeAddress(frame.returnAddress)
+	}
+	return r
+}
+
+// Backtrace returns the frames of the call stack, one per line and innermost first.
+func (d *Debugger) Backtrace() (r string) {
+	for i, frame := range d.backtrace() {
+		r += d.formatFrame(i, frame) + "\n"
+	}
+	return
+}
+
+// InstructionsAround returns the disassembled instructions around an address, which is marked with >.
+// Up to count instructions are shown before and after the address, less when it is close to the start of the memory.
+func (d *Debugger) InstructionsAround(address uint16, count int) (text string) {
+	before := address / 2
+	if before > uint16(count) {
+		before = uint16(count)
+	}
+	start := address - before*2
+	result := d.ReadMemoryCallback(start, int(before*2)+count*2+2)
+	for i := 0; i+1 < len(result); i += 2 {
+		current := start + uint16(i)
+		instruction := disasm.DecodeAt(result, i)
+		if label, ok := d.Symbols.Labels()[current]; ok {
+			text += label + ":\n"
+		}
+		if current == address {
+			text += "> " + d.formatInstruction(current, instruction) + "\n"
+		} else {
+			text += "  " + d.formatInstruction(current, instruction) + "\n"
+		}
+	}
+	return
+}
+
+func (d *Debugger) addStackCmds() {
+	d.shell.AddCmd(&ishell.Cmd{
+		Name:    "bt",
+		Aliases: []string{"backtrace"},
+		Help:    "Show the subroutines that have not returned yet, innermost first, with their entry point and return address",
+		Func: func(c *ishell.Context) {
+			c.Print(d.Backtrace())
+		},
+	})
+
+	d.shell.AddCmd(&ishell.Cmd{
+		Name: "frame",
+		Help: "View the disassembled instructions around the current instruction of a frame of bt (ex: frame 1)",
+		Func: func(c *ishell.Context) {
+			frames := d.backtrace()
+			index := 0
+			if len(c.Args) > 0 {
+				var err error
+				index, err = strconv.Atoi(c.Args[0])
+				if err != nil || index < 0 || index >= len(frames) {
+					c.Err(fmt.Errorf("unable to parse frame: [%v], make sure that it is between 0 and %d", c.Args[0], len(frames)-1))
+					return
+				}
+			}
+			c.Println(d.formatFrame(index, frames[index]))
+			c.Print(d.InstructionsAround(frames[index].address, viewInstructions))
+		},
+	})
+}
@@ -0,0 +1,181 @@
+package debugger
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/raveltan/chip-fa/disasm"
+	"gopkg.in/abiosoft/ishell.v2"
+)
+
+// CPUState is a snapshot of the CPU used by the stepping commands
+type CPUState struct {
+	Register       [16]uint8
+	IndexRegister  uint16
+	ProgramCounter uint16
+	Stack          [16]uint16
+	StackPointer   uint16
+	DelayTimer     uint8
+	SoundTimer     uint8
+	// Operation code at the program counter
+	OperationCode uint16
+	// 16 bit address stored after the operation code, used by F000 NNNN (XO-CHIP)
+	NextWord uint16
+	// Amount of instructions executed since the CPU booted, see cpu.CPU.Cycles
+	Cycles uint64
+}
+
+// instruction returns the decoded instruction at the program counter.
+func (s CPUState) instruction() disasm.Instruction {
+	instruction := disasm.Decode(s.OperationCode)
+	instruction.Long = s.NextWord
+	return instruction
+}
+
+// formatInstruction returns an instruction with its address and operation code,
+// the addresses of the instruction are replaced by their labels.
+func (d *Debugger) formatInstruction(address uint16, instruction disasm.Instruction) string {
+	return fmt.Sprintf("0x%03x: %04x  %s", address, instruction.OperationCode, instruction.Format(disasm.Cowgod, d.Symbols.Labels()))
+}
+
+// formatChanges returns the registers that are different between 2 states, one per line.
+func formatChanges(before CPUState, after CPUState) (r string) {
+	for i := range before.Register {
+		if before.Register[i] != after.Register[i] {
+			r += fmt.Sprintf("v%x: 0x%x -> 0x%x\n", i, before.Register[i], after.Register[i])
+		}
+	}
+	if before.IndexRegister != after.IndexRegister {
+		r += fmt.Sprintf("I: 0x%x -> 0x%x\n", before.IndexRegister, after.IndexRegister)
+	}
+	if before.StackPointer != after.StackPointer {
+		r += fmt.Sprintf("SP: 0x%x -> 0x%x\n", before.StackPointer, after.StackPointer)
+	}
+	if before.DelayTimer != after.DelayTimer {
+		r += fmt.Sprintf("Delay: 0x%x -> 0x%x\n", before.DelayTimer, after.DelayTimer)
+	}
+	if before.SoundTimer != after.SoundTimer {
+		r += fmt.Sprintf("Sound: 0x%x -> 0x%x\n", before.SoundTimer, after.SoundTimer)
+	}
+	return
+}
+
+// runUntil runs the emulation until stop returns true, then prints the last executed instruction (with the amount
+// of executed instructions when there are several) and the registers that have been changed since the command started.
+// Breakpoints stop the emulation before their instruction, thus nothing is executed when the command
+// starts at one: it is reported instead of an instruction, unless the instruction failed with a CPU error.
+func (d *Debugger) runUntil(c *ishell.Context, stop func(CPUState) bool) {
+	before := d.GetStateCallback()
+	last, ok := d.RunUntilCallback(stop)
+	if !ok {
+		c.Err(errors.New("unable to step as emulation is not paused"))
+		return
+	}
+	after := d.GetStateCallback()
+	// Instructions that fail are not counted, as they are not executed
+	executed := after.Cycles - before.Cycles
+	failed := d.GetErrorCallback() != nil
+	if executed == 0 && !failed {
+		c.Println("Stopped at breakpoint")
+	} else {
+		if failed && executed > 0 {
+			c.Println(fmt.Sprintf("Executed %d instructions, then failed at", executed))
+		} else if executed > 1 {
+			c.Println(fmt.Sprintf("Executed %d instructions, the last one is", executed))
+		}
+		c.Println(d.formatInstruction(last.ProgramCounter, last.instruction()))
+	}
+	c.Print(formatChanges(before, after))
+	c.Println("PC: " + d.describeAddress(after.ProgramCounter))
+}
+
+// NextCondition returns the stop condition of the next command, which executes the next instruction
+// and runs a subroutine call (2NNN) until it returns.
+func (d *Debugger) NextCondition() func(CPUState) bool {
+	start := d.GetStateCallback()
+	if start.instruction().Op != disasm.OpCALL {
+		return func(CPUState) bool { return true }
+	}
+	// The subroutine has returned when the stack is back to its depth before the call
+	return func(s CPUState) bool {
+		return s.StackPointer <= start.StackPointer
+	}
+}
+
+// FinishCondition returns the stop condition of the finish command, which runs until the current subroutine returns.
+// It returns false when the program is not in a subroutine.
+func (d *Debugger) FinishCondition() (func(CPUState) bool, bool) {
+	start := d.GetStateCallback()
+	if start.StackPointer == 0 {
+		return nil, false
+	}
+	return func(s CPUState) bool {
+		return s.StackPointer < start.StackPointer
+	}, true
+}
+
+func (d *Debugger) addStepCmds() {
+	d.shell.AddCmd(&ishell.Cmd{
+		Name:    "step",
+		Aliases: []string{"s"},
+		Help:    "[s] Execute the next instruction, or the next n instructions (ex: step, step 10)",
+		Func: func(c *ishell.Context) {
+			count := 1
+			if len(c.Args) > 0 {
+				var err error
+				count, err = strconv.Atoi(c.Args[0])
+				if err != nil || count < 1 {
+					c.Err(fmt.Errorf("unable to parse instruction count: [%v], make sure that it is a positive integer", c.Args[0]))
+					return
+				}
+			}
+			d.runUntil(c, func(CPUState) bool {
+				count--
+				return count == 0
+			})
+		},
+	})
+
+	d.shell.AddCmd(&ishell.Cmd{
+		Name:    "next",
+		Aliases: []string{"n"},
+		Help:    "[n] Execute the next instruction, running a subroutine call (2NNN) until it returns",
+		Func: func(c *ishell.Context) {
+			d.runUntil(c, d.NextCondition())
+		},
+	})
+
+	d.shell.AddCmd(&ishell.Cmd{
+		Name: "finish",
+		Help: "Run until the current subroutine returns",
+		Func: func(c *ishell.Context) {
+			stop, ok := d.FinishCondition()
+			if !ok {
+				c.Err(errors.New("unable to finish as the program is not in a subroutine"))
+				return
+			}
+			d.runUntil(c, stop)
+		},
+	})
+
+	d.shell.AddCmd(&ishell.Cmd{
+		Name:    "until",
+		Aliases: []string{"u"},
+		Help:    "[u] Run until the program counter reaches an address (ex: until 0x2A4, until main_loop)",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) == 0 {
+				c.Err(errors.New("missing address (ex: until 0x2A4)"))
+				return
+			}
+			address, err := d.parseAddress(c.Args[0])
+			if err != nil {
+				c.Err(err)
+				return
+			}
+			d.runUntil(c, func(s CPUState) bool {
+				return s.ProgramCounter == address
+			})
+		},
+	})
+}
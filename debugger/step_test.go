@@ -0,0 +1,73 @@
+package debugger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/raveltan/chip-fa/cpu"
+)
+
+func TestStepReport(t *testing.T) {
+	c := &cpu.CPU{ProgramCounter: 0x200}
+	c.Memory[0x200], c.Memory[0x201] = 0x60, 0x12
+	d := newTestDebugger(c)
+	d.initShell()
+	output := &bytes.Buffer{}
+	d.shell.SetOut(output)
+
+	// The executed instruction is reported
+	if err := d.RunScript(writeScript(t, "step")); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), "0x200: 6012") || strings.Contains(output.String(), "breakpoint") {
+		t.Fatalf("step printed %q, expected the executed instruction", output.String())
+	}
+
+	// Several instructions are counted, the last one is reported
+	output.Reset()
+	run := d.RunUntilCallback
+	d.RunUntilCallback = func(stop func(CPUState) bool) (last CPUState, ok bool) {
+		for done := false; !done; done = stop(d.GetStateCallback()) {
+			if last, ok = run(func(CPUState) bool { return true }); !ok {
+				return
+			}
+		}
+		return
+	}
+	if err := d.RunScript(writeScript(t, "step 3")); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), "Executed 3 instructions") || !strings.Contains(output.String(), "0x206: ") ||
+		!strings.Contains(output.String(), "PC: 0x208") {
+		t.Fatalf("step 3 printed %q, expected 3 instructions up to 0x206", output.String())
+	}
+	d.RunUntilCallback = run
+	c.ProgramCounter, c.Cycles = 0x202, 1
+
+	// Nothing is executed when the step starts at a breakpoint
+	output.Reset()
+	if err := d.RunScript(writeScript(t, "si 0x300", "break 0x202", "step")); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), "Stopped at breakpoint") || strings.Contains(output.String(), "0x202: ") {
+		t.Fatalf("step printed %q, expected the breakpoint", output.String())
+	}
+	if c.ProgramCounter != 0x202 || c.Cycles != 1 {
+		t.Fatalf("PC = 0x%x, %d cycles after stopping at a breakpoint", c.ProgramCounter, c.Cycles)
+	}
+
+	// Instructions that fail are reported, although they do not count as executed
+	output.Reset()
+	c.ProgramCounter = 0x200
+	d.GetErrorCallback = func() error { return cpu.ErrStackUnderflow }
+	d.RunUntilCallback = func(stop func(CPUState) bool) (CPUState, bool) {
+		return d.GetStateCallback(), true
+	}
+	if err := d.RunScript(writeScript(t, "step")); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), "0x200: 6012") || strings.Contains(output.String(), "breakpoint") {
+		t.Fatalf("step printed %q, expected the failed instruction", output.String())
+	}
+}
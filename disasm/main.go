@@ -0,0 +1,551 @@
+package disasm
+
+import (
+	"fmt"
+)
+
+// Op identifies a decoded instruction, it is shared by the CPU decoder and the disassembler
+// thus both of them always agree on the instruction set.
+type Op int
+
+// Instructions of CHIP-8, SUPER-CHIP (SCHIP), XO-CHIP and the emulator specific breakpoint
+const (
+	// Not part of the supported instruction set
+	OpUnknown Op = iota
+	// 00E0: Clear Screen.
+	OpCLS
+	// 00EE: Return from subroutine.
+	OpRET
+	// 0001: Program breakpoint. (Chip-fa)
+	OpBRK
+	// 00CN: Scrolls the screen down by N pixels. (SUPER-CHIP)
+	OpSCD
+	// 00DN: Scrolls the selected planes up by N pixels. (XO-CHIP)
+	OpSCU
+	// 00FB: Scrolls the screen right by 4 pixels. (SUPER-CHIP)
+	OpSCR
+	// 00FC: Scrolls the screen left by 4 pixels. (SUPER-CHIP)
+	OpSCL
+	// 00FD: Exits the interpreter. (SUPER-CHIP)
+	OpEXIT
+	// 00FE: Switches to the 64x32 low resolution mode. (SUPER-CHIP)
+	OpLOW
+	// 00FF: Switches to the 128x64 high resolution mode. (SUPER-CHIP)
+	OpHIGH
+	// 1NNN: Jumps to address NNN.
+	OpJP
+	// 2NNN: Call subroutine at NNN.
+	OpCALL
+	// 3XNN: Skips the next instruction if VX equals NN.
+	OpSEByte
+	// 4XNN: Skips the next instruction if VX doesn't equal NN.
+	OpSNEByte
+	// 5XY0: Skips the next instruction if VX equals VY.
+	OpSEReg
+	// 5XY2: Stores VX to VY in memory starting at address I. (XO-CHIP)
+	OpSaveRange
+	// 5XY3: Fills VX to VY with values from memory starting at address I. (XO-CHIP)
+	OpLoadRange
+	// 6XNN: Sets VX to NN.
+	OpLDByte
+	// 7XNN: Adds NN to VX.
+	OpADDByte
+	// 8XY0: Sets VX to the value of VY.
+	OpLDReg
+	// 8XY1: Sets VX to VX or VY.
+	OpOR
+	// 8XY2: Sets VX to VX and VY.
+	OpAND
+	// 8XY3: Sets VX to VX xor VY.
+	OpXOR
+	// 8XY4: Adds VY to VX.
+	OpADDReg
+	// 8XY5: VY is subtracted from VX.
+	OpSUB
+	// 8XY6: Shifts VX (or VY) to the right by 1.
+	OpSHR
+	// 8XY7: Sets VX to VY minus VX.
+	OpSUBN
+	// 8XYE: Shifts VX (or VY) to the left by 1.
+	OpSHL
+	// 9XY0: Skips the next instruction if VX doesn't equal VY.
+	OpSNEReg
+	// ANNN: Sets I to the address NNN.
+	OpLDI
+	// BNNN: Jumps to the address NNN plus V0.
+	OpJPV0
+	// CXNN: Sets VX to a random number and NN.
+	OpRND
+	// DXYN: Draws a sprite at coordinate (VX, VY).
+	OpDRW
+	// EX9E: Skips the next instruction if the key stored in VX is pressed.
+	OpSKP
+	// EXA1: Skips the next instruction if the key stored in VX isn't pressed.
+	OpSKNP
+	// F000 NNNN: Sets I to the 16 bit address NNNN. (XO-CHIP)
+	OpLDILong
+	// FN01: Selects the drawing planes by the bitmask N. (XO-CHIP)
+	OpPLANE
+	// F002: Loads the audio pattern buffer from I. (XO-CHIP)
+	OpAUDIO
+	// FX07: Sets VX to the value of the delay timer.
+	OpLDVxDT
+	// FX0A: A key press is awaited, and then stored in VX.
+	OpLDVxK
+	// FX15: Sets the delay timer to VX.
+	OpLDDTVx
+	// FX18: Sets the sound timer to VX.
+	OpLDSTVx
+	// FX1E: Adds VX to I.
+	OpADDIVx
+	// FX29: Sets I to the location of the sprite for the character in VX.
+	OpLDFVx
+	// FX30: Sets I to the location of the big sprite for the character in VX. (SUPER-CHIP)
+	OpLDHFVx
+	// FX33: Stores the binary-coded decimal representation of VX at I.
+	OpLDBVx
+	// FX3A: Sets the audio pattern playback pitch to VX. (XO-CHIP)
+	OpPITCH
+	// FX55: Stores V0 to VX in memory starting at address I.
+	OpLDIVx
+	// FX65: Fills V0 to VX with values from memory starting at address I.
+	OpLDVxI
+	// FX75: Stores V0 to VX in the RPL user flags. (SUPER-CHIP)
+	OpLDRVx
+	// FX85: Fills V0 to VX with values from the RPL user flags. (SUPER-CHIP)
+	OpLDVxR
+)
+
+// Syntax of the disassembled instructions
+type Syntax int
+
+const (
+	// Cowgod's Chip-8 technical reference syntax (ex: LD V3, 0x1F)
+	Cowgod Syntax = iota
+	// Octo's syntax (ex: v3 := 0x1F)
+	Octo
+)
+
+// Instruction is a decoded operationCode
+type Instruction struct {
+	Op            Op
+	OperationCode uint16
+	// Operands of the operationCode (0xOXYN, 0xOXNN, 0xONNN)
+	X   uint8
+	Y   uint8
+	N   uint8
+	NN  uint8
+	NNN uint16
+	// 16 bit address stored after F000, only set by DecodeAt
+	Long uint16
+}
+
+// Decode decodes a single operationCode.
+func Decode(operationCode uint16) Instruction {
+	i := Instruction{
+		OperationCode: operationCode,
+		X:             uint8(operationCode & 0x0F00 >> 8),
+		Y:             uint8(operationCode & 0x00F0 >> 4),
+		N:             uint8(operationCode & 0x000F),
+		NN:            uint8(operationCode & 0x00FF),
+		NNN:           operationCode & 0x0FFF,
+	}
+	i.Op = decodeOp(operationCode)
+	return i
+}
+
+// DecodeAt decodes the instruction at address, including the address stored after F000.
+// Bytes outside of memory are read as 0.
+func DecodeAt(memory []byte, address int) Instruction {
+	read := func(address int) uint16 {
+		if address < 0 || address >= len(memory) {
+			return 0
+		}
+		return uint16(memory[address])
+	}
+	i := Decode(read(address)<<8 | read(address+1))
+	if i.Op == OpLDILong {
+		i.Long = read(address+2)<<8 | read(address+3)
+	}
+	return i
+}
+
+func decodeOp(operationCode uint16) Op {
+	switch operationCode & 0xF000 {
+	case 0x0000:
+		switch {
+		case operationCode == 0x00E0:
+			return OpCLS
+		case operationCode == 0x00EE:
+			return OpRET
+		case operationCode == 0x0001:
+			return OpBRK
+		case operationCode&0xFFF0 == 0x00C0:
+			return OpSCD
+		case operationCode&0xFFF0 == 0x00D0:
+			return OpSCU
+		case operationCode == 0x00FB:
+			return OpSCR
+		case operationCode == 0x00FC:
+			return OpSCL
+		case operationCode == 0x00FD:
+			return OpEXIT
+		case operationCode == 0x00FE:
+			return OpLOW
+		case operationCode == 0x00FF:
+			return OpHIGH
+		}
+	case 0x1000:
+		return OpJP
+	case 0x2000:
+		return OpCALL
+	case 0x3000:
+		return OpSEByte
+	case 0x4000:
+		return OpSNEByte
+	case 0x5000:
+		switch operationCode & 0x000F {
+		case 0x0:
+			return OpSEReg
+		case 0x2:
+			return OpSaveRange
+		case 0x3:
+			return OpLoadRange
+		}
+	case 0x6000:
+		return OpLDByte
+	case 0x7000:
+		return OpADDByte
+	case 0x8000:
+		switch operationCode & 0x000F {
+		case 0x0:
+			return OpLDReg
+		case 0x1:
+			return OpOR
+		case 0x2:
+			return OpAND
+		case 0x3:
+			return OpXOR
+		case 0x4:
+			return OpADDReg
+		case 0x5:
+			return OpSUB
+		case 0x6:
+			return OpSHR
+		case 0x7:
+			return OpSUBN
+		case 0xE:
+			return OpSHL
+		}
+	case 0x9000:
+		if operationCode&0x000F == 0 {
+			return OpSNEReg
+		}
+	case 0xA000:
+		return OpLDI
+	case 0xB000:
+		return OpJPV0
+	case 0xC000:
+		return OpRND
+	case 0xD000:
+		return OpDRW
+	case 0xE000:
+		switch operationCode & 0x00FF {
+		case 0x9E:
+			return OpSKP
+		case 0xA1:
+			return OpSKNP
+		}
+	case 0xF000:
+		switch operationCode & 0x00FF {
+		case 0x00:
+			if operationCode == 0xF000 {
+				return OpLDILong
+			}
+		case 0x01:
+			return OpPLANE
+		case 0x02:
+			if operationCode == 0xF002 {
+				return OpAUDIO
+			}
+		case 0x07:
+			return OpLDVxDT
+		case 0x0A:
+			return OpLDVxK
+		case 0x15:
+			return OpLDDTVx
+		case 0x18:
+			return OpLDSTVx
+		case 0x1E:
+			return OpADDIVx
+		case 0x29:
+			return OpLDFVx
+		case 0x30:
+			return OpLDHFVx
+		case 0x33:
+			return OpLDBVx
+		case 0x3A:
+			return OpPITCH
+		case 0x55:
+			return OpLDIVx
+		case 0x65:
+			return OpLDVxI
+		case 0x75:
+			return OpLDRVx
+		case 0x85:
+			return OpLDVxR
+		}
+	}
+	return OpUnknown
+}
+
+// Size returns the size of the instruction in bytes.
+func (i Instruction) Size() int {
+	if i.Op == OpLDILong {
+		return 4
+	}
+	return 2
+}
+
+// String returns the instruction in Cowgod's syntax.
+func (i Instruction) String() string {
+	return i.Format(Cowgod, nil)
+}
+
+// Format returns the instruction in the given syntax,
+// addresses that have a label in labels are replaced by the label.
+func (i Instruction) Format(syntax Syntax, labels map[uint16]string) string {
+	if syntax == Octo {
+		return i.formatOcto(labels)
+	}
+	return i.formatCowgod(labels)
+}
+
+func formatAddress(address uint16, labels map[uint16]string) string {
+	if label, ok := labels[address]; ok {
+		return label
+	}
+	return fmt.Sprintf("0x%03X", address)
+}
+
+func (i Instruction) formatCowgod(labels map[uint16]string) string {
+	vx := fmt.Sprintf("V%X", i.X)
+	vy := fmt.Sprintf("V%X", i.Y)
+	nn := fmt.Sprintf("0x%02X", i.NN)
+	switch i.Op {
+	case OpCLS:
+		return "CLS"
+	case OpRET:
+		return "RET"
+	case OpBRK:
+		return "BRK"
+	case OpSCD:
+		return fmt.Sprintf("SCD %d", i.N)
+	case OpSCU:
+		return fmt.Sprintf("SCU %d", i.N)
+	case OpSCR:
+		return "SCR"
+	case OpSCL:
+		return "SCL"
+	case OpEXIT:
+		return "EXIT"
+	case OpLOW:
+		return "LOW"
+	case OpHIGH:
+		return "HIGH"
+	case OpJP:
+		return "JP " + formatAddress(i.NNN, labels)
+	case OpCALL:
+		return "CALL " + formatAddress(i.NNN, labels)
+	case OpSEByte:
+		return "SE " + vx + ", " + nn
+	case OpSNEByte:
+		return "SNE " + vx + ", " + nn
+	case OpSEReg:
+		return "SE " + vx + ", " + vy
+	case OpSaveRange:
+		return "LD [I], " + vx + "-" + vy
+	case OpLoadRange:
+		return "LD " + vx + "-" + vy + ", [I]"
+	case OpLDByte:
+		return "LD " + vx + ", " + nn
+	case OpADDByte:
+		return "ADD " + vx + ", " + nn
+	case OpLDReg:
+		return "LD " + vx + ", " + vy
+	case OpOR:
+		return "OR " + vx + ", " + vy
+	case OpAND:
+		return "AND " + vx + ", " + vy
+	case OpXOR:
+		return "XOR " + vx + ", " + vy
+	case OpADDReg:
+		return "ADD " + vx + ", " + vy
+	case OpSUB:
+		return "SUB " + vx + ", " + vy
+	case OpSHR:
+		return "SHR " + vx + ", " + vy
+	case OpSUBN:
+		return "SUBN " + vx + ", " + vy
+	case OpSHL:
+		return "SHL " + vx + ", " + vy
+	case OpSNEReg:
+		return "SNE " + vx + ", " + vy
+	case OpLDI:
+		return "LD I, " + formatAddress(i.NNN, labels)
+	case OpJPV0:
+		return "JP V0, " + formatAddress(i.NNN, labels)
+	case OpRND:
+		return "RND " + vx + ", " + nn
+	case OpDRW:
+		return fmt.Sprintf("DRW %s, %s, %d", vx, vy, i.N)
+	case OpSKP:
+		return "SKP " + vx
+	case OpSKNP:
+		return "SKNP " + vx
+	case OpLDILong:
+		return "LD I, LONG " + formatAddress(i.Long, labels)
+	case OpPLANE:
+		return fmt.Sprintf("PLANE %d", i.X)
+	case OpAUDIO:
+		return "AUDIO"
+	case OpLDVxDT:
+		return "LD " + vx + ", DT"
+	case OpLDVxK:
+		return "LD " + vx + ", K"
+	case OpLDDTVx:
+		return "LD DT, " + vx
+	case OpLDSTVx:
+		return "LD ST, " + vx
+	case OpADDIVx:
+		return "ADD I, " + vx
+	case OpLDFVx:
+		return "LD F, " + vx
+	case OpLDHFVx:
+		return "LD HF, " + vx
+	case OpLDBVx:
+		return "LD B, " + vx
+	case OpPITCH:
+		return "PITCH " + vx
+	case OpLDIVx:
+		return "LD [I], " + vx
+	case OpLDVxI:
+		return "LD " + vx + ", [I]"
+	case OpLDRVx:
+		return "LD R, " + vx
+	case OpLDVxR:
+		return "LD " + vx + ", R"
+	}
+	return fmt.Sprintf("DB 0x%02X, 0x%02X", i.OperationCode>>8, i.OperationCode&0xFF)
+}
+
+func (i Instruction) formatOcto(labels map[uint16]string) string {
+	vx := fmt.Sprintf("v%x", i.X)
+	vy := fmt.Sprintf("v%x", i.Y)
+	nn := fmt.Sprintf("0x%02X", i.NN)
+	switch i.Op {
+	case OpCLS:
+		return "clear"
+	case OpRET:
+		return "return"
+	case OpSCD:
+		return fmt.Sprintf("scroll-down %d", i.N)
+	case OpSCU:
+		return fmt.Sprintf("scroll-up %d", i.N)
+	case OpSCR:
+		return "scroll-right"
+	case OpSCL:
+		return "scroll-left"
+	case OpEXIT:
+		return "exit"
+	case OpLOW:
+		return "lores"
+	case OpHIGH:
+		return "hires"
+	case OpJP:
+		return "jump " + formatAddress(i.NNN, labels)
+	case OpCALL:
+		return ":call " + formatAddress(i.NNN, labels)
+	// Octo writes skips as the condition under which the next instruction is executed
+	case OpSEByte:
+		return "if " + vx + " != " + nn + " then"
+	case OpSNEByte:
+		return "if " + vx + " == " + nn + " then"
+	case OpSEReg:
+		return "if " + vx + " != " + vy + " then"
+	case OpSaveRange:
+		return "save " + vx + " - " + vy
+	case OpLoadRange:
+		return "load " + vx + " - " + vy
+	case OpLDByte:
+		return vx + " := " + nn
+	case OpADDByte:
+		return vx + " += " + nn
+	case OpLDReg:
+		return vx + " := " + vy
+	case OpOR:
+		return vx + " |= " + vy
+	case OpAND:
+		return vx + " &= " + vy
+	case OpXOR:
+		return vx + " ^= " + vy
+	case OpADDReg:
+		return vx + " += " + vy
+	case OpSUB:
+		return vx + " -= " + vy
+	case OpSHR:
+		return vx + " >>= " + vy
+	case OpSUBN:
+		return vx + " =- " + vy
+	case OpSHL:
+		return vx + " <<= " + vy
+	case OpSNEReg:
+		return "if " + vx + " == " + vy + " then"
+	case OpLDI:
+		return "i := " + formatAddress(i.NNN, labels)
+	case OpJPV0:
+		return "jump0 " + formatAddress(i.NNN, labels)
+	case OpRND:
+		return vx + " := random " + nn
+	case OpDRW:
+		return fmt.Sprintf("sprite %s %s %d", vx, vy, i.N)
+	case OpSKP:
+		return "if " + vx + " -key then"
+	case OpSKNP:
+		return "if " + vx + " key then"
+	case OpLDILong:
+		return "i := long " + formatAddress(i.Long, labels)
+	case OpPLANE:
+		return fmt.Sprintf("plane %d", i.X)
+	case OpAUDIO:
+		return "audio"
+	case OpLDVxDT:
+		return vx + " := delay"
+	case OpLDVxK:
+		return vx + " := key"
+	case OpLDDTVx:
+		return "delay := " + vx
+	case OpLDSTVx:
+		return "buzzer := " + vx
+	case OpADDIVx:
+		return "i += " + vx
+	case OpLDFVx:
+		return "i := hex " + vx
+	case OpLDHFVx:
+		return "i := bighex " + vx
+	case OpLDBVx:
+		return "bcd " + vx
+	case OpPITCH:
+		return "pitch := " + vx
+	case OpLDIVx:
+		return "save " + vx
+	case OpLDVxI:
+		return "load " + vx
+	case OpLDRVx:
+		return "saveflags " + vx
+	case OpLDVxR:
+		return "loadflags " + vx
+	}
+	// Octo has no breakpoint instruction, thus BRK is written as raw bytes too
+	return fmt.Sprintf("0x%02X 0x%02X", i.OperationCode>>8, i.OperationCode&0xFF)
+}
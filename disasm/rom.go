@@ -0,0 +1,129 @@
+package disasm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Address where the ROMs are loaded and start executing
+const RomAddress = 0x200
+
+// Maximum amount of data bytes written on a single line
+const bytesPerLine = 8
+
+// Disassemble disassembles a whole ROM loaded at RomAddress.
+// -----------
+// Code and data are separated by following the execution from the entry point (recursive descent):
+// jumps and calls are followed, skips follow both of the next instructions, and the execution stops
+// at returns, exits, computed jumps (BNNN) and unknown operationCodes.
+// Every byte that is never reached is written as data.
+// Targets of jumps, calls and I are given generated labels (label_2A4, sub_2A0, data_3C0).
+// -----------
+func Disassemble(rom []byte, syntax Syntax) string {
+	memory := make([]byte, RomAddress+len(rom))
+	copy(memory[RomAddress:], rom)
+	end := len(memory)
+
+	isCode := make([]bool, end)
+	labels := map[uint16]string{}
+	addLabel := func(address uint16, prefix string) {
+		if int(address) < RomAddress || int(address) >= end {
+			return
+		}
+		// Subroutines are named after their calls, even if they are also jumped to
+		if _, ok := labels[address]; !ok || prefix == "sub" {
+			labels[address] = fmt.Sprintf("%s_%03X", prefix, address)
+		}
+	}
+
+	pending := []int{RomAddress}
+	for len(pending) > 0 {
+		address := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		for address >= RomAddress && address+1 < end && !isCode[address] {
+			instruction := DecodeAt(memory, address)
+			if instruction.Op == OpUnknown || address+instruction.Size() > end {
+				break
+			}
+			for offset := 0; offset < instruction.Size(); offset++ {
+				isCode[address+offset] = true
+			}
+			next := address + instruction.Size()
+
+			stop := false
+			switch instruction.Op {
+			case OpJP:
+				addLabel(instruction.NNN, "label")
+				pending = append(pending, int(instruction.NNN))
+				stop = true
+			case OpCALL:
+				addLabel(instruction.NNN, "sub")
+				pending = append(pending, int(instruction.NNN))
+			case OpRET, OpEXIT, OpJPV0:
+				if instruction.Op == OpJPV0 {
+					addLabel(instruction.NNN, "data")
+				}
+				stop = true
+			case OpSEByte, OpSNEByte, OpSEReg, OpSNEReg, OpSKP, OpSKNP:
+				// The skipped instruction may be F000 NNNN, which is 4 bytes long
+				pending = append(pending, next+DecodeAt(memory, next).Size())
+			case OpLDI:
+				addLabel(instruction.NNN, "data")
+			case OpLDILong:
+				addLabel(instruction.Long, "data")
+			}
+			if stop {
+				break
+			}
+			address = next
+		}
+	}
+
+	// Labels that point inside of an instruction can not be defined, thus their addresses are written instead
+	for address := RomAddress; address < end; address++ {
+		if !isCode[address] {
+			continue
+		}
+		size := DecodeAt(memory, address).Size()
+		for offset := 1; offset < size; offset++ {
+			delete(labels, uint16(address+offset))
+		}
+		address += size - 1
+	}
+
+	builder := strings.Builder{}
+	labelDefinition := func(address int) {
+		if label, ok := labels[uint16(address)]; ok {
+			if syntax == Octo {
+				builder.WriteString(": " + label + "\n")
+			} else {
+				builder.WriteString(label + ":\n")
+			}
+		}
+	}
+	for address := RomAddress; address < end; {
+		labelDefinition(address)
+		if isCode[address] {
+			instruction := DecodeAt(memory, address)
+			builder.WriteString("\t" + instruction.Format(syntax, labels) + "\n")
+			address += instruction.Size()
+			continue
+		}
+
+		// Data continues until the next code, label or the end of the line
+		data := []string{}
+		for len(data) < bytesPerLine && address < end && !isCode[address] {
+			if _, ok := labels[uint16(address)]; ok && len(data) > 0 {
+				break
+			}
+			data = append(data, fmt.Sprintf("0x%02X", memory[address]))
+			address++
+		}
+		if syntax == Octo {
+			builder.WriteString("\t" + strings.Join(data, " ") + "\n")
+		} else {
+			builder.WriteString("\tDB " + strings.Join(data, ", ") + "\n")
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,183 @@
+package emulator
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/raveltan/chip-fa/cpu"
+	"github.com/raveltan/chip-fa/disasm"
+)
+
+// The debugger shell, the GDB stub and the debug adapter run on their own goroutines while the game loop
+// executes the CPU. Their requests are sent to the game loop, which applies them between the cycles
+// at the start of each update, thus the CPU and the emulator are only used by the game loop.
+// -----------
+// Example (a callback of the debugger)
+// e.request(func() {
+// 	registers = e.Cpu.Register
+// })
+// -----------
+
+// request applies f from the game loop and waits until it is done, f is applied directly once the game loop has stopped.
+// It must not be called by the game loop itself, see callDebugger.
+func (e *Emulator) request(f func()) {
+	done := make(chan struct{})
+	select {
+	case e.requests <- func() {
+		f()
+		close(done)
+	}:
+		<-done
+	case <-e.stopped:
+		f()
+	}
+}
+
+// applyRequests applies the pending requests, called by the game loop before executing the cycles of a frame.
+func (e *Emulator) applyRequests() {
+	for {
+		select {
+		case request := <-e.requests:
+			request()
+		default:
+			return
+		}
+	}
+}
+
+// callDebugger runs f, which uses the debugger, from the game loop. The callbacks of the debugger are requests
+// that wait for the game loop, thus f is run on another goroutine while the game loop applies the requests.
+func (e *Emulator) callDebugger(f func()) {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	for {
+		select {
+		case request := <-e.requests:
+			request()
+		case <-done:
+			return
+		}
+	}
+}
+
+// resume resumes the paused emulation, clearing the CPU error that halted it. Returns false when it is not paused.
+func (e *Emulator) resume() bool {
+	if !e.Pause {
+		return false
+	}
+	e.Pause = false
+	if e.cpuError != nil {
+		e.cpuError = nil
+		ebiten.SetWindowTitle("Chip-Fa")
+	}
+	return true
+}
+
+// The game loop hands the stops of the emulation over to the debugger shell through handOff, it never waits for it.
+// -----------
+// breakpoint (cpu.StopForDebuggingCallback)   -> stopAtBreakpoint, runs the hooks of the breakpoint if any
+// watchpoint (cpu.StopForWatchpointCallback)  -> stopForWatchpoint
+// CPU error                                   -> haltWithError
+// failed frame hook, debugger hotkey          -> handOff
+// debug script (before the game loop starts)  -> handOff, runs the script
+// -----------
+// The GDB stub and the debug adapter do not use the shell, they wait for the pause in runUntilPaused instead.
+
+// handOff pauses the emulation and hands it over to the debugger shell, when debugging is enabled.
+// run (nil when there is nothing to run) is called first, the emulation is resumed when it succeeds
+// and the shell is opened otherwise. run and the shell use the debugger, whose callbacks are requests,
+// thus they are run on another goroutine while the game loop applies the requests.
+func (e *Emulator) handOff(run func() bool) {
+	e.Pause = true
+	if e.debug == nil {
+		return
+	}
+	go func() {
+		if run != nil && run() {
+			e.request(func() {
+				e.resume()
+			})
+			return
+		}
+		e.debug.StartDebugShell()
+	}()
+}
+
+// stopAtBreakpoint pauses the emulation at a breakpoint, before its instruction is executed.
+// Breakpoints are ignored when no debugger controls the emulation, and the breakpoints of hooks
+// only pause it while their commands are run (unless a stepping command is running).
+func (e *Emulator) stopAtBreakpoint() {
+	address := e.Cpu.ProgramCounter
+	if e.debug != nil && e.runUntil == nil && e.debug.HasBreakHooks(address) {
+		// Checked before the hooks are run, as their commands may change the state the conditions depend on
+		resume := e.onlyHookBreakpoints(address)
+		e.handOff(func() bool {
+			if e.debug.RunBreakHooks(address) && resume {
+				return true
+			}
+			log.Printf("Stopped at %s", e.describeAddress(address))
+			return false
+		})
+		return
+	}
+	if !e.debugged {
+		return
+	}
+	log.Printf("Stopped at %s", e.describeAddress(address))
+	e.handOff(nil)
+}
+
+// onlyHookBreakpoints returns whether every breakpoint that stopped the emulation at address was added by a hook,
+// the other breakpoints at the same address keep the emulation paused once the commands of the hooks are done.
+func (e *Emulator) onlyHookBreakpoints(address uint16) bool {
+	hit := false
+	for _, breakpoint := range e.Cpu.Breakpoints() {
+		if breakpoint.Address != address || (breakpoint.Condition != nil && !breakpoint.Condition.Evaluate(e.Cpu)) {
+			continue
+		}
+		if !e.debug.IsHookBreakpoint(breakpoint.ID) {
+			return false
+		}
+		hit = true
+	}
+	return hit
+}
+
+// stopForWatchpoint pauses the emulation and reports the accesses that triggered watchpoints.
+func (e *Emulator) stopForWatchpoint(hits []cpu.WatchpointHit) {
+	if !e.debugged {
+		return
+	}
+	for _, hit := range hits {
+		access := "read"
+		if hit.Write {
+			access = "written"
+		}
+		instruction := disasm.Decode(hit.OperationCode).Format(disasm.Cowgod, e.symbols.Labels())
+		log.Printf("Watchpoint %d: %s %s by %s (%04x %s), 0x%02x -> 0x%02x",
+			hit.Watchpoint.ID, e.describeAddress(hit.Watchpoint.Address), access,
+			e.describeAddress(hit.ProgramCounter), hit.OperationCode, instruction, hit.OldValue, hit.NewValue)
+	}
+	e.handOff(nil)
+}
+
+// haltWithError pauses the emulation and reports a CPU error
+// on the window title and the debugger shell (if debugging is enabled).
+func (e *Emulator) haltWithError(err error) {
+	e.Pause = true
+	e.cpuError = err
+	ebiten.SetWindowTitle(fmt.Sprintf("Chip-Fa (halted: %v)", err))
+	log.Printf("error: Emulation halted, %v", err)
+	if e.debug != nil && (errors.Is(err, cpu.ErrStackOverflow) || errors.Is(err, cpu.ErrStackUnderflow)) {
+		// The calls that filled (or emptied) the stack, the stack is left as it was before the instruction
+		e.callDebugger(func() {
+			log.Printf("Call stack:\n%s", e.debug.Backtrace())
+		})
+	}
+	e.handOff(nil)
+}
@@ -0,0 +1,329 @@
+package emulator
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raveltan/chip-fa/cpu"
+	"github.com/raveltan/chip-fa/debugger"
+	"github.com/raveltan/chip-fa/gdbstub"
+)
+
+// newTestEmulator returns a paused emulator whose ROM increments V0 in a loop, controlled by a debugger.
+// -----------
+// 0x200: 7001  ADD V0, 0x01
+// 0x202: 1200  JP 0x200
+// -----------
+func newTestEmulator() *Emulator {
+	c := &cpu.CPU{}
+	c.Boot()
+	copy(c.Memory[0x200:], []uint8{0x70, 0x01, 0x12, 0x00})
+	e := &Emulator{Cpu: c, cyclePerSecond: 600, keymap: DefaultKeymap(), Pause: true, debugged: true,
+		requests: make(chan func()), stopped: make(chan struct{})}
+	c.StopForDebuggingCallback = e.stopAtBreakpoint
+	c.StopForWatchpointCallback = e.stopForWatchpoint
+	return e
+}
+
+// runGameLoop applies the requests and emulates the frames on its own goroutine as Update does, without the window.
+// The game loop stops at the end of the test, the requests are then applied directly as once ebiten.RunGame returns.
+func runGameLoop(t *testing.T, e *Emulator) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			e.applyRequests()
+			if err := e.emulateFrame(); err != nil {
+				t.Errorf("emulateFrame returned %v", err)
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+		close(e.stopped)
+	})
+}
+
+// waitFor polls condition, which may issue requests, until it returns true.
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// writeScript writes debugger commands to a file, returning its path.
+func writeScript(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "script.txt")
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	e := newTestEmulator()
+	d := createDebugger(e)
+	target := gdbTarget{e: e}
+	runGameLoop(t, e)
+
+	// Every interface drives the emulation at the same time, each call either succeeds or fails without blocking
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				f(i)
+			}
+		}()
+	}
+	run(func(int) {
+		d.PauseEmulationCallback()
+		d.ResumeEmulationCallback()
+	})
+	run(func(i int) {
+		d.SetRegisterCallback(0x1, uint8(i))
+		d.GetRegisterCallback()
+		d.GetStateCallback()
+	})
+	run(func(int) {
+		d.PauseEmulationCallback()
+		count := 3
+		d.RunUntilCallback(func(debugger.CPUState) bool {
+			count--
+			return count == 0
+		})
+	})
+	run(func(i int) {
+		target.Pause()
+		registers := target.Registers()
+		registers.Register[0x2] = uint8(i)
+		target.SetRegisters(registers)
+		target.ReadMemory(0x200, 4)
+		// The other goroutines may resume the emulation in between
+		if err := target.Step(); err != nil && !errors.Is(err, gdbstub.ErrNotPaused) {
+			t.Errorf("Step returned %v", err)
+		}
+		interrupt := make(chan struct{})
+		close(interrupt)
+		if err := target.Continue(interrupt); err != nil && !errors.Is(err, gdbstub.ErrNotPaused) {
+			t.Errorf("Continue returned %v", err)
+		}
+		target.Resume()
+	})
+	wg.Wait()
+
+	// The emulation is still driven by the game loop
+	d.PauseEmulationCallback()
+	before := d.GetStateCallback()
+	count := 10
+	last, ok := d.RunUntilCallback(func(debugger.CPUState) bool {
+		count--
+		return count == 0
+	})
+	after := d.GetStateCallback()
+	if !ok || after.Cycles != before.Cycles+10 || last.Cycles != after.Cycles-1 {
+		t.Fatalf("ran from cycle %d to %d (last %d, %v), expected 10 cycles", before.Cycles, after.Cycles, last.Cycles, ok)
+	}
+}
+
+func TestStopAtBreakpoint(t *testing.T) {
+	e := newTestEmulator()
+	d := createDebugger(e)
+	runGameLoop(t, e)
+
+	// Nothing is executed when starting at a breakpoint
+	id, err := d.AddBreakpointCallback(0x200, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, ok := d.RunUntilCallback(func(debugger.CPUState) bool { return false })
+	state := d.GetStateCallback()
+	if !ok || state.Cycles != 0 || state.ProgramCounter != 0x200 || last.Cycles != 0 {
+		t.Fatalf("stopped at 0x%x after %d cycles, expected the breakpoint at 0x200", state.ProgramCounter, state.Cycles)
+	}
+
+	// Resuming from a breakpoint executes its instruction
+	d.DeleteBreakpointCallback(id)
+	if _, err := d.AddBreakpointCallback(0x202, ""); err != nil {
+		t.Fatal(err)
+	}
+	last, ok = d.RunUntilCallback(func(debugger.CPUState) bool { return false })
+	state = d.GetStateCallback()
+	if !ok || state.ProgramCounter != 0x202 || state.Register[0] != 1 || last.ProgramCounter != 0x200 {
+		t.Fatalf("stopped at 0x%x with v0 = %d (last 0x%x), expected the breakpoint at 0x202", state.ProgramCounter, state.Register[0], last.ProgramCounter)
+	}
+	if !d.ResumeEmulationCallback() {
+		t.Fatal("the emulation was not paused by the breakpoint")
+	}
+	waitFor(t, "the next hit of the breakpoint", func() bool {
+		return d.GetBreakpointsCallback()[0].HitCount == 2 && !d.PauseEmulationCallback()
+	})
+}
+
+func TestGetMemoryView(t *testing.T) {
+	e := newTestEmulator()
+	d := createDebugger(e)
+	runGameLoop(t, e)
+
+	// The deprecated callback still returns the memory from PC - 120 to PC + 121
+	view := d.GetMemoryViewCallback()
+	if len(view) != 242 || !reflect.DeepEqual(view[120:124], []uint8{0x70, 0x01, 0x12, 0x00}) {
+		t.Fatalf("%d bytes around the PC, expected 242 bytes with the ROM at 120", len(view))
+	}
+}
+
+func TestHooksResume(t *testing.T) {
+	e := newTestEmulator()
+	e.debug = createDebugger(e)
+	runGameLoop(t, e)
+
+	// Frame hooks run after every frame that was not stopped
+	if err := e.debug.RunScript(writeScript(t, "on frame do sv 0x6 0x1\nresume\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the frame hook", func() bool {
+		return e.debug.GetRegisterCallback()[0x6] == 1
+	})
+
+	// The emulation is resumed once the commands of a breakpoint hook are done
+	if err := e.debug.RunScript(writeScript(t, "pause\non clear\non break 0x202 do sv 0x5 0x7\nresume\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the breakpoint hook", func() bool {
+		breakpoints := e.debug.GetBreakpointsCallback()
+		return len(breakpoints) == 1 && breakpoints[0].HitCount > 3 && e.debug.GetRegisterCallback()[0x5] == 7
+	})
+
+	// A plain breakpoint at the same address keeps the emulation paused once the commands are done
+	if _, err := e.debug.AddBreakpointCallback(0x202, ""); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the plain breakpoint", func() bool {
+		before := e.debug.GetStateCallback()
+		time.Sleep(20 * time.Millisecond)
+		after := e.debug.GetStateCallback()
+		return after.Cycles == before.Cycles && after.ProgramCounter == 0x202
+	})
+}
+
+func TestClearHooksWhileRunning(t *testing.T) {
+	e := newTestEmulator()
+	e.debug = createDebugger(e)
+	runGameLoop(t, e)
+
+	// The emulator checks the hooks at the end of every frame while they are deleted, the hook at 0x300 is never run.
+	// Long frames make the deletion start while the game loop is in the middle of one.
+	e.cyclePerSecond = 3000000
+	script := "resume\n" + strings.Repeat("on break 0x300 do sv 0x5 0x7\non clear\n", 50)
+	done := make(chan error, 1)
+	go func() {
+		done <- e.debug.RunScript(writeScript(t, script))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("on clear did not return while the emulation is running")
+	}
+	if breakpoints := e.debug.GetBreakpointsCallback(); len(breakpoints) != 0 || e.debug.HasBreakHooks(0x300) {
+		t.Fatalf("%d breakpoints left after on clear", len(breakpoints))
+	}
+}
+
+func TestInterruptBeforeContinue(t *testing.T) {
+	e := newTestEmulator()
+	target := gdbTarget{e: e}
+	runGameLoop(t, e)
+
+	interrupt := make(chan struct{})
+	close(interrupt)
+	if err := target.Continue(interrupt); err != nil {
+		t.Fatalf("Continue returned %v", err)
+	}
+	var cycles uint64
+	var paused bool
+	e.request(func() {
+		cycles, paused = e.Cpu.Cycles, e.Pause
+	})
+	if cycles != 1 || !paused {
+		t.Fatalf("%d cycles executed (paused: %v) after an interrupt, expected 1", cycles, paused)
+	}
+}
+
+func TestStepWhileRunning(t *testing.T) {
+	e := newTestEmulator()
+	target := gdbTarget{e: e}
+	runGameLoop(t, e)
+
+	// Resumed by something else than GDB, such as the debugger shell
+	target.Resume()
+	if err := target.Step(); !errors.Is(err, gdbstub.ErrNotPaused) {
+		t.Fatalf("Step returned %v while running, expected %v", err, gdbstub.ErrNotPaused)
+	}
+	if err := target.Continue(make(chan struct{})); !errors.Is(err, gdbstub.ErrNotPaused) {
+		t.Fatalf("Continue returned %v while running, expected %v", err, gdbstub.ErrNotPaused)
+	}
+}
+
+func TestHaltWithError(t *testing.T) {
+	e := newTestEmulator()
+	target := gdbTarget{e: e}
+	runGameLoop(t, e)
+
+	// The accesses of the failing instruction are reported before its error
+	var watchpointHits int
+	e.request(func() {
+		e.Cpu.AddWatchpoint(0x300, cpu.WatchRead)
+		e.Cpu.StopForWatchpointCallback = func(hits []cpu.WatchpointHit) {
+			watchpointHits += len(hits)
+			e.stopForWatchpoint(hits)
+		}
+	})
+	registers := target.Registers()
+	registers.ProgramCounter = 0x300
+	target.SetRegisters(registers)
+	var unknownOpcode *cpu.UnknownOpcodeError
+	if err := target.Step(); !errors.As(err, &unknownOpcode) {
+		t.Fatalf("Step returned %v, expected an unknown operation code", err)
+	}
+	var paused bool
+	e.request(func() {
+		paused = e.Pause
+	})
+	if !paused || watchpointHits != 1 {
+		t.Fatalf("paused: %v, %d watchpoint hits after an error", paused, watchpointHits)
+	}
+
+	// Resuming clears the error
+	registers.ProgramCounter = 0x200
+	target.SetRegisters(registers)
+	target.Resume()
+	waitFor(t, "the emulation to resume", func() bool {
+		return target.Registers().Register[0] > 0
+	})
+	if err := target.cpuError(); err != nil {
+		t.Fatalf("the error %v was not cleared", err)
+	}
+}
@@ -0,0 +1,160 @@
+package emulator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+)
+
+// Axes are considered as pressed when they are pushed past this threshold,
+// which is also the dead zone of sticks that do not rest exactly at 0
+const gamepadAxisThreshold = 0.5
+
+// D-pad directions, in the order of the last 4 buttons of the gamepads whose D-pad is reported as buttons
+// (GLFW reports the hats after the buttons, up, right, down then left)
+const (
+	dpadUp = iota
+	dpadRight
+	dpadDown
+	dpadLeft
+)
+
+var dpadNames = [4]string{"dpadup", "dpadright", "dpaddown", "dpadleft"}
+
+// Gamepads with fewer buttons have no D-pad reported as buttons, as it comes after at least 4 other buttons
+const dpadMinButtons = 8
+
+// GamepadBinding is either a gamepad button, or one direction of a gamepad axis.
+// -----------
+// Bindings are named "Button<N>" for buttons and "Axis<N>+" / "Axis<N>-" for axes (ex: Button0, Axis1-).
+// The numbering of the buttons and axes depends on the gamepad and the platform,
+// D-pads are usually reported as the first 2 axes or as the last 4 buttons.
+// The latter are named "DPadUp", "DPadRight", "DPadDown" and "DPadLeft", whatever the number of buttons.
+// -----------
+type GamepadBinding struct {
+	Button ebiten.GamepadButton
+	// Whether the binding is an axis instead of a button
+	IsAxis bool
+	Axis   int
+	// Direction of the axis, either -1 or 1
+	Direction float64
+	// Whether the binding is one of the last 4 buttons instead of a button
+	IsDPad bool
+	// Direction of the D-pad (dpadUp, dpadRight, dpadDown or dpadLeft)
+	DPad int
+}
+
+// Default gamepad bindings, as most games use 2/4/6/8 for movement and 5 or A for actions.
+// The directions are bound to the first 2 axes only, the last 4 buttons are not always a D-pad
+// (Start, Select or the stick buttons on some gamepads), thus the DPad bindings are left to the keymap.
+var defaultGamepadBindings = map[int][]GamepadBinding{
+	0x2: {{IsAxis: true, Axis: 1, Direction: -1}},
+	0x4: {{IsAxis: true, Axis: 0, Direction: -1}},
+	0x6: {{IsAxis: true, Axis: 0, Direction: 1}},
+	0x8: {{IsAxis: true, Axis: 1, Direction: 1}},
+	0x5: {{Button: ebiten.GamepadButton0}},
+	0xA: {{Button: ebiten.GamepadButton1}},
+}
+
+func parseGamepadBinding(name string) (GamepadBinding, error) {
+	lowerName := strings.ToLower(name)
+	for direction, dpadName := range dpadNames {
+		if lowerName == dpadName {
+			return GamepadBinding{IsDPad: true, DPad: direction}, nil
+		}
+	}
+	switch {
+	case strings.HasPrefix(lowerName, "button"):
+		button, err := strconv.Atoi(lowerName[len("button"):])
+		if err != nil || button < 0 || ebiten.GamepadButton(button) > ebiten.GamepadButtonMax {
+			return GamepadBinding{}, fmt.Errorf("unknown gamepad button %q", name)
+		}
+		return GamepadBinding{Button: ebiten.GamepadButton(button)}, nil
+	case strings.HasPrefix(lowerName, "axis") && (strings.HasSuffix(lowerName, "+") || strings.HasSuffix(lowerName, "-")):
+		axis, err := strconv.Atoi(lowerName[len("axis") : len(lowerName)-1])
+		if err != nil || axis < 0 {
+			return GamepadBinding{}, fmt.Errorf("unknown gamepad axis %q", name)
+		}
+		direction := 1.0
+		if strings.HasSuffix(lowerName, "-") {
+			direction = -1
+		}
+		return GamepadBinding{IsAxis: true, Axis: axis, Direction: direction}, nil
+	}
+	return GamepadBinding{}, fmt.Errorf("unknown gamepad binding %q, must be Button<N>, Axis<N>+, Axis<N>- or DPadUp/Right/Down/Left", name)
+}
+
+func parseGamepadBindings(names []string) (bindings []GamepadBinding, err error) {
+	for _, name := range names {
+		binding, err := parseGamepadBinding(name)
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, binding)
+	}
+	return
+}
+
+// isAxisPressed returns whether an axis at value is pushed in direction past the dead zone.
+func isAxisPressed(value float64, direction float64) bool {
+	return value*direction > gamepadAxisThreshold
+}
+
+// dpadButton returns the button of a D-pad direction on a gamepad with buttonNum buttons,
+// false when the gamepad has no D-pad reported as buttons.
+func dpadButton(direction int, buttonNum int) (ebiten.GamepadButton, bool) {
+	if buttonNum < dpadMinButtons {
+		return 0, false
+	}
+	return ebiten.GamepadButton(buttonNum - len(dpadNames) + direction), true
+}
+
+// button returns the button of a button or D-pad binding on a gamepad with buttonNum buttons,
+// false when the gamepad has no such button.
+func (b GamepadBinding) button(buttonNum int) (ebiten.GamepadButton, bool) {
+	if b.IsDPad {
+		return dpadButton(b.DPad, buttonNum)
+	}
+	return b.Button, int(b.Button) < buttonNum
+}
+
+// isPressed returns whether the binding is pressed on the gamepad.
+func (b GamepadBinding) isPressed(id ebiten.GamepadID) bool {
+	if b.IsAxis {
+		if b.Axis >= ebiten.GamepadAxisNum(id) {
+			return false
+		}
+		return isAxisPressed(ebiten.GamepadAxis(id, b.Axis), b.Direction)
+	}
+	button, ok := b.button(ebiten.GamepadButtonNum(id))
+	return ok && ebiten.IsGamepadButtonPressed(id, button)
+}
+
+// updateGamepads sets the keypad states from every connected gamepad,
+// and notifies when a gamepad is connected or disconnected.
+func (e *Emulator) updateGamepads() {
+	for _, id := range inpututil.JustConnectedGamepadIDs() {
+		e.showMessage(fmt.Sprintf("Gamepad %d connected: %s", id, ebiten.GamepadName(id)))
+	}
+	for _, id := range e.gamepads {
+		if inpututil.IsGamepadJustDisconnected(id) {
+			e.showMessage(fmt.Sprintf("Gamepad %d disconnected", id))
+		}
+	}
+
+	// Gamepads can be connected or disconnected at any time, thus they are polled on every frame
+	e.gamepads = ebiten.GamepadIDs()
+	for _, id := range e.gamepads {
+		for chip8Key, bindings := range e.keymap.Gamepad {
+			for _, binding := range bindings {
+				if binding.isPressed(id) {
+					e.Cpu.KeypadStates[chip8Key] = 1
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package emulator
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+func TestParseGamepadBinding(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected GamepadBinding
+	}{
+		{"Button0", GamepadBinding{Button: ebiten.GamepadButton0}},
+		{"button31", GamepadBinding{Button: ebiten.GamepadButton31}},
+		{"Axis1-", GamepadBinding{IsAxis: true, Axis: 1, Direction: -1}},
+		{"AXIS4+", GamepadBinding{IsAxis: true, Axis: 4, Direction: 1}},
+		{"DPadUp", GamepadBinding{IsDPad: true, DPad: dpadUp}},
+		{"dpadleft", GamepadBinding{IsDPad: true, DPad: dpadLeft}},
+	}
+	for _, test := range tests {
+		binding, err := parseGamepadBinding(test.name)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if binding != test.expected {
+			t.Errorf("%s: parsed %+v, expected %+v", test.name, binding, test.expected)
+		}
+	}
+
+	for _, name := range []string{"", "Button", "Button32", "Button-1", "ButtonA", "Axis1", "Axis+", "Axis-1-", "DPad", "DPadCenter", "Stick0+"} {
+		if binding, err := parseGamepadBinding(name); err == nil {
+			t.Errorf("%q was parsed as %+v, expected an error", name, binding)
+		}
+	}
+}
+
+func TestIsAxisPressed(t *testing.T) {
+	tests := []struct {
+		value     float64
+		direction float64
+		expected  bool
+	}{
+		// Sticks at rest and slightly pushed are in the dead zone
+		{0, 1, false},
+		{0, -1, false},
+		{0.2, 1, false},
+		{-0.3, -1, false},
+		{gamepadAxisThreshold, 1, false},
+		{-gamepadAxisThreshold, -1, false},
+		// Pushed past the dead zone, only in the direction of the binding
+		{0.6, 1, true},
+		{1, 1, true},
+		{-1, -1, true},
+		{1, -1, false},
+		{-0.8, 1, false},
+	}
+	for _, test := range tests {
+		if pressed := isAxisPressed(test.value, test.direction); pressed != test.expected {
+			t.Errorf("axis at %v in direction %v pressed: %v, expected %v", test.value, test.direction, pressed, test.expected)
+		}
+	}
+}
+
+func TestDPadButton(t *testing.T) {
+	// The D-pad is reported as the last 4 buttons
+	for direction, expected := range [4]ebiten.GamepadButton{12, 13, 14, 15} {
+		button, ok := dpadButton(direction, 16)
+		if !ok || button != expected {
+			t.Errorf("direction %d is button %d (%v), expected %d", direction, button, ok, expected)
+		}
+	}
+	if button, ok := dpadButton(dpadLeft, dpadMinButtons); !ok || button != dpadMinButtons-1 {
+		t.Errorf("left is button %d (%v) on a gamepad with %d buttons", button, ok, dpadMinButtons)
+	}
+	// Gamepads without a D-pad reported as buttons
+	for _, buttonNum := range []int{0, 4, dpadMinButtons - 1} {
+		if button, ok := dpadButton(dpadUp, buttonNum); ok {
+			t.Errorf("up is button %d on a gamepad with %d buttons, expected none", button, buttonNum)
+		}
+	}
+}
+
+func TestDefaultGamepadBindings(t *testing.T) {
+	keymap := DefaultKeymap()
+	// The directions are bound to the axes only
+	for chip8Key, axis := range map[int]GamepadBinding{
+		0x2: {IsAxis: true, Axis: 1, Direction: -1},
+		0x4: {IsAxis: true, Axis: 0, Direction: -1},
+		0x6: {IsAxis: true, Axis: 0, Direction: 1},
+		0x8: {IsAxis: true, Axis: 1, Direction: 1},
+	} {
+		if bindings := keymap.Gamepad[chip8Key]; len(bindings) != 1 || bindings[0] != axis {
+			t.Errorf("key 0x%x is bound to %+v", chip8Key, bindings)
+		}
+	}
+
+	// On gamepads with a D-pad reported as axes, the last 4 buttons (Start, Select, stick buttons...) are not bound
+	for buttonNum := dpadMinButtons; buttonNum <= 16; buttonNum++ {
+		for chip8Key, bindings := range keymap.Gamepad {
+			for _, binding := range bindings {
+				if button, ok := binding.button(buttonNum); !binding.IsAxis && ok && int(button) >= buttonNum-len(dpadNames) {
+					t.Errorf("key 0x%x is bound to button %d on a gamepad with %d buttons", chip8Key, button, buttonNum)
+				}
+			}
+		}
+	}
+}
+
+func TestGamepadBindingButton(t *testing.T) {
+	tests := []struct {
+		binding   GamepadBinding
+		buttonNum int
+		expected  ebiten.GamepadButton
+		ok        bool
+	}{
+		{GamepadBinding{Button: ebiten.GamepadButton3}, 12, 3, true},
+		{GamepadBinding{Button: ebiten.GamepadButton3}, 3, 0, false},
+		{GamepadBinding{IsDPad: true, DPad: dpadDown}, 12, 10, true},
+		{GamepadBinding{IsDPad: true, DPad: dpadDown}, 4, 0, false},
+	}
+	for _, test := range tests {
+		button, ok := test.binding.button(test.buttonNum)
+		if ok != test.ok || (ok && button != test.expected) {
+			t.Errorf("%+v on a gamepad with %d buttons is button %d (%v), expected %d (%v)", test.binding, test.buttonNum, button, ok, test.expected, test.ok)
+		}
+	}
+}
+
+func TestLoadKeymapGamepad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keymap.json")
+	data := `{
+		"keys": {"5": ["Space"]},
+		"gamepad": {"5": ["Button2"], "2": ["Axis3-"]},
+		"roms": {
+			"tetris.ch8": {"gamepad": {"4": ["Button7", "DPadUp"], "5": ["Button3"]}},
+			"pong.ch8": {"gamepad": {"1": ["Axis1-"]}}
+		}
+	}`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	keymap, err := LoadKeymap(path, filepath.Join("roms", "tetris.ch8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := DefaultKeymap()
+	expected := defaults.Gamepad
+	// The top level entries, then the entries of the ROM replace the bindings of their keys
+	expected[0x2] = []GamepadBinding{{IsAxis: true, Axis: 3, Direction: -1}}
+	expected[0x4] = []GamepadBinding{{Button: ebiten.GamepadButton7}, {IsDPad: true, DPad: dpadUp}}
+	expected[0x5] = []GamepadBinding{{Button: ebiten.GamepadButton3}}
+	if !reflect.DeepEqual(keymap.Gamepad, expected) {
+		t.Errorf("gamepad bindings %+v, expected %+v", keymap.Gamepad, expected)
+	}
+	// The gamepad entries do not change the keys
+	if len(keymap.Keypad[0x5]) != 1 || keymap.Keypad[0x5][0] != ebiten.KeySpace || !reflect.DeepEqual(keymap.Keypad[0x6], defaults.Keypad[0x6]) {
+		t.Errorf("keypad bindings %v after loading gamepad bindings", keymap.Keypad)
+	}
+
+	// The entries of other ROMs are not applied
+	keymap, err = LoadKeymap(path, "other.ch8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keymap.Gamepad[0x1]) != 0 || !reflect.DeepEqual(keymap.Gamepad[0x4], defaults.Gamepad[0x4]) || keymap.Gamepad[0x5][0].Button != ebiten.GamepadButton2 {
+		t.Errorf("gamepad bindings %+v for a ROM without entries", keymap.Gamepad)
+	}
+
+	// Invalid bindings are reported with the ROM they belong to
+	data = `{"roms": {"tetris.ch8": {"gamepad": {"4": ["Axis9"]}}}}`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeymap(path, "tetris.ch8"); err == nil {
+		t.Error("a keymap with an invalid gamepad binding was loaded")
+	}
+}
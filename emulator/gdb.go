@@ -0,0 +1,111 @@
+package emulator
+
+import (
+	"github.com/raveltan/chip-fa/debugger"
+	"github.com/raveltan/chip-fa/gdbstub"
+)
+
+// gdbTarget exposes the emulator to the GDB stub, the execution is driven by the game loop
+// the same way as the stepping commands of the debugger. Every method is a request applied by the game loop.
+type gdbTarget struct {
+	e *Emulator
+}
+
+func (t gdbTarget) Registers() (registers gdbstub.Registers) {
+	t.e.request(func() {
+		c := t.e.Cpu
+		registers = gdbstub.Registers{
+			Register:       c.Register,
+			IndexRegister:  c.IndexRegister,
+			ProgramCounter: c.ProgramCounter,
+			StackPointer:   c.StackPointer,
+			DelayTimer:     c.DelayTimer,
+			SoundTimer:     c.SoundTimer,
+		}
+	})
+	return
+}
+
+func (t gdbTarget) SetRegisters(registers gdbstub.Registers) {
+	t.e.request(func() {
+		c := t.e.Cpu
+		c.Register = registers.Register
+		c.IndexRegister = registers.IndexRegister
+		c.ProgramCounter = registers.ProgramCounter
+		c.StackPointer = registers.StackPointer
+		c.DelayTimer = registers.DelayTimer
+		c.SoundTimer = registers.SoundTimer
+	})
+}
+
+func (t gdbTarget) ReadMemory(address uint16, length int) (data []uint8) {
+	t.e.request(func() {
+		data = t.e.readMemory(address, length)
+	})
+	return
+}
+
+func (t gdbTarget) WriteMemory(address uint16, data []uint8) (err error) {
+	t.e.request(func() {
+		err = t.e.writeMemory(address, data)
+	})
+	return
+}
+
+func (t gdbTarget) AddBreakpoint(address uint16) (id int) {
+	t.e.request(func() {
+		id = t.e.Cpu.AddBreakpoint(address, nil).ID
+	})
+	return
+}
+
+func (t gdbTarget) DeleteBreakpoint(id int) (deleted bool) {
+	t.e.request(func() {
+		deleted = t.e.Cpu.DeleteBreakpoint(id)
+	})
+	return
+}
+
+func (t gdbTarget) Step() error {
+	if _, started := t.e.runUntilPaused(func(debugger.CPUState) bool {
+		return true
+	}); !started {
+		return gdbstub.ErrNotPaused
+	}
+	return t.cpuError()
+}
+
+func (t gdbTarget) Continue(interrupt <-chan struct{}) error {
+	// Stopped by breakpoints, errors or the interruption, which is checked after every instruction
+	// as it may happen before the execution is resumed
+	if _, started := t.e.runUntilPaused(func(debugger.CPUState) bool {
+		select {
+		case <-interrupt:
+			return true
+		default:
+			return false
+		}
+	}); !started {
+		return gdbstub.ErrNotPaused
+	}
+	return t.cpuError()
+}
+
+func (t gdbTarget) cpuError() (err error) {
+	t.e.request(func() {
+		err = t.e.cpuError
+	})
+	return
+}
+
+func (t gdbTarget) Pause() {
+	t.e.request(func() {
+		t.e.Pause = true
+	})
+}
+
+func (t gdbTarget) Resume() {
+	t.e.request(func() {
+		t.e.resume()
+	})
+}
@@ -0,0 +1,202 @@
+package emulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+)
+
+// Keymap binds the physical keys and gamepads to the CHIP-8 keypad and to the emulator hotkeys,
+// each of them can be bound to multiple physical keys.
+type Keymap struct {
+	// Physical keys of each CHIP-8 key (0x0 - 0xF)
+	Keypad [16][]ebiten.Key
+	// Gamepad bindings of each CHIP-8 key (0x0 - 0xF), shared by every connected gamepad
+	Gamepad [16][]GamepadBinding
+	// Opens the debugger shell (only when debugging is enabled)
+	Debugger []ebiten.Key
+	// Pauses and resumes the emulation
+	Pause []ebiten.Key
+	// Plays the game backwards while held (only when rewinding is enabled)
+	Rewind []ebiten.Key
+	// Shows and hides the debugger overlay (only when debugging is enabled)
+	Overlay []ebiten.Key
+	// Stepping commands of the debugger overlay, only used while it is shown
+	Continue []ebiten.Key
+	Step     []ebiten.Key
+	Next     []ebiten.Key
+	Finish   []ebiten.Key
+}
+
+// keymapFile is the JSON layout of a keymap file
+// -----------
+// "keys": {"0": ["X"], "1": ["1", "KP1"], ...}
+// "gamepad": {"2": ["Axis1-"], "5": ["Button0"], ...}
+// "hotkeys": {"debugger": ["0"], "pause": ["P"], "rewind": ["Backspace"], "overlay": ["F9"], "continue": ["F5"], ...}
+// "roms": {"tetris.ch8": {"keys": {...}, "gamepad": {...}, "hotkeys": {...}}}
+// -----------
+// Keys are named after ebiten.Key (case insensitive) and gamepad bindings are named as described
+// by GamepadBinding, every entry replaces the default bindings of that CHIP-8 key or hotkey.
+// The entries of "roms" are only applied when running a ROM with the same file name,
+// on top of the top level entries.
+type keymapFile struct {
+	Keys    map[string][]string   `json:"keys"`
+	Gamepad map[string][]string   `json:"gamepad"`
+	Hotkeys map[string][]string   `json:"hotkeys"`
+	Roms    map[string]keymapFile `json:"roms"`
+}
+
+// DefaultKeymap returns the default bindings, the 4x4 block of keys from 1 to V
+// bound to the CHIP-8 keypad in order (1 is 0x0, 2 is 0x1, ..., V is 0xF).
+func DefaultKeymap() *Keymap {
+	keymap := &Keymap{
+		Keypad: [16][]ebiten.Key{
+			{ebiten.Key1}, {ebiten.Key2}, {ebiten.Key3}, {ebiten.Key4},
+			{ebiten.KeyQ}, {ebiten.KeyW}, {ebiten.KeyE}, {ebiten.KeyR},
+			{ebiten.KeyA}, {ebiten.KeyS}, {ebiten.KeyD}, {ebiten.KeyF},
+			{ebiten.KeyZ}, {ebiten.KeyX}, {ebiten.KeyC}, {ebiten.KeyV},
+		},
+		Debugger: []ebiten.Key{ebiten.Key0, ebiten.KeyKP0},
+		Pause:    []ebiten.Key{ebiten.KeyP},
+		Rewind:   []ebiten.Key{ebiten.KeyBackspace},
+		Overlay:  []ebiten.Key{ebiten.KeyF9},
+		Continue: []ebiten.Key{ebiten.KeyF5},
+		Step:     []ebiten.Key{ebiten.KeyF6},
+		Next:     []ebiten.Key{ebiten.KeyF7},
+		Finish:   []ebiten.Key{ebiten.KeyF8},
+	}
+	for chip8Key, bindings := range defaultGamepadBindings {
+		keymap.Gamepad[chip8Key] = bindings
+	}
+	return keymap
+}
+
+// LoadKeymap loads a keymap file on top of the default bindings,
+// applying the ROM specific bindings of rom if there is any.
+func LoadKeymap(path string, rom string) (*Keymap, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := keymapFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid keymap %s, %w", path, err)
+	}
+
+	keymap := DefaultKeymap()
+	if err := keymap.apply(file); err != nil {
+		return nil, fmt.Errorf("invalid keymap %s, %w", path, err)
+	}
+	if romFile, ok := file.Roms[filepath.Base(rom)]; ok {
+		if err := keymap.apply(romFile); err != nil {
+			return nil, fmt.Errorf("invalid keymap %s for %s, %w", path, filepath.Base(rom), err)
+		}
+	}
+	return keymap, nil
+}
+
+func (k *Keymap) apply(file keymapFile) error {
+	for name, keyNames := range file.Keys {
+		chip8Key, err := parseChip8Key(name)
+		if err != nil {
+			return err
+		}
+		keys, err := parseKeys(keyNames)
+		if err != nil {
+			return err
+		}
+		k.Keypad[chip8Key] = keys
+	}
+	for name, bindingNames := range file.Gamepad {
+		chip8Key, err := parseChip8Key(name)
+		if err != nil {
+			return err
+		}
+		bindings, err := parseGamepadBindings(bindingNames)
+		if err != nil {
+			return err
+		}
+		k.Gamepad[chip8Key] = bindings
+	}
+	for name, keyNames := range file.Hotkeys {
+		keys, err := parseKeys(keyNames)
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(name) {
+		case "debugger":
+			k.Debugger = keys
+		case "pause":
+			k.Pause = keys
+		case "rewind":
+			k.Rewind = keys
+		case "overlay":
+			k.Overlay = keys
+		case "continue":
+			k.Continue = keys
+		case "step":
+			k.Step = keys
+		case "next":
+			k.Next = keys
+		case "finish":
+			k.Finish = keys
+		default:
+			return fmt.Errorf("unknown hotkey %q, must be debugger, pause, rewind, overlay, continue, step, next or finish", name)
+		}
+	}
+	return nil
+}
+
+func parseChip8Key(name string) (uint64, error) {
+	chip8Key, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(name), "0x"), 16, 8)
+	if err != nil || chip8Key > 0xF {
+		return 0, fmt.Errorf("unknown CHIP-8 key %q, must be between 0 and F", name)
+	}
+	return chip8Key, nil
+}
+
+func parseKeys(names []string) (keys []ebiten.Key, err error) {
+	for _, name := range names {
+		key, ok := parseKey(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", name)
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+func parseKey(name string) (ebiten.Key, bool) {
+	for k := ebiten.Key(0); k <= ebiten.KeyMax; k++ {
+		if strings.EqualFold(k.String(), name) {
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+// isPressed returns whether any of the keys is pressed.
+func isPressed(keys []ebiten.Key) bool {
+	for _, k := range keys {
+		if ebiten.IsKeyPressed(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// isJustPressed returns whether any of the keys is pressed on this frame.
+func isJustPressed(keys []ebiten.Key) bool {
+	for _, k := range keys {
+		if inpututil.IsKeyJustPressed(k) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,8 +1,10 @@
 package emulator
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 
 	"image/color"
@@ -10,196 +12,663 @@ import (
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/audio"
+	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
 	"github.com/raveltan/chip-fa/cpu"
 	"github.com/raveltan/chip-fa/debugger"
+	"github.com/raveltan/chip-fa/disasm"
+	"github.com/raveltan/chip-fa/gdbstub"
+	"github.com/raveltan/chip-fa/symbols"
+	"github.com/raveltan/chip-fa/trace"
 	"github.com/raveltan/chip-fa/wavegen"
 )
 
+// Options of an emulation started by StartEmulation
+type Options struct {
+	// Path to the ROM file
+	Rom            string
+	DPIScale       float64
+	DisplayScale   float64
+	CyclePerSecond int
+	Debug          bool
+	Quirks         cpu.Quirks
+	// Path to a save state that is loaded after the ROM, empty to start the ROM from the beginning
+	LoadState string
+	// Seconds of history kept for rewinding, 0 disables rewinding
+	RewindSeconds int
+	// Amount of frames between the rewind captures
+	RewindInterval int
+	// Path to a keymap file (see LoadKeymap), empty to use the default keymap
+	Keymap string
+	// Path to a symbol file (see symbols.Load) used by the debugger, empty when there is none
+	Symbols string
+	// Path of the trace of the executed instructions (see the trace package), empty to start without tracing
+	Trace       string
+	TraceFormat trace.Format
+	// Path to a file of debugger commands (see debugger.RunScript) run before the ROM starts, enables debugging
+	DebugScript string
+	// Address (ex: :1234) where a GDB stub is listening, empty to disable it. See the gdbstub package
+	GDB string
+	// Called with a debugger of the emulation before it starts, used to control it from another interface (ex: dap).
+	// The ROM does not start until the debugger resumes it
+	AttachDebugger func(*debugger.Debugger)
+}
+
 type Emulator struct {
 	Cpu             *cpu.CPU
 	beepAudioPlayer *audio.Player
-	beepAudioTimer  int
+	beepStream      *wavegen.Stream
 	scaleFactor     float64
-	debug           *debugger.Debugger
-	Pause           bool
+	cyclePerSecond  int
+	// Cycles that are carried to the next frame, multiplied by 60
+	cycleCredit int
+	debug       *debugger.Debugger
+	// Set when a debugger controls the emulation (shell, GDB or debug adapter), breakpoints are ignored otherwise
+	debugged bool
+	// Only used by the game loop, the other goroutines change it through requests (see controller.go)
+	Pause bool
+	// Requests applied by the game loop between the cycles, closed stopped once the game loop is done
+	requests chan func()
+	stopped  chan struct{}
+	// Last error returned by the CPU, emulation is paused until it is resumed from the debugger
+	cpuError error
+	// Offscreen image of the CPU screen, recreated when the screen resolution changes
+	frame       *ebiten.Image
+	framePixels []byte
+	romPath     string
+	keymap      *Keymap
+	// Labels of the ROM, nil when there is no symbol file
+	symbols *symbols.Table
+	// Gamepads that were connected on the last update
+	gamepads []ebiten.GamepadID
+	// nil when rewinding is disabled
+	rewind *rewindBuffer
+	// Set by the debugger's stepping commands, the emulation is paused as soon as it returns true
+	runUntil func(debugger.CPUState) bool
+	// Receives the state before the last executed instruction when the stepping command stops,
+	// nil when nothing waits for it (stepping from the overlay)
+	runUntilDone    chan debugger.CPUState
+	runUntilLast    debugger.CPUState
+	runUntilStarted bool
+	// Trace of the executed instructions, nil when no trace file has been opened
+	traceFile   *os.File
+	traceWriter *trace.Writer
+	// Set while the debugger overlay is shown (see overlay.go)
+	overlay bool
+	// Views of the overlay, created when it is first drawn
+	overlayView *debugger.Debugger
+	// Notification shown on the window, until the timer reaches 0
+	message      string
+	messageTimer int
+}
+
+// Amount of updates a notification is shown on the window
+const messageDuration = 120
+
+// Colors of the pixels by the planes that are set (XO-CHIP)
+// Index 0 is the background, 1 is plane 1, 2 is plane 2 and 3 is when both planes are set.
+var palette = [4]color.Color{
+	color.Black,
+	color.White,
+	color.RGBA{0xAA, 0xAA, 0xAA, 0xFF},
+	color.RGBA{0x55, 0x55, 0x55, 0xFF},
 }
 
+// Returned from Update to stop the game loop when the ROM exits the interpreter
+var errProgramExited = errors.New("program exited")
+
 func (e *Emulator) Update() error {
+	e.applyRequests()
 	// Reset keypad state
 	for i := range e.Cpu.KeypadStates {
 		e.Cpu.KeypadStates[i] = 0
 	}
 	// Set keypad states
-	for k := ebiten.Key(0); k <= ebiten.KeyMax; k++ {
-		if ebiten.IsKeyPressed(k) {
-			switch k.String() {
-			case "1":
-				e.Cpu.KeypadStates[0] = 1
-			case "2":
-				e.Cpu.KeypadStates[1] = 1
-			case "3":
-				e.Cpu.KeypadStates[2] = 1
-			case "4":
-				e.Cpu.KeypadStates[3] = 1
-			case "Q":
-				e.Cpu.KeypadStates[4] = 1
-			case "W":
-				e.Cpu.KeypadStates[5] = 1
-			case "E":
-				e.Cpu.KeypadStates[6] = 1
-			case "R":
-				e.Cpu.KeypadStates[7] = 1
-			case "A":
-				e.Cpu.KeypadStates[8] = 1
-			case "S":
-				e.Cpu.KeypadStates[9] = 1
-			case "D":
-				e.Cpu.KeypadStates[10] = 1
-			case "F":
-				e.Cpu.KeypadStates[11] = 1
-			case "Z":
-				e.Cpu.KeypadStates[12] = 1
-			case "X":
-				e.Cpu.KeypadStates[13] = 1
-			case "C":
-				e.Cpu.KeypadStates[14] = 1
-			case "V":
-				e.Cpu.KeypadStates[15] = 1
-			case "0", "KP0":
-				if e.debug != nil {
-					e.Pause = true
-					go e.debug.StartDebugShell()
-				}
-			}
+	for chip8Key, keys := range e.keymap.Keypad {
+		if isPressed(keys) {
+			e.Cpu.KeypadStates[chip8Key] = 1
 		}
 	}
+	e.updateGamepads()
+	if e.debug != nil && isJustPressed(e.keymap.Debugger) {
+		e.handOff(nil)
+	}
+	if e.debug != nil && isJustPressed(e.keymap.Overlay) {
+		e.overlay = !e.overlay
+	}
+	if e.overlay {
+		e.updateOverlay()
+	}
+	if isJustPressed(e.keymap.Pause) {
+		e.Pause = !e.Pause
+		if e.Pause {
+			e.showMessage("Paused")
+		} else {
+			e.showMessage("Resumed")
+		}
+	}
+	e.handleStateHotkeys()
+	if e.messageTimer > 0 {
+		e.messageTimer--
+	}
+	if !e.Pause && e.rewind != nil && isPressed(e.keymap.Rewind) {
+		// Play the game backwards while the rewind key is held
+		if !e.rewind.rewind(e.Cpu) && e.messageTimer == 0 {
+			e.showMessage("Reached the end of the rewind history")
+		}
+		return nil
+	}
 	if !e.Pause {
 		if e.beepAudioPlayer == nil {
 			// Pass the (infinite) stream to audio.NewPlayer.
 			// After calling Play, the stream never ends as long as the player object lives.
 			var err error
-			e.beepAudioPlayer, err = audio.NewPlayer(audio.NewContext(44100), &wavegen.Stream{})
+			e.beepStream = &wavegen.Stream{}
+			e.beepAudioPlayer, err = audio.NewPlayer(audio.NewContext(wavegen.SampleRate), e.beepStream)
 			if err != nil {
 				return err
 			}
 		}
+		if e.Cpu.AudioPatternLoaded {
+			e.beepStream.SetPattern(e.Cpu.AudioPattern, e.Cpu.Pitch)
+		}
+	}
+	if err := e.emulateFrame(); err != nil {
+		return err
+	}
 
-		// FIXME: find a way to do conditional rerendering
-		// Update sound timer
-		if e.Cpu.SoundTimer > 0 || e.beepAudioTimer > 0 {
-			if e.Cpu.SoundTimer > 0 {
-				if e.Cpu.SoundTimer == 1 {
-					// Beep the buzzer
-					e.beepAudioPlayer.Play()
-					e.beepAudioTimer = 25
-				}
-				e.Cpu.SoundTimer--
+	// Buzz while the sound timer is active
+	if e.beepAudioPlayer != nil {
+		if e.Cpu.SoundTimer > 0 && !e.Pause {
+			if !e.beepAudioPlayer.IsPlaying() {
+				e.beepAudioPlayer.Play()
 			}
-			if e.beepAudioTimer > 0 {
-				if e.beepAudioTimer == 1 {
-					// Stop wave generator
-					e.beepAudioPlayer.Pause()
-				}
-				e.beepAudioTimer--
+		} else if e.beepAudioPlayer.IsPlaying() {
+			e.beepAudioPlayer.Pause()
+		}
+	}
+	return nil
+}
+
+// emulateFrame runs the CPU for a frame, called by the game loop once the requests and the input are handled.
+// The window and the audio are left to Update, thus the emulation can be driven without them (see the tests).
+func (e *Emulator) emulateFrame() error {
+	if e.runUntil != nil {
+		if !e.runUntilStarted {
+			// The stepping command is started from the game loop, thus it never sees a half set up command
+			e.runUntilStarted = true
+			e.Pause = false
+		} else if e.Pause {
+			e.finishRunUntil()
+		}
+	}
+	if e.Pause {
+		return nil
+	}
+
+	// Update is called 60 times per second, thus the CPU executes cyclePerSecond / 60 cycles on each frame.
+	// The remainder is carried to the next frame to keep the average speed exact.
+	e.cycleCredit += e.cyclePerSecond
+	for e.cycleCredit >= 60 && !e.Pause {
+		e.cycleCredit -= 60
+		var last debugger.CPUState
+		if e.runUntil != nil {
+			last = e.cpuState()
+		}
+		err := e.Cpu.DoCycle()
+		// Breakpoints stop the execution before the instruction, which is not reported by the stepping commands.
+		// Instructions that fail are reported, as they are the reason of the stop.
+		if e.runUntil != nil && (last.Cycles != e.Cpu.Cycles || err != nil) {
+			e.runUntilLast = last
+		}
+		if err != nil {
+			if errors.Is(err, cpu.ErrProgramExited) {
+				return errProgramExited
 			}
+			e.haltWithError(err)
+		}
+		if e.runUntil != nil && !e.Pause && e.runUntil(e.cpuState()) {
+			e.Pause = true
+		}
+	}
+	// Most sessions have no frame hooks, they are not given a goroutine on every frame
+	if e.debug != nil && !e.Pause && e.runUntil == nil && e.debug.HasFrameHooks() {
+		hooksPassed := true
+		e.callDebugger(func() {
+			hooksPassed = e.debug.RunFrameHooks()
+		})
+		if !hooksPassed {
+			e.handOff(nil)
+		}
+	}
+	if e.Pause {
+		// Stopped by the debugger or an error in the middle of the frame
+		e.cycleCredit = 0
+		if e.runUntil != nil {
+			e.finishRunUntil()
 		}
-		e.Cpu.DoCycle()
 	}
+
+	// Timers are decremented once per frame regardless of the CPU speed
+	e.Cpu.UpdateTimers()
+	if e.rewind != nil {
+		e.rewind.update(e.Cpu)
+	}
+	return nil
+}
+
+// describeAddress returns an address with its closest label (ex: 0x2a4 <draw+0x4>).
+func (e *Emulator) describeAddress(address uint16) string {
+	if label := e.symbols.Describe(address); label != "" {
+		return fmt.Sprintf("0x%x <%s>", address, label)
+	}
+	return fmt.Sprintf("0x%x", address)
+}
+
+// cpuState returns a snapshot of the CPU for the debugger.
+func (e *Emulator) cpuState() debugger.CPUState {
+	c := e.Cpu
+	state := debugger.CPUState{
+		Register:       c.Register,
+		IndexRegister:  c.IndexRegister,
+		ProgramCounter: c.ProgramCounter,
+		Stack:          c.Stack,
+		StackPointer:   c.StackPointer,
+		DelayTimer:     c.DelayTimer,
+		SoundTimer:     c.SoundTimer,
+		Cycles:         c.Cycles,
+	}
+	if int(c.ProgramCounter)+1 < c.MemorySize() {
+		state.OperationCode = uint16(c.Memory[c.ProgramCounter])<<8 | uint16(c.Memory[c.ProgramCounter+1])
+	}
+	if int(c.ProgramCounter)+3 < c.MemorySize() {
+		state.NextWord = uint16(c.Memory[c.ProgramCounter+2])<<8 | uint16(c.Memory[c.ProgramCounter+3])
+	}
+	return state
+}
+
+// runUntilPaused resumes the emulation until stop returns true after an instruction is executed,
+// or until the emulation is paused by something else. See debugger.Debugger.RunUntilCallback.
+// It must not be called by the game loop, which runs the instructions.
+func (e *Emulator) runUntilPaused(stop func(debugger.CPUState) bool) (debugger.CPUState, bool) {
+	done := make(chan debugger.CPUState, 1)
+	started := false
+	e.request(func() {
+		started = e.startRunUntil(stop, done)
+	})
+	if !started {
+		return debugger.CPUState{}, false
+	}
+	return <-done, true
+}
+
+// startRunUntil resumes the emulation until stop returns true without waiting for it,
+// done receives the state before the last executed instruction (nil when it is not needed).
+// Returns false when the emulation is not paused.
+func (e *Emulator) startRunUntil(stop func(debugger.CPUState) bool, done chan debugger.CPUState) bool {
+	if !e.Pause || e.runUntil != nil {
+		return false
+	}
+	if e.cpuError != nil {
+		e.cpuError = nil
+		ebiten.SetWindowTitle("Chip-Fa")
+	}
+	e.runUntilLast = e.cpuState()
+	e.runUntilDone = done
+	e.runUntil = stop
+	return true
+}
+
+// readMemory returns length bytes of memory starting at address, clamped to the end of the memory
+// of the quirks preset (empty when address is past it).
+func (e *Emulator) readMemory(address uint16, length int) []uint8 {
+	end := int(address) + length
+	if end > e.Cpu.MemorySize() {
+		end = e.Cpu.MemorySize()
+	}
+	if int(address) >= end {
+		return []uint8{}
+	}
+	return append([]uint8{}, e.Cpu.Memory[address:end]...)
+}
+
+// writeMemory writes data to the memory starting at address, failing when it does not fit in the memory.
+func (e *Emulator) writeMemory(address uint16, data []uint8) error {
+	if int(address)+len(data) > e.Cpu.MemorySize() {
+		return fmt.Errorf("%w: 0x%x (+%d)", cpu.ErrMemoryOutOfBounds, address, len(data))
+	}
+	// Written directly, the debugger writes do not trigger the watchpoints
+	copy(e.Cpu.Memory[address:], data)
 	return nil
 }
 
+// finishRunUntil ends the stepping command of the debugger once the emulation is paused.
+func (e *Emulator) finishRunUntil() {
+	e.runUntil = nil
+	e.runUntilStarted = false
+	if e.runUntilDone != nil {
+		// Buffered, the game loop never waits for the stepping command
+		e.runUntilDone <- e.runUntilLast
+		e.runUntilDone = nil
+	}
+}
+
 func (e *Emulator) Draw(s *ebiten.Image) {
-	for i, v := range e.Cpu.Screen {
-		drawColor := color.White
-		if v == 0 {
-			drawColor = color.Black
-		}
-		s.Set(i%64, i/64, drawColor)
+	width, height := e.Cpu.ScreenWidth(), e.Cpu.ScreenHeight()
+	if e.frame == nil {
+		e.frame = ebiten.NewImage(width, height)
+		e.framePixels = make([]byte, width*height*4)
+	} else if frameWidth, frameHeight := e.frame.Size(); frameWidth != width || frameHeight != height {
+		// Screen resolution has been changed
+		e.frame.Dispose()
+		e.frame = ebiten.NewImage(width, height)
+		e.framePixels = make([]byte, width*height*4)
+	}
+
+	for i, v := range e.Cpu.Screen[:width*height] {
+		r, g, b, a := palette[v&0x3].RGBA()
+		e.framePixels[4*i] = uint8(r >> 8)
+		e.framePixels[4*i+1] = uint8(g >> 8)
+		e.framePixels[4*i+2] = uint8(b >> 8)
+		e.framePixels[4*i+3] = uint8(a >> 8)
+	}
+	e.frame.ReplacePixels(e.framePixels)
+
+	// Stretch the CPU screen to the whole window
+	screenWidth, screenHeight := s.Size()
+	op := &ebiten.DrawImageOptions{}
+	op.GeoM.Scale(float64(screenWidth)/float64(width), float64(screenHeight)/float64(height))
+	s.DrawImage(e.frame, op)
+
+	if e.overlay {
+		e.drawOverlay(s)
+	} else if e.cpuError != nil {
+		ebitenutil.DebugPrint(s, "Halted: "+e.cpuError.Error())
+	} else if e.messageTimer > 0 {
+		ebitenutil.DebugPrint(s, e.message)
 	}
 }
 
 func (e *Emulator) Layout(outsideWidth, outsideHeight int) (screenWidth, screenHeight int) {
-	return (outsideWidth) / (12 * int(e.scaleFactor)), (outsideHeight) / int((12 * e.scaleFactor))
+	return int(float64(outsideWidth) * e.scaleFactor), int(float64(outsideHeight) * e.scaleFactor)
 }
 
 func createDebugger(e *Emulator) *debugger.Debugger {
-	return &debugger.Debugger{ResumeEmulationCallback: func() bool {
-		if !e.Pause {
-			return false
-		}
-		e.Pause = false
-		return true
-	}, PauseEmulationCallback: func() bool {
-		if e.Pause {
-			return false
-		}
-		e.Pause = true
-		return true
+	// Every callback is a request applied by the game loop between the cycles, see controller.go
+	d := &debugger.Debugger{ResumeEmulationCallback: func() (resumed bool) {
+		e.request(func() {
+			resumed = e.resume()
+		})
+		return
+	}, PauseEmulationCallback: func() (paused bool) {
+		e.request(func() {
+			if !e.Pause {
+				e.Pause = true
+				paused = true
+			}
+		})
+		return
 	}, ExitCallback: func() {
+		e.request(func() {
+			if err := e.closeTrace(); err != nil {
+				log.Printf("Unable to write trace, %v", err)
+			}
+		})
 		os.Exit(0)
-	}, GetRegisterCallback: func() [16]uint8 {
-		return e.Cpu.Register
-	}, GetTimerCallback: func() [2]uint8 {
-		return [2]uint8{e.Cpu.DelayTimer, e.Cpu.SoundTimer}
+	}, GetRegisterCallback: func() (registers [16]uint8) {
+		e.request(func() {
+			registers = e.Cpu.Register
+		})
+		return
+	}, GetTimerCallback: func() (timers [2]uint8) {
+		e.request(func() {
+			timers = [2]uint8{e.Cpu.DelayTimer, e.Cpu.SoundTimer}
+		})
+		return
 	}, SetRegisterCallback: func(u1, u2 uint8) {
-		e.Cpu.Register[u1] = u2
+		e.request(func() {
+			e.Cpu.Register[u1] = u2
+		})
 	}, SetTimerCallback: func(isDelayTimer bool, u uint8) {
-		if isDelayTimer {
-			e.Cpu.DelayTimer = u
-		} else {
-			e.Cpu.SoundTimer = u
-		}
+		e.request(func() {
+			if isDelayTimer {
+				e.Cpu.DelayTimer = u
+			} else {
+				e.Cpu.SoundTimer = u
+			}
+		})
 	}, GetSpecialCallback: func() (r string) {
-		r += "I: " + fmt.Sprintf("0x%x", e.Cpu.IndexRegister) + "\n"
-		r += "PC: " + fmt.Sprintf("0x%x", e.Cpu.ProgramCounter) + "\n"
-		r += "Current Instruction Location: " + fmt.Sprintf("0x%x", e.Cpu.ProgramCounter-0x200) + "\n"
-		r += "Stack: ["
-		for i, v := range e.Cpu.Stack {
-			if i == int(e.Cpu.StackPointer) {
-				r += "<" + fmt.Sprintf("0x%x", v) + "> ,"
-				continue
+		e.request(func() {
+			r += "I: " + fmt.Sprintf("0x%x", e.Cpu.IndexRegister) + "\n"
+			r += "PC: " + e.describeAddress(e.Cpu.ProgramCounter) + "\n"
+			r += "Current Instruction Location: " + fmt.Sprintf("0x%x", e.Cpu.ProgramCounter-0x200) + "\n"
+			r += "Current Instruction: " + disasm.DecodeAt(e.Cpu.Memory[:e.Cpu.MemorySize()], int(e.Cpu.ProgramCounter)).Format(disasm.Cowgod, e.symbols.Labels()) + "\n"
+			r += "Stack: ["
+			for i, v := range e.Cpu.Stack {
+				if i == int(e.Cpu.StackPointer) {
+					r += "<" + fmt.Sprintf("0x%x", v) + "> ,"
+					continue
+				}
+				if i < int(e.Cpu.StackPointer) {
+					// Only the entries below the stack pointer are calls that have not returned yet
+					r += e.describeAddress(v) + " ,"
+					continue
+				}
+				r += fmt.Sprintf("%x", v) + " ,"
 			}
-			r += fmt.Sprintf("%x", v) + " ,"
-		}
-		r += "]"
+			r += "]"
+			if e.cpuError != nil {
+				r += "\nHalted: " + e.cpuError.Error()
+			}
+		})
 		return
 	}, SetICallback: func(u uint16) {
-		e.Cpu.IndexRegister = u
+		e.request(func() {
+			e.Cpu.IndexRegister = u
+		})
 	}, SetPcCallback: func(u uint16) {
-		e.Cpu.ProgramCounter = u
-	}, GetMemoryViewCallback: func() (m []uint8) {
-		for i := e.Cpu.ProgramCounter - 120; i <= e.Cpu.ProgramCounter+121 && i <= 4096; i++ {
-			m = append(m, e.Cpu.Memory[i])
+		e.request(func() {
+			e.Cpu.ProgramCounter = u
+		})
+	}, AddBreakpointCallback: func(address uint16, conditionText string) (id int, err error) {
+		var condition *cpu.Condition
+		if conditionText != "" {
+			condition, err = cpu.ParseCondition(conditionText)
+			if err != nil {
+				return 0, err
+			}
+		}
+		e.request(func() {
+			id = e.Cpu.AddBreakpoint(address, condition).ID
+		})
+		return
+	}, DeleteBreakpointCallback: func(id int) (deleted bool) {
+		e.request(func() {
+			deleted = e.Cpu.DeleteBreakpoint(id)
+		})
+		return
+	}, GetBreakpointsCallback: func() (breakpoints []debugger.Breakpoint) {
+		e.request(func() {
+			for _, breakpoint := range e.Cpu.Breakpoints() {
+				condition := ""
+				if breakpoint.Condition != nil {
+					condition = breakpoint.Condition.String()
+				}
+				breakpoints = append(breakpoints, debugger.Breakpoint{
+					ID: breakpoint.ID, Address: breakpoint.Address, Condition: condition, HitCount: breakpoint.HitCount,
+				})
+			}
+		})
+		return
+	}, GetStateCallback: func() (state debugger.CPUState) {
+		e.request(func() {
+			state = e.cpuState()
+		})
+		return
+	}, RunUntilCallback: func(stop func(debugger.CPUState) bool) (debugger.CPUState, bool) {
+		return e.runUntilPaused(stop)
+	}, AddWatchpointCallback: func(address uint16, kindText string) (id int, err error) {
+		kinds := map[string]cpu.WatchKind{"read": cpu.WatchRead, "write": cpu.WatchWrite, "rw": cpu.WatchReadWrite}
+		kind, ok := kinds[kindText]
+		if !ok {
+			return 0, fmt.Errorf("unknown watchpoint kind %q, must be read, write or rw", kindText)
+		}
+		e.request(func() {
+			id = e.Cpu.AddWatchpoint(address, kind).ID
+		})
+		return
+	}, DeleteWatchpointCallback: func(id int) (deleted bool) {
+		e.request(func() {
+			deleted = e.Cpu.DeleteWatchpoint(id)
+		})
+		return
+	}, GetWatchpointsCallback: func() (watchpoints []debugger.Watchpoint) {
+		e.request(func() {
+			for _, watchpoint := range e.Cpu.Watchpoints() {
+				watchpoints = append(watchpoints, debugger.Watchpoint{
+					ID: watchpoint.ID, Address: watchpoint.Address, Kind: watchpoint.Kind.String(), HitCount: watchpoint.HitCount,
+				})
+			}
+		})
+		return
+	}, ReadMemoryCallback: func(address uint16, length int) (data []uint8) {
+		e.request(func() {
+			data = e.readMemory(address, length)
+		})
+		return
+	}, WriteMemoryCallback: func(address uint16, data []uint8) (err error) {
+		e.request(func() {
+			err = e.writeMemory(address, data)
+		})
+		return
+	}, GetErrorCallback: func() (err error) {
+		e.request(func() {
+			err = e.cpuError
+		})
+		return
+	}, EvaluateConditionCallback: func(text string) (result bool, err error) {
+		condition, err := cpu.ParseCondition(text)
+		if err != nil {
+			return false, err
+		}
+		e.request(func() {
+			result = condition.Evaluate(e.Cpu)
+		})
+		return
+	}, SetTraceCallback: func(enabled bool, path string, formatName string) (err error) {
+		if !enabled {
+			e.request(func() {
+				err = e.stopTrace()
+			})
+			return
+		}
+		format, err := trace.ParseFormat(formatName)
+		if err != nil {
+			return err
 		}
+		e.request(func() {
+			err = e.startTrace(path, format)
+		})
 		return
 	}}
+	d.GetMemoryViewCallback = func() []uint8 {
+		programCounter := int(d.GetStateCallback().ProgramCounter)
+		start := programCounter - 120
+		if start < 0 {
+			start = 0
+		}
+		return d.ReadMemoryCallback(uint16(start), programCounter+122-start)
+	}
+	return d
 }
 
-func StartEmulation(rom string, DPIscale float64, displayScale float64, cyclePerSecond int, debug bool) {
+func StartEmulation(options Options) {
 	// Initialize CPU
-	cpu := new(cpu.CPU)
+	cpu := &cpu.CPU{Quirks: options.Quirks}
 	cpu.Boot()
-	if err := cpu.LoadROM(rom); err != nil {
+	if err := cpu.LoadROM(options.Rom); err != nil {
 		log.Fatal(fmt.Sprintf("error: Unable to open ROM, %v", err))
 	}
-	ebiten.SetWindowSize(64*12*int(displayScale), 32*12*int(displayScale))
+	ebiten.SetWindowSize(64*12*int(options.DisplayScale), 32*12*int(options.DisplayScale))
 	ebiten.SetWindowTitle("Chip-Fa")
-	ebiten.SetMaxTPS(cyclePerSecond)
+	// The emulator always runs at 60Hz (the rate of the timers),
+	// executing multiple cycles on each frame
+	ebiten.SetMaxTPS(60)
 
 	// Setup emulator and debugger
-	emulator := &Emulator{Cpu: cpu, scaleFactor: DPIscale}
+	emulator := &Emulator{Cpu: cpu, scaleFactor: options.DPIScale, cyclePerSecond: options.CyclePerSecond, romPath: options.Rom,
+		requests: make(chan func()), stopped: make(chan struct{})}
+	emulator.keymap = DefaultKeymap()
+	if options.Keymap != "" {
+		keymap, err := LoadKeymap(options.Keymap, options.Rom)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("error: Unable to load keymap, %v", err))
+		}
+		emulator.keymap = keymap
+	}
+	if options.RewindSeconds > 0 {
+		emulator.rewind = newRewindBuffer(options.RewindSeconds, options.RewindInterval)
+	}
+	if options.LoadState != "" {
+		if err := emulator.loadStateFile(options.LoadState); err != nil {
+			log.Fatal(fmt.Sprintf("error: Unable to load state, %v", err))
+		}
+	}
+	if options.Symbols != "" {
+		table, err := symbols.Load(options.Symbols)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("error: Unable to load symbols, %v", err))
+		}
+		emulator.symbols = table
+	}
+	if options.Trace != "" {
+		if err := emulator.startTrace(options.Trace, options.TraceFormat); err != nil {
+			log.Fatal(fmt.Sprintf("error: Unable to create trace, %v", err))
+		}
+	}
+	debug := options.Debug || options.DebugScript != ""
 	if debug {
 		emulator.debug = createDebugger(emulator)
+		emulator.debug.Symbols = emulator.symbols
 	}
-	cpu.StopForDebuggingCallback = func() {
-		if debug {
-			emulator.Pause = true
-			go emulator.debug.StartDebugShell()
+	if options.DebugScript != "" {
+		// The ROM starts once the script is done
+		emulator.handOff(func() bool {
+			if err := emulator.debug.RunScript(options.DebugScript); err != nil {
+				log.Printf("error: Debug script stopped, %v", err)
+				return false
+			}
+			return true
+		})
+	}
+	if options.GDB != "" {
+		listener, err := net.Listen("tcp", options.GDB)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("error: Unable to start the GDB stub, %v", err))
 		}
+		// The ROM does not start until GDB connects and continues the execution
+		emulator.Pause = true
+		log.Printf("Waiting for GDB on %s", listener.Addr())
+		go func() {
+			log.Printf("error: GDB stub stopped, %v", gdbstub.Serve(listener, gdbTarget{e: emulator}))
+		}()
+	}
+	if options.AttachDebugger != nil {
+		emulator.Pause = true
+		attached := createDebugger(emulator)
+		attached.Symbols = emulator.symbols
+		options.AttachDebugger(attached)
 	}
+	emulator.debugged = debug || options.GDB != "" || options.AttachDebugger != nil
+	cpu.StopForDebuggingCallback = emulator.stopAtBreakpoint
+	cpu.StopForWatchpointCallback = emulator.stopForWatchpoint
 
 	// Start emulation
-	if err := ebiten.RunGame(emulator); err != nil {
+	err := ebiten.RunGame(emulator)
+	close(emulator.stopped)
+	if traceErr := emulator.closeTrace(); traceErr != nil {
+		log.Printf("Unable to write trace, %v", traceErr)
+	}
+	if err != nil && err != errProgramExited {
 		log.Fatal(err)
 	}
 
@@ -0,0 +1,191 @@
+package emulator
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+	"github.com/raveltan/chip-fa/debugger"
+)
+
+// Size of a character printed by ebitenutil.DebugPrintAt
+const (
+	overlayCharWidth  = 6
+	overlayCharHeight = 16
+)
+
+// Amount of instructions shown before and after the program counter
+const overlayInstructions = 5
+
+// Bytes of memory shown from I
+const overlayMemory = 64
+
+// Keys of the keypad indicator, in the layout of the COSMAC VIP keypad
+var overlayKeypad = [4][4]uint8{
+	{0x1, 0x2, 0x3, 0xC},
+	{0x4, 0x5, 0x6, 0xD},
+	{0x7, 0x8, 0x9, 0xE},
+	{0xA, 0x0, 0xB, 0xF},
+}
+
+var overlayBackground = color.RGBA{0, 0, 0, 0xC0}
+
+// overlayButton is a command of the overlay, drawn on the first line where it can be clicked
+type overlayButton struct {
+	label string
+	keys  []ebiten.Key
+	run   func()
+}
+
+// text returns the button with its first hotkey (ex: [F6 Step]).
+func (b overlayButton) text() string {
+	if len(b.keys) == 0 {
+		return "[" + b.label + "]"
+	}
+	return fmt.Sprintf("[%s %s]", b.keys[0], b.label)
+}
+
+func (e *Emulator) overlayButtons() []overlayButton {
+	continueLabel := "Continue"
+	if !e.Pause {
+		continueLabel = "Pause"
+	}
+	return []overlayButton{
+		{continueLabel, e.keymap.Continue, func() {
+			if !e.resume() {
+				e.Pause = true
+			}
+		}},
+		{"Step", e.keymap.Step, func() {
+			e.overlayRunUntil(func(debugger.CPUState) bool { return true })
+		}},
+		{"Next", e.keymap.Next, func() {
+			var stop func(debugger.CPUState) bool
+			e.callDebugger(func() {
+				stop = e.debug.NextCondition()
+			})
+			e.overlayRunUntil(stop)
+		}},
+		{"Finish", e.keymap.Finish, func() {
+			var stop func(debugger.CPUState) bool
+			ok := false
+			e.callDebugger(func() {
+				stop, ok = e.debug.FinishCondition()
+			})
+			if !ok {
+				e.showMessage("Unable to finish as the program is not in a subroutine")
+				return
+			}
+			e.overlayRunUntil(stop)
+		}},
+	}
+}
+
+// overlayRunUntil starts a stepping command from the overlay, the game loop does not wait for it.
+func (e *Emulator) overlayRunUntil(stop func(debugger.CPUState) bool) {
+	if !e.startRunUntil(stop, nil) {
+		e.showMessage("Unable to step as emulation is not paused")
+	}
+}
+
+// updateOverlay runs the command of the button that is clicked or whose hotkey is pressed.
+func (e *Emulator) updateOverlay() {
+	mouseX, mouseY := ebiten.CursorPosition()
+	clicked := inpututil.IsMouseButtonJustPressed(ebiten.MouseButtonLeft) && mouseY >= 0 && mouseY < overlayCharHeight
+	x := 0
+	for _, button := range e.overlayButtons() {
+		width := len(button.text()) * overlayCharWidth
+		if isJustPressed(button.keys) || (clicked && mouseX >= x && mouseX < x+width) {
+			button.run()
+			return
+		}
+		x += width + overlayCharWidth
+	}
+}
+
+// printOverlay prints text at a position in characters, keeping up to maxLines lines.
+func printOverlay(s *ebiten.Image, text string, column int, row int, maxLines int) {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	if len(lines) > maxLines {
+		lines = lines[:maxLines]
+	}
+	ebitenutil.DebugPrintAt(s, strings.Join(lines, "\n"), column*overlayCharWidth, row*overlayCharHeight)
+}
+
+// drawOverlay draws the debugger overlay on top of the CPU screen
+// -----------
+// Layout (in characters)
+// row 0       buttons and the state of the emulation
+// rows 2-13   registers (left), disassembly around the program counter (right)
+// rows 11-17  keypad (left), call stack (right)
+// rows 18-22  memory from I
+// row 23      notification
+// -----------
+func (e *Emulator) drawOverlay(s *ebiten.Image) {
+	width, height := s.Size()
+	ebitenutil.DrawRect(s, 0, 0, float64(width), float64(height), overlayBackground)
+	state := e.cpuState()
+	// The views are shared with the debugger shell. Draw is called by the game loop, thus they read the CPU directly
+	// instead of going through the requests of the debugger, which would wait for a goroutine on every frame.
+	if e.overlayView == nil {
+		e.overlayView = &debugger.Debugger{GetStateCallback: e.cpuState, ReadMemoryCallback: e.readMemory, Symbols: e.symbols}
+	}
+	disassembly := e.overlayView.InstructionsAround(state.ProgramCounter, overlayInstructions)
+	stack := e.overlayView.Backtrace()
+	memory := e.overlayView.MemoryView(state.IndexRegister, overlayMemory)
+
+	buttons := ""
+	for _, button := range e.overlayButtons() {
+		buttons += button.text() + " "
+	}
+	status := "Running"
+	if e.cpuError != nil {
+		status = "Halted: " + e.cpuError.Error()
+	} else if e.Pause {
+		status = "Paused at " + e.describeAddress(state.ProgramCounter)
+	}
+	printOverlay(s, buttons+" "+status, 0, 0, 1)
+
+	registers := "Registers\n"
+	for i, v := range state.Register {
+		registers += fmt.Sprintf("v%x=%02x ", i, v)
+		if i%4 == 3 {
+			registers += "\n"
+		}
+	}
+	registers += fmt.Sprintf("I=0x%03x PC=0x%03x\nSP=%x DT=%02x ST=%02x", state.IndexRegister, state.ProgramCounter,
+		state.StackPointer, state.DelayTimer, state.SoundTimer)
+	printOverlay(s, registers, 0, 2, 8)
+
+	// The program counter is kept in the middle of the disassembly, labels may add lines around it
+	instructions := strings.Split(strings.TrimRight(disassembly, "\n"), "\n")
+	first := 0
+	for i, line := range instructions {
+		if strings.HasPrefix(line, ">") && i > overlayInstructions {
+			first = i - overlayInstructions
+		}
+	}
+	printOverlay(s, "Disassembly\n"+strings.Join(instructions[first:], "\n"), 28, 2, 2*overlayInstructions+2)
+
+	keypad := "Keypad\n"
+	for _, row := range overlayKeypad {
+		for _, key := range row {
+			if e.Cpu.KeypadStates[key] != 0 {
+				keypad += fmt.Sprintf("[%X]", key)
+			} else {
+				keypad += fmt.Sprintf(" %X ", key)
+			}
+		}
+		keypad += "\n"
+	}
+	printOverlay(s, keypad, 0, 11, 5)
+	printOverlay(s, "Stack\n"+stack, 28, 14, 4)
+
+	printOverlay(s, fmt.Sprintf("Memory at I\n%s", memory), 0, 18, overlayMemory/16+1)
+	if e.messageTimer > 0 {
+		printOverlay(s, e.message, 0, 23, 1)
+	}
+}
@@ -0,0 +1,157 @@
+package emulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+
+	"github.com/raveltan/chip-fa/cpu"
+)
+
+// rewindBuffer keeps a bounded history of the CPU states to play the game backwards.
+// Only the latest state is kept as is, every older state is stored as a delta:
+// the run length encoded XOR of the state and the state captured after it.
+// Most of the memory never changes between captures, thus the deltas are usually tiny.
+type rewindBuffer struct {
+	// Latest captured state, as written by cpu.SaveState
+	head []byte
+	// Ring buffer of deltas, the delta at start is the oldest one
+	deltas [][]byte
+	start  int
+	count  int
+	// Amount of frames between captures
+	interval int
+	frames   int
+	// Frames left to show the restored state, each capture is held for interval frames
+	// so the game is played backwards at its normal speed
+	held int
+}
+
+// newRewindBuffer creates a rewind buffer that keeps the given seconds of history,
+// capturing a state every interval frames.
+func newRewindBuffer(seconds int, interval int) *rewindBuffer {
+	if interval < 1 {
+		interval = 1
+	}
+	capacity := seconds * 60 / interval
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &rewindBuffer{deltas: make([][]byte, capacity), interval: interval}
+}
+
+// update should be called once every frame, it captures the CPU state every interval frames.
+func (r *rewindBuffer) update(c *cpu.CPU) {
+	r.held = 0
+	r.frames++
+	if r.frames < r.interval {
+		return
+	}
+	r.frames = 0
+
+	state := &bytes.Buffer{}
+	if err := c.SaveState(state); err != nil {
+		log.Printf("error: Unable to capture rewind state, %v", err)
+		return
+	}
+	r.push(state.Bytes())
+}
+
+func (r *rewindBuffer) push(state []byte) {
+	if r.head == nil || len(r.head) != len(state) {
+		r.head = state
+		r.start, r.count = 0, 0
+		return
+	}
+
+	delta := encodeDelta(r.head, state)
+	if r.count == len(r.deltas) {
+		// Drop the oldest delta
+		r.deltas[r.start] = nil
+		r.start = (r.start + 1) % len(r.deltas)
+		r.count--
+	}
+	r.deltas[(r.start+r.count)%len(r.deltas)] = delta
+	r.count++
+	r.head = state
+}
+
+// rewind should be called once every frame while rewinding, it restores the CPU to the previous
+// captured state every interval frames. Returns false when there is no more history.
+func (r *rewindBuffer) rewind(c *cpu.CPU) bool {
+	if r.held > 0 {
+		r.held--
+		return true
+	}
+	if r.count == 0 {
+		return false
+	}
+	r.count--
+	last := (r.start + r.count) % len(r.deltas)
+	previous := make([]byte, len(r.head))
+	copy(previous, r.head)
+	applyDelta(previous, r.deltas[last])
+	r.deltas[last] = nil
+	r.head = previous
+	r.frames = 0
+	r.held = r.interval - 1
+
+	if err := c.LoadState(bytes.NewReader(r.head)); err != nil {
+		log.Printf("error: Unable to restore rewind state, %v", err)
+		return false
+	}
+	return true
+}
+
+// reset drops the whole history, used when the CPU state is replaced.
+func (r *rewindBuffer) reset() {
+	for i := range r.deltas {
+		r.deltas[i] = nil
+	}
+	r.head = nil
+	r.start, r.count, r.frames, r.held = 0, 0, 0, 0
+}
+
+// encodeDelta returns the XOR of a and b (which have the same length) encoded as a list of
+// (length of unchanged bytes, length of changed bytes, changed bytes) entries using uvarints.
+func encodeDelta(a []byte, b []byte) []byte {
+	delta := []byte{}
+	varint := make([]byte, binary.MaxVarintLen64)
+	for i := 0; i < len(a); {
+		unchanged := i
+		for unchanged < len(a) && a[unchanged] == b[unchanged] {
+			unchanged++
+		}
+		changed := unchanged
+		for changed < len(a) && a[changed] != b[changed] {
+			changed++
+		}
+		if unchanged == len(a) {
+			break
+		}
+		delta = append(delta, varint[:binary.PutUvarint(varint, uint64(unchanged-i))]...)
+		delta = append(delta, varint[:binary.PutUvarint(varint, uint64(changed-unchanged))]...)
+		for j := unchanged; j < changed; j++ {
+			delta = append(delta, a[j]^b[j])
+		}
+		i = changed
+	}
+	return delta
+}
+
+// applyDelta XORs the delta created by encodeDelta into state.
+func applyDelta(state []byte, delta []byte) {
+	position := 0
+	for len(delta) > 0 {
+		unchanged, n := binary.Uvarint(delta)
+		delta = delta[n:]
+		changed, n := binary.Uvarint(delta)
+		delta = delta[n:]
+		position += int(unchanged)
+		for i := 0; i < int(changed); i++ {
+			state[position+i] ^= delta[i]
+		}
+		delta = delta[changed:]
+		position += int(changed)
+	}
+}
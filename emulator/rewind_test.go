@@ -0,0 +1,38 @@
+package emulator
+
+import (
+	"testing"
+
+	"github.com/raveltan/chip-fa/cpu"
+)
+
+func TestRewindSpeed(t *testing.T) {
+	c := &cpu.CPU{}
+	c.Boot()
+	r := newRewindBuffer(1, 3)
+	// V0 counts the frames, a state is captured every 3 frames (V0 = 3, 6, 9 and 12)
+	for frame := 1; frame <= 12; frame++ {
+		c.Register[0] = uint8(frame)
+		r.update(c)
+	}
+
+	// Each capture is held for 3 frames, as long as it took to play them forward
+	expected := []uint8{9, 9, 9, 6, 6, 6, 3, 3, 3}
+	for frame, value := range expected {
+		if !r.rewind(c) {
+			t.Fatalf("the history ended after %d frames", frame)
+		}
+		if c.Register[0] != value {
+			t.Fatalf("V0 = %d after rewinding %d frames, expected %d", c.Register[0], frame+1, value)
+		}
+	}
+	if r.rewind(c) {
+		t.Fatalf("rewound past the oldest capture to V0 = %d", c.Register[0])
+	}
+
+	// Playing forward again starts a new capture interval
+	r.update(c)
+	if r.held != 0 {
+		t.Fatalf("%d frames still held after playing forward", r.held)
+	}
+}
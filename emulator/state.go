@@ -0,0 +1,77 @@
+package emulator
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+)
+
+// Hotkeys of the save state slots, pressing the key saves the state
+// while pressing it with shift loads the state.
+var stateSlotKeys = [...]ebiten.Key{ebiten.KeyF1, ebiten.KeyF2, ebiten.KeyF3, ebiten.KeyF4}
+
+// stateSlotPath returns the path of the save state file of a slot, which is stored next to the ROM.
+func (e *Emulator) stateSlotPath(slot int) string {
+	return fmt.Sprintf("%s.%d.state", e.romPath, slot)
+}
+
+func (e *Emulator) handleStateHotkeys() {
+	for i, key := range stateSlotKeys {
+		if !inpututil.IsKeyJustPressed(key) {
+			continue
+		}
+		slot := i + 1
+		path := e.stateSlotPath(slot)
+		if ebiten.IsKeyPressed(ebiten.KeyShift) {
+			if err := e.loadStateFile(path); err != nil {
+				e.showMessage(fmt.Sprintf("Unable to load slot %d: %v", slot, err))
+				continue
+			}
+			e.showMessage(fmt.Sprintf("Loaded slot %d", slot))
+		} else {
+			if err := e.saveStateFile(path); err != nil {
+				e.showMessage(fmt.Sprintf("Unable to save slot %d: %v", slot, err))
+				continue
+			}
+			e.showMessage(fmt.Sprintf("Saved slot %d", slot))
+		}
+	}
+}
+
+func (e *Emulator) saveStateFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := e.Cpu.SaveState(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (e *Emulator) loadStateFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := e.Cpu.LoadState(f); err != nil {
+		return err
+	}
+	// The rewind history does not lead to the loaded state anymore
+	if e.rewind != nil {
+		e.rewind.reset()
+	}
+	return nil
+}
+
+// showMessage shows a short notification on the window for a few seconds.
+func (e *Emulator) showMessage(message string) {
+	log.Println(message)
+	e.message = message
+	e.messageTimer = messageDuration
+}
@@ -0,0 +1,61 @@
+package emulator
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"github.com/raveltan/chip-fa/trace"
+)
+
+// startTrace starts tracing the executed instructions, a new trace file is created when path is not empty,
+// otherwise the last trace file is resumed.
+func (e *Emulator) startTrace(path string, format trace.Format) error {
+	if path != "" {
+		if err := e.closeTrace(); err != nil {
+			return err
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		writer, err := trace.NewWriter(f, format)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		e.traceFile, e.traceWriter = f, writer
+	}
+	if e.traceWriter == nil {
+		return errors.New("no trace file, a path is needed to start tracing")
+	}
+	e.Cpu.TraceCallback = func(programCounter uint16, operationCode uint16) {
+		if err := e.traceWriter.Write(trace.NewEntry(e.Cpu, programCounter, operationCode)); err != nil {
+			log.Printf("Unable to write trace, %v", err)
+			e.Cpu.TraceCallback = nil
+		}
+	}
+	return nil
+}
+
+// stopTrace stops tracing, the trace file is kept open to be resumed by startTrace.
+func (e *Emulator) stopTrace() error {
+	e.Cpu.TraceCallback = nil
+	if e.traceWriter == nil {
+		return nil
+	}
+	return e.traceWriter.Flush()
+}
+
+// closeTrace stops tracing and closes the trace file, it must be called before exiting.
+func (e *Emulator) closeTrace() error {
+	if e.traceFile == nil {
+		return nil
+	}
+	err := e.stopTrace()
+	if closeErr := e.traceFile.Close(); err == nil {
+		err = closeErr
+	}
+	e.traceFile, e.traceWriter = nil, nil
+	return err
+}
@@ -0,0 +1,488 @@
+package gdbstub
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/raveltan/chip-fa/cpu"
+)
+
+// Registers of the CHIP-8, in the order they are numbered by GDB
+type Registers struct {
+	Register       [16]uint8
+	IndexRegister  uint16
+	ProgramCounter uint16
+	StackPointer   uint16
+	DelayTimer     uint8
+	SoundTimer     uint8
+}
+
+// Returned by Step and Continue when the execution could not be resumed, as something else resumed it
+// (the debugger shell, the pause hotkey...). The stub replies with an error instead of a stop reply.
+var ErrNotPaused = errors.New("the target is not paused")
+
+// Target is the emulated CHIP-8 controlled by GDB.
+// -----------
+// The stub runs on its own goroutine, every method is called while the target is paused.
+// -----------
+type Target interface {
+	Registers() Registers
+	SetRegisters(Registers)
+	// ReadMemory reads length bytes starting at address, the result is shorter when it goes past the end of the memory
+	ReadMemory(address uint16, length int) []uint8
+	// WriteMemory writes bytes starting at address, failing when they do not fit in the memory
+	WriteMemory(address uint16, data []uint8) error
+	// AddBreakpoint stops the execution before the instruction at address is executed, returning the ID of the breakpoint
+	AddBreakpoint(address uint16) int
+	DeleteBreakpoint(id int) bool
+	// Step executes a single instruction, blocking until it is executed. The CPU error is returned, if any,
+	// or ErrNotPaused when the execution could not be resumed.
+	Step() error
+	// Continue resumes the execution, blocking until it is stopped by a breakpoint, a CPU error (which is returned)
+	// or until interrupt is closed, which happens when the user interrupts the execution (Ctrl-C).
+	// The interruption may happen before the execution is resumed, it must still stop it.
+	// Returns ErrNotPaused when the execution could not be resumed.
+	Continue(interrupt <-chan struct{}) error
+	// Pause stops the execution, it is called when GDB connects
+	Pause()
+	// Resume resumes the execution without blocking, it is called when GDB detaches or disconnects
+	Resume()
+}
+
+// Register names, sizes (in bits) and types for the target description
+var registerDescriptions = []struct {
+	name    string
+	bitSize int
+	kind    string
+}{
+	{"v0", 8, "uint8"}, {"v1", 8, "uint8"}, {"v2", 8, "uint8"}, {"v3", 8, "uint8"},
+	{"v4", 8, "uint8"}, {"v5", 8, "uint8"}, {"v6", 8, "uint8"}, {"v7", 8, "uint8"},
+	{"v8", 8, "uint8"}, {"v9", 8, "uint8"}, {"va", 8, "uint8"}, {"vb", 8, "uint8"},
+	{"vc", 8, "uint8"}, {"vd", 8, "uint8"}, {"ve", 8, "uint8"}, {"vf", 8, "uint8"},
+	{"i", 16, "data_ptr"},
+	{"pc", 16, "code_ptr"},
+	{"sp", 16, "uint16"},
+	{"dt", 8, "uint8"},
+	{"st", 8, "uint8"},
+}
+
+// targetDescription returns the target description XML, read by GDB with qXfer:features:read:target.xml.
+func targetDescription() string {
+	xml := `<?xml version="1.0"?>` + "\n" +
+		`<!DOCTYPE target SYSTEM "gdb-target.dtd">` + "\n" +
+		`<target version="1.0">` + "\n" +
+		`  <feature name="org.chip-fa.chip8">` + "\n"
+	for i, register := range registerDescriptions {
+		xml += fmt.Sprintf(`    <reg name="%s" bitsize="%d" type="%s" regnum="%d"/>`+"\n", register.name, register.bitSize, register.kind, i)
+	}
+	return xml + "  </feature>\n</target>\n"
+}
+
+// values returns the registers in the order of registerDescriptions.
+func (r Registers) values() []uint64 {
+	values := []uint64{}
+	for _, v := range r.Register {
+		values = append(values, uint64(v))
+	}
+	return append(values, uint64(r.IndexRegister), uint64(r.ProgramCounter), uint64(r.StackPointer), uint64(r.DelayTimer), uint64(r.SoundTimer))
+}
+
+// set sets the register number n, returning false when there is no such register.
+func (r *Registers) set(n int, value uint64) bool {
+	switch {
+	case n >= 0 && n < len(r.Register):
+		r.Register[n] = uint8(value)
+	case n == 16:
+		r.IndexRegister = uint16(value)
+	case n == 17:
+		r.ProgramCounter = uint16(value)
+	case n == 18:
+		r.StackPointer = uint16(value)
+	case n == 19:
+		r.DelayTimer = uint8(value)
+	case n == 20:
+		r.SoundTimer = uint8(value)
+	default:
+		return false
+	}
+	return true
+}
+
+// encodeRegister encodes a register as little endian hexadecimal bytes, as expected by GDB.
+func encodeRegister(value uint64, bitSize int) (r string) {
+	for i := 0; i < bitSize/8; i++ {
+		r += fmt.Sprintf("%02x", uint8(value>>(8*uint(i))))
+	}
+	return
+}
+
+// decodeRegister decodes a little endian hexadecimal register.
+func decodeRegister(text string) (uint64, bool) {
+	data, err := hex.DecodeString(text)
+	if err != nil {
+		return 0, false
+	}
+	value := uint64(0)
+	for i, b := range data {
+		value |= uint64(b) << (8 * uint(i))
+	}
+	return value, true
+}
+
+// Serve accepts the GDB connections of a listener, serving one at a time until the listener is closed.
+func Serve(listener net.Listener, target Target) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		log.Printf("GDB connected from %s", conn.RemoteAddr())
+		if err := ServeConn(conn, target); err != nil {
+			log.Printf("GDB connection closed, %v", err)
+		} else {
+			log.Printf("GDB disconnected")
+		}
+		conn.Close()
+	}
+}
+
+// session is the state of a GDB connection
+type session struct {
+	target Target
+	w      io.Writer
+	events chan event
+	// Closed when the session ends, to stop the reading of the connection
+	closed chan struct{}
+	// Error that ended the reading of the connection, set before events is closed
+	readErr error
+	// Set by QStartNoAckMode, the packets are no longer acknowledged
+	noAck bool
+	// Last sent packet, sent again when GDB asks for it (-)
+	lastPacket []byte
+	// Reply to ?, the reason of the last stop
+	lastStop string
+	// Breakpoints added by GDB by their address, removed when GDB disconnects
+	breakpoints map[uint16]int
+}
+
+// ServeConn serves a single GDB connection, the target is paused while GDB is connected
+// and resumed when GDB detaches or disconnects.
+func ServeConn(conn io.ReadWriter, target Target) error {
+	s := &session{target: target, w: conn, events: make(chan event), closed: make(chan struct{}),
+		lastStop: "S05", breakpoints: map[uint16]int{}}
+	defer close(s.closed)
+	go func() {
+		r := bufio.NewReader(conn)
+		for {
+			e, err := readEvent(r)
+			if err != nil {
+				s.readErr = err
+				close(s.events)
+				return
+			}
+			select {
+			case s.events <- e:
+			case <-s.closed:
+				return
+			}
+		}
+	}()
+
+	target.Pause()
+	defer func() {
+		for _, id := range s.breakpoints {
+			target.DeleteBreakpoint(id)
+		}
+		target.Resume()
+	}()
+
+	for e := range s.events {
+		switch {
+		case e.interrupt:
+			// The target is already paused
+			if err := s.send(s.lastStop); err != nil {
+				return err
+			}
+			continue
+		case e.invalid:
+			if _, err := s.w.Write([]byte("-")); err != nil {
+				return err
+			}
+			continue
+		case e.nack:
+			if _, err := s.w.Write(s.lastPacket); err != nil {
+				return err
+			}
+			continue
+		}
+		if !s.noAck {
+			if _, err := s.w.Write([]byte("+")); err != nil {
+				return err
+			}
+		}
+		reply, done := s.handle(e.packet)
+		if done {
+			if reply != "" {
+				return s.send(reply)
+			}
+			return nil
+		}
+		if err := s.send(reply); err != nil {
+			return err
+		}
+	}
+	if s.readErr == io.EOF {
+		return nil
+	}
+	return s.readErr
+}
+
+func (s *session) send(data string) error {
+	s.lastPacket = encodePacket(data)
+	_, err := s.w.Write(s.lastPacket)
+	return err
+}
+
+// run runs Step or Continue, interrupting the target when GDB interrupts it. The stop reply is returned.
+func (s *session) run(f func(interrupt <-chan struct{}) error) (string, bool) {
+	done := make(chan error, 1)
+	interrupt := make(chan struct{})
+	go func() {
+		done <- f(interrupt)
+	}()
+	interrupted := false
+	for {
+		select {
+		case err := <-done:
+			if errors.Is(err, ErrNotPaused) {
+				// The target did not stop, thus the last stop reason is kept
+				return "E02", false
+			}
+			s.lastStop = stopReply(err, interrupted)
+			return s.lastStop, false
+		case e, ok := <-s.events:
+			if !ok {
+				// GDB disconnected while the target was running
+				if !interrupted {
+					close(interrupt)
+				}
+				<-done
+				return "", true
+			}
+			// Other packets are not allowed while the target is running
+			if e.interrupt && !interrupted {
+				interrupted = true
+				close(interrupt)
+			}
+		}
+	}
+}
+
+// stopReply returns the stop reply of a run, CPU errors are reported as signals.
+func stopReply(err error, interrupted bool) string {
+	var unknownOpcode *cpu.UnknownOpcodeError
+	switch {
+	case err == nil && interrupted:
+		// SIGINT
+		return "S02"
+	case err == nil:
+		// SIGTRAP
+		return "S05"
+	case errors.Is(err, cpu.ErrProgramExited):
+		return "W00"
+	case errors.As(err, &unknownOpcode):
+		// SIGILL
+		return "S04"
+	}
+	// SIGSEGV, for the memory and stack errors
+	return "S0b"
+}
+
+// parseHex parses a hexadecimal number of the packets.
+func parseHex(text string) (uint64, bool) {
+	value, err := strconv.ParseUint(text, 16, 64)
+	return value, err == nil
+}
+
+// handle handles a packet and returns its reply, done is set when the connection must be closed after the reply.
+func (s *session) handle(packet string) (reply string, done bool) {
+	// Reply to the malformed packets
+	const errorReply = "E01"
+	if packet == "" {
+		return "", false
+	}
+	arguments := packet[1:]
+	switch packet[0] {
+	case '?':
+		return s.lastStop, false
+	case 'g':
+		registers := s.target.Registers().values()
+		for i, value := range registers {
+			reply += encodeRegister(value, registerDescriptions[i].bitSize)
+		}
+		return reply, false
+	case 'G':
+		registers := s.target.Registers()
+		offset := 0
+		for i, register := range registerDescriptions {
+			size := register.bitSize / 4
+			if offset+size > len(arguments) {
+				return errorReply, false
+			}
+			value, ok := decodeRegister(arguments[offset : offset+size])
+			if !ok {
+				return errorReply, false
+			}
+			registers.set(i, value)
+			offset += size
+		}
+		s.target.SetRegisters(registers)
+		return "OK", false
+	case 'p':
+		n, ok := parseHex(arguments)
+		if !ok || n >= uint64(len(registerDescriptions)) {
+			return errorReply, false
+		}
+		return encodeRegister(s.target.Registers().values()[n], registerDescriptions[n].bitSize), false
+	case 'P':
+		parts := strings.SplitN(arguments, "=", 2)
+		if len(parts) != 2 {
+			return errorReply, false
+		}
+		n, ok := parseHex(parts[0])
+		value, valueOk := decodeRegister(parts[1])
+		registers := s.target.Registers()
+		if !ok || !valueOk || n >= uint64(len(registerDescriptions)) || !registers.set(int(n), value) {
+			return errorReply, false
+		}
+		s.target.SetRegisters(registers)
+		return "OK", false
+	case 'm':
+		parts := strings.SplitN(arguments, ",", 2)
+		if len(parts) != 2 {
+			return errorReply, false
+		}
+		address, ok := parseHex(parts[0])
+		length, lengthOk := parseHex(parts[1])
+		if !ok || !lengthOk || address > 0xFFFF || length > 0x10000 {
+			return errorReply, false
+		}
+		data := s.target.ReadMemory(uint16(address), int(length))
+		if len(data) == 0 && length > 0 {
+			return errorReply, false
+		}
+		return hex.EncodeToString(data), false
+	case 'M':
+		parts := strings.SplitN(arguments, ":", 2)
+		if len(parts) != 2 {
+			return errorReply, false
+		}
+		location := strings.SplitN(parts[0], ",", 2)
+		if len(location) != 2 {
+			return errorReply, false
+		}
+		address, ok := parseHex(location[0])
+		length, lengthOk := parseHex(location[1])
+		data, err := hex.DecodeString(parts[1])
+		if !ok || !lengthOk || err != nil || address > 0xFFFF || uint64(len(data)) != length {
+			return errorReply, false
+		}
+		if err := s.target.WriteMemory(uint16(address), data); err != nil {
+			return errorReply, false
+		}
+		return "OK", false
+	case 'Z', 'z':
+		// Z0 (software) and Z1 (hardware) breakpoints are the same for the emulator, watchpoints are not supported
+		parts := strings.Split(arguments, ",")
+		if len(parts) < 2 || (parts[0] != "0" && parts[0] != "1") {
+			return "", false
+		}
+		address, ok := parseHex(parts[1])
+		if !ok || address > 0xFFFF {
+			return errorReply, false
+		}
+		id, exists := s.breakpoints[uint16(address)]
+		if packet[0] == 'Z' && !exists {
+			s.breakpoints[uint16(address)] = s.target.AddBreakpoint(uint16(address))
+		}
+		if packet[0] == 'z' && exists {
+			s.target.DeleteBreakpoint(id)
+			delete(s.breakpoints, uint16(address))
+		}
+		return "OK", false
+	case 'c', 's':
+		// The execution may be resumed at another address (ex: c 2a4)
+		if arguments != "" {
+			address, ok := parseHex(arguments)
+			if !ok || address > 0xFFFF {
+				return errorReply, false
+			}
+			registers := s.target.Registers()
+			registers.ProgramCounter = uint16(address)
+			s.target.SetRegisters(registers)
+		}
+		if packet[0] == 's' {
+			return s.run(func(<-chan struct{}) error { return s.target.Step() })
+		}
+		return s.run(s.target.Continue)
+	case 'D':
+		return "OK", true
+	case 'k':
+		return "", true
+	case 'H', 'T':
+		// There is a single thread
+		return "OK", false
+	case 'q', 'Q':
+		return s.handleQuery(packet)
+	}
+	// Empty replies tell GDB that the packet is not supported
+	return "", false
+}
+
+// handleQuery handles the general query packets (q and Q).
+func (s *session) handleQuery(packet string) (string, bool) {
+	switch {
+	case strings.HasPrefix(packet, "qSupported"):
+		return "PacketSize=4000;qXfer:features:read+;QStartNoAckMode+", false
+	case packet == "QStartNoAckMode":
+		// The OK reply is still acknowledged by GDB
+		s.noAck = true
+		return "OK", false
+	case strings.HasPrefix(packet, "qXfer:features:read:target.xml:"):
+		parts := strings.SplitN(packet[len("qXfer:features:read:target.xml:"):], ",", 2)
+		if len(parts) != 2 {
+			return "E01", false
+		}
+		offset, ok := parseHex(parts[0])
+		length, lengthOk := parseHex(parts[1])
+		if !ok || !lengthOk {
+			return "E01", false
+		}
+		// m is followed by a part of the document, l by its last part
+		description := targetDescription()
+		if offset >= uint64(len(description)) {
+			return "l", false
+		}
+		end := offset + length
+		if end >= uint64(len(description)) {
+			return "l" + description[offset:], false
+		}
+		return "m" + description[offset:end], false
+	case packet == "qAttached":
+		return "1", false
+	case packet == "qC":
+		return "QC1", false
+	case packet == "qfThreadInfo":
+		return "m1", false
+	case packet == "qsThreadInfo":
+		return "l", false
+	}
+	return "", false
+}
@@ -0,0 +1,485 @@
+package gdbstub
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raveltan/chip-fa/cpu"
+)
+
+// fakeTarget is a CHIP-8 that only stores the registers, the memory and the breakpoints set by the stub
+type fakeTarget struct {
+	mutex       sync.Mutex
+	registers   Registers
+	memory      [0x1000]uint8
+	breakpoints map[int]uint16
+	nextID      int
+	pauses      int
+	resumed     bool
+	// Returned by Step, which otherwise moves the program counter to the next instruction
+	stepErr error
+	// Continue returns the error sent on stop, or nil once it is interrupted
+	stop        chan error
+	interrupted int
+}
+
+func newFakeTarget() *fakeTarget {
+	return &fakeTarget{breakpoints: map[int]uint16{}, stop: make(chan error)}
+}
+
+func (t *fakeTarget) Registers() Registers {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.registers
+}
+
+func (t *fakeTarget) SetRegisters(registers Registers) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.registers = registers
+}
+
+func (t *fakeTarget) ReadMemory(address uint16, length int) []uint8 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	end := int(address) + length
+	if end > len(t.memory) {
+		end = len(t.memory)
+	}
+	if int(address) >= end {
+		return []uint8{}
+	}
+	return append([]uint8{}, t.memory[address:end]...)
+}
+
+func (t *fakeTarget) WriteMemory(address uint16, data []uint8) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if int(address)+len(data) > len(t.memory) {
+		return cpu.ErrMemoryOutOfBounds
+	}
+	copy(t.memory[address:], data)
+	return nil
+}
+
+func (t *fakeTarget) AddBreakpoint(address uint16) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.nextID++
+	t.breakpoints[t.nextID] = address
+	return t.nextID
+}
+
+func (t *fakeTarget) DeleteBreakpoint(id int) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, ok := t.breakpoints[id]
+	delete(t.breakpoints, id)
+	return ok
+}
+
+func (t *fakeTarget) Step() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.stepErr != nil {
+		return t.stepErr
+	}
+	t.registers.ProgramCounter += 2
+	return nil
+}
+
+func (t *fakeTarget) Continue(interrupt <-chan struct{}) error {
+	select {
+	case <-interrupt:
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		t.interrupted++
+		return nil
+	case err := <-t.stop:
+		return err
+	}
+}
+
+func (t *fakeTarget) Pause() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.pauses++
+}
+
+func (t *fakeTarget) Resume() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.resumed = true
+}
+
+// client is a scripted GDB client connected to the stub by a pipe
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	done chan error
+}
+
+// connect serves a connection to the target, the stub is stopped at the end of the test.
+func connect(t *testing.T, target Target) *client {
+	stub, conn := net.Pipe()
+	// A broken stub fails the test instead of blocking it
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn), done: make(chan error, 1)}
+	go func() {
+		c.done <- ServeConn(stub, target)
+		stub.Close()
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		<-c.done
+	})
+	return c
+}
+
+func (c *client) write(data string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(data)); err != nil {
+		c.t.Fatalf("unable to write %q, %v", data, err)
+	}
+}
+
+// expect reads the next bytes sent by the stub, which must be data.
+func (c *client) expect(data string) {
+	c.t.Helper()
+	received := make([]byte, len(data))
+	for i := range received {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			c.t.Fatalf("unable to read %q, %v", data, err)
+		}
+		received[i] = b
+	}
+	if string(received) != data {
+		c.t.Fatalf("received %q, expected %q", received, data)
+	}
+}
+
+// read reads the next packet sent by the stub, checking its checksum.
+func (c *client) read() string {
+	c.t.Helper()
+	e, err := readEvent(c.r)
+	if err != nil {
+		c.t.Fatalf("unable to read the reply, %v", err)
+	}
+	if e.packet == "" && (e.invalid || e.interrupt || e.nack) {
+		c.t.Fatalf("received %+v, expected a packet", e)
+	}
+	return e.packet
+}
+
+// reply reads the next packet sent by the stub and acknowledges it.
+func (c *client) reply() string {
+	c.t.Helper()
+	packet := c.read()
+	c.write("+")
+	return packet
+}
+
+// command sends a packet, which must be acknowledged and answered with the expected reply.
+func (c *client) command(packet string, expected string) {
+	c.t.Helper()
+	c.write(string(encodePacket(packet)))
+	c.expect("+")
+	if reply := c.reply(); reply != expected {
+		c.t.Fatalf("%s: received %q, expected %q", packet, reply, expected)
+	}
+}
+
+// detach ends the session, the stub must return without error. The connection is closed by the stub
+// once the reply is sent, thus it is not acknowledged.
+func (c *client) detach() {
+	c.t.Helper()
+	c.write(string(encodePacket("D")))
+	c.expect("+")
+	if reply := c.read(); reply != "OK" {
+		c.t.Fatalf("D: received %q, expected OK", reply)
+	}
+	if err := <-c.done; err != nil {
+		c.t.Fatalf("ServeConn returned %v", err)
+	}
+	c.done <- nil
+}
+
+// cont resumes the target with c.
+func (c *client) cont() {
+	c.t.Helper()
+	c.write(string(encodePacket("c")))
+	c.expect("+")
+}
+
+func TestEncodePacket(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected string
+	}{
+		{"", "$#00"},
+		{"OK", "$OK#9a"},
+		{"S05", "$S05#b8"},
+		// $, #, } and * are escaped
+		{"a}b", "$a}]b#9d"},
+		{"#$*", "$}\x03}\x04}\x0a#88"},
+	}
+	for _, test := range tests {
+		if packet := string(encodePacket(test.data)); packet != test.expected {
+			t.Errorf("encodePacket(%q) = %q, expected %q", test.data, packet, test.expected)
+		}
+	}
+}
+
+func TestReadEvent(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected event
+	}{
+		{"$g#67", event{packet: "g"}},
+		// Acknowledgements and garbage are skipped
+		{"++x$?#3f", event{packet: "?"}},
+		{"$a}]b#9d", event{packet: "a}b"}},
+		{"$g#00", event{invalid: true}},
+		{"\x03", event{interrupt: true}},
+		{"-", event{nack: true}},
+	}
+	for _, test := range tests {
+		e, err := readEvent(bufio.NewReader(strings.NewReader(test.input)))
+		if err != nil || e != test.expected {
+			t.Errorf("readEvent(%q) = %+v, %v, expected %+v", test.input, e, err, test.expected)
+		}
+	}
+}
+
+func TestAcknowledgements(t *testing.T) {
+	target := newFakeTarget()
+	c := connect(t, target)
+	// A packet with a wrong checksum is not acknowledged and must be sent again
+	c.write("$?#00")
+	c.expect("-")
+	c.command("?", "S05")
+	// The last packet is sent again when GDB did not receive it
+	c.write("-")
+	if reply := c.reply(); reply != "S05" {
+		t.Fatalf("received %q after -, expected the last packet", reply)
+	}
+	// Unsupported packets get an empty reply
+	c.command("vMustReplyEmpty", "")
+	// Acknowledgements are no longer sent once the no ack mode is started
+	c.command("QStartNoAckMode", "OK")
+	c.write(string(encodePacket("?")))
+	if reply := c.read(); reply != "S05" {
+		t.Fatalf("received %q in no ack mode, expected S05", reply)
+	}
+	c.write(string(encodePacket("D")))
+	if reply := c.read(); reply != "OK" {
+		t.Fatalf("received %q after D, expected OK", reply)
+	}
+}
+
+func TestRegisters(t *testing.T) {
+	target := newFakeTarget()
+	target.registers = Registers{IndexRegister: 0x2a4, ProgramCounter: 0x200, StackPointer: 1, DelayTimer: 0x3c, SoundTimer: 2}
+	target.registers.Register[0] = 0x12
+	target.registers.Register[0xF] = 0x01
+	c := connect(t, target)
+
+	// 16 registers of 1 byte, I, PC and SP of 2 bytes (little endian), then the 2 timers
+	c.command("g", "12000000000000000000000000000001"+"a402"+"0002"+"0100"+"3c"+"02")
+	c.command("p10", "a402")
+	c.command("p11", "0002")
+	c.command("pf", "01")
+	c.command("p15", "E01")
+
+	c.command("Pf=ff", "OK")
+	c.command("P11=2a02", "OK")
+	c.command("P15=00", "E01")
+	if registers := target.Registers(); registers.Register[0xF] != 0xff || registers.ProgramCounter != 0x22a {
+		t.Fatalf("registers after P: %+v", registers)
+	}
+
+	c.command("G"+"0102030405060708090a0b0c0d0e0f10"+"0003"+"0402"+"0000"+"00"+"05", "OK")
+	registers := target.Registers()
+	expected := Registers{IndexRegister: 0x300, ProgramCounter: 0x204, SoundTimer: 5}
+	for i := range expected.Register {
+		expected.Register[i] = uint8(i + 1)
+	}
+	if registers != expected {
+		t.Fatalf("registers after G: %+v, expected %+v", registers, expected)
+	}
+	// Registers that are missing from G are an error
+	c.command("G0102", "E01")
+	c.detach()
+}
+
+func TestMemory(t *testing.T) {
+	target := newFakeTarget()
+	copy(target.memory[0x200:], []uint8{0x00, 0xE0, 0xA2, 0x2A})
+	c := connect(t, target)
+
+	c.command("m200,4", "00e0a22a")
+	// Reads that go past the end of the memory are shortened
+	c.command("mffe,4", "0000")
+	c.command("m1000,1", "E01")
+	c.command("m200", "E01")
+
+	c.command("M300,3:abcdef", "OK")
+	if data := target.ReadMemory(0x300, 3); data[0] != 0xab || data[1] != 0xcd || data[2] != 0xef {
+		t.Fatalf("memory after M: %x", data)
+	}
+	c.command("m300,3", "abcdef")
+	// The length must match the data
+	c.command("M300,2:abcdef", "E01")
+	c.command("Mfff,2:abcd", "E01")
+	c.detach()
+}
+
+func TestBreakpoints(t *testing.T) {
+	target := newFakeTarget()
+	c := connect(t, target)
+
+	c.command("Z0,204,2", "OK")
+	c.command("Z1,208,2", "OK")
+	// Adding the same breakpoint twice only adds it once
+	c.command("Z0,204,2", "OK")
+	// Watchpoints are not supported
+	c.command("Z2,300,1", "")
+	target.mutex.Lock()
+	count := len(target.breakpoints)
+	target.mutex.Unlock()
+	if count != 2 {
+		t.Fatalf("%d breakpoints, expected 2", count)
+	}
+
+	c.command("z0,204,2", "OK")
+	c.command("z0,204,2", "OK")
+	target.mutex.Lock()
+	count = len(target.breakpoints)
+	target.mutex.Unlock()
+	if count != 1 {
+		t.Fatalf("%d breakpoints after z0, expected 1", count)
+	}
+
+	// The breakpoints of GDB are removed and the target is resumed when it detaches
+	c.detach()
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+	if len(target.breakpoints) != 0 || !target.resumed {
+		t.Fatalf("breakpoints %v, resumed %v after detaching", target.breakpoints, target.resumed)
+	}
+}
+
+func TestStep(t *testing.T) {
+	target := newFakeTarget()
+	target.registers.ProgramCounter = 0x200
+	c := connect(t, target)
+
+	c.command("s", "S05")
+	if pc := target.Registers().ProgramCounter; pc != 0x202 {
+		t.Fatalf("PC = 0x%x after s, expected 0x202", pc)
+	}
+	// The execution is resumed at the address of the packet
+	c.command("s2a0", "S05")
+	if pc := target.Registers().ProgramCounter; pc != 0x2a2 {
+		t.Fatalf("PC = 0x%x after s2a0, expected 0x2a2", pc)
+	}
+	c.command("?", "S05")
+
+	// CPU errors are reported as signals
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{&cpu.UnknownOpcodeError{ProgramCounter: 0x2a2, OperationCode: 0xF0FF}, "S04"},
+		{cpu.ErrStackOverflow, "S0b"},
+		{cpu.ErrMemoryOutOfBounds, "S0b"},
+		{cpu.ErrProgramExited, "W00"},
+	}
+	for _, test := range tests {
+		target.mutex.Lock()
+		target.stepErr = test.err
+		target.mutex.Unlock()
+		c.command("s", test.expected)
+		c.command("?", test.expected)
+	}
+
+	// The target was resumed by something else, the last stop reason is kept
+	target.mutex.Lock()
+	target.stepErr = ErrNotPaused
+	target.mutex.Unlock()
+	c.command("s", "E02")
+	c.command("?", "W00")
+	c.detach()
+}
+
+func TestContinue(t *testing.T) {
+	target := newFakeTarget()
+	c := connect(t, target)
+
+	// Stopped by a breakpoint
+	c.cont()
+	target.stop <- nil
+	if reply := c.reply(); reply != "S05" {
+		t.Fatalf("received %q after a breakpoint, expected S05", reply)
+	}
+
+	// Stopped by a CPU error
+	c.cont()
+	target.stop <- cpu.ErrStackUnderflow
+	if reply := c.reply(); reply != "S0b" {
+		t.Fatalf("received %q after a stack error, expected S0b", reply)
+	}
+
+	// Not resumed, as the target was resumed by something else
+	c.cont()
+	target.stop <- ErrNotPaused
+	if reply := c.reply(); reply != "E02" {
+		t.Fatalf("received %q when the target is not paused, expected E02", reply)
+	}
+
+	// Interrupted by GDB (Ctrl-C), which may happen before Continue is called by the stub
+	c.cont()
+	c.write("\x03")
+	if reply := c.reply(); reply != "S02" {
+		t.Fatalf("received %q after an interrupt, expected S02", reply)
+	}
+	c.command("?", "S02")
+	target.mutex.Lock()
+	pauses, interrupted := target.pauses, target.interrupted
+	target.mutex.Unlock()
+	// The target is only paused when GDB connects
+	if pauses != 1 || interrupted != 1 {
+		t.Fatalf("target paused %d times, interrupted %d times, expected 1 and 1", pauses, interrupted)
+	}
+
+	// An interrupt while the target is already stopped only repeats the stop reason
+	c.write("\x03")
+	if reply := c.reply(); reply != "S02" {
+		t.Fatalf("received %q after an interrupt while stopped, expected S02", reply)
+	}
+	c.detach()
+}
+
+func TestDisconnectWhileRunning(t *testing.T) {
+	target := newFakeTarget()
+	c := connect(t, target)
+
+	c.cont()
+	// GDB disconnects, the target is interrupted then resumed
+	c.conn.Close()
+	if err := <-c.done; err != nil {
+		t.Fatalf("ServeConn returned %v", err)
+	}
+	c.done <- nil
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+	if target.interrupted != 1 || !target.resumed {
+		t.Fatalf("target interrupted %d times, resumed %v after disconnecting", target.interrupted, target.resumed)
+	}
+}
@@ -0,0 +1,92 @@
+package gdbstub
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Interrupt request sent by GDB (Ctrl-C) while the target is running
+const interruptByte = 0x03
+
+// event is something received from GDB, either a packet or an interrupt request
+type event struct {
+	packet    string
+	interrupt bool
+	// Set when the checksum of the packet does not match, GDB is asked to send it again
+	invalid bool
+	// Set when GDB asks for the last packet again (-)
+	nack bool
+}
+
+// readEvent reads the next packet ($data#checksum), interrupt or negative acknowledgement (-),
+// positive acknowledgements (+) are skipped.
+func readEvent(r *bufio.Reader) (event, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return event{}, err
+		}
+		switch b {
+		case interruptByte:
+			return event{interrupt: true}, nil
+		case '+':
+			continue
+		case '-':
+			return event{nack: true}, nil
+		case '$':
+		default:
+			// Garbage between packets is ignored, as done by GDB
+			continue
+		}
+
+		data := []byte{}
+		sum := byte(0)
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				return event{}, err
+			}
+			if b == '#' {
+				break
+			}
+			sum += b
+			// Escaped bytes are sent as } followed by the byte xor 0x20
+			if b == '}' {
+				escaped, err := r.ReadByte()
+				if err != nil {
+					return event{}, err
+				}
+				sum += escaped
+				b = escaped ^ 0x20
+			}
+			data = append(data, b)
+		}
+		checksum := make([]byte, 2)
+		if _, err := io.ReadFull(r, checksum); err != nil {
+			return event{}, err
+		}
+		var expected byte
+		if _, err := fmt.Sscanf(string(checksum), "%02x", &expected); err != nil || expected != sum {
+			return event{invalid: true}, nil
+		}
+		return event{packet: string(data)}, nil
+	}
+}
+
+// encodePacket frames data as $data#checksum, escaping the bytes that have a meaning in the protocol.
+func encodePacket(data string) []byte {
+	packet := []byte{'$'}
+	sum := byte(0)
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		if b == '$' || b == '#' || b == '}' || b == '*' {
+			packet = append(packet, '}')
+			sum += '}'
+			b ^= 0x20
+		}
+		packet = append(packet, b)
+		sum += b
+	}
+	return append(packet, []byte(fmt.Sprintf("#%02x", sum))...)
+}
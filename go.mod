@@ -4,7 +4,7 @@ go 1.16
 
 require (
 	github.com/abiosoft/readline v0.0.0-20180607040430-155bce2042db // indirect
-	github.com/fatih/color v1.10.0 // indirect
+	github.com/fatih/color v1.10.0
 	github.com/flynn-archive/go-shlex v0.0.0-20150515145356-3f9db97f8568 // indirect
 	github.com/hajimehoshi/ebiten/v2 v2.0.7
 	github.com/urfave/cli/v2 v2.3.0
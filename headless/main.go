@@ -0,0 +1,247 @@
+package headless
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/raveltan/chip-fa/cpu"
+	"github.com/raveltan/chip-fa/trace"
+)
+
+// Exit status of a headless run
+const (
+	// The stop condition is met, or the cycle limit is reached when there is no stop condition
+	ExitSuccess = 0
+	// The CPU returned an error
+	ExitCPUError = 1
+	// The cycle limit is reached before the stop condition is met
+	ExitConditionNotMet = 2
+)
+
+// Options of a headless run
+type Options struct {
+	// Path to the ROM file
+	Rom    string
+	Quirks cpu.Quirks
+	// Path to a save state that is loaded after the ROM, empty to start the ROM from the beginning
+	LoadState string
+	// Maximum amount of cycles that are executed
+	Cycles int
+	// Emulated CPU speed, used to decrement the timers at 60Hz
+	CyclePerSecond int
+
+	// Stop conditions, the run stops as soon as one of them is met
+
+	// Stops when the program counter reaches UntilPC (if HasUntilPC is set)
+	HasUntilPC bool
+	UntilPC    uint16
+	// Stops when the breakpoint operationCode (0x0001) is executed
+	UntilBreakpoint bool
+	// Stops when the hash of the screen (as returned by ScreenHash) matches
+	UntilScreenHash string
+
+	// Path of the PNG screenshot written when the run stops, empty to skip it
+	Screenshot string
+	// Writes the screen as text to ASCIIOutput when the run stops, nil to skip it
+	ASCIIOutput io.Writer
+	// Path of the trace of the executed instructions (see the trace package), empty to skip it
+	Trace       string
+	TraceFormat trace.Format
+}
+
+// Result of a headless run
+type Result struct {
+	// Amount of executed cycles
+	Cycles int
+	// Reason why the run has been stopped
+	Reason string
+	// Hash of the screen when the run stopped
+	ScreenHash string
+	// Error returned by the CPU
+	Err error
+	// Exit status of the run
+	ExitStatus int
+}
+
+func (o Options) hasCondition() bool {
+	return o.HasUntilPC || o.UntilBreakpoint || o.UntilScreenHash != ""
+}
+
+// Run executes the ROM without opening a window until a stop condition is met,
+// or Cycles cycles are executed. Errors are only returned when the run is unable to start
+// or unable to write the outputs, CPU errors are reported by the Result.
+func Run(options Options) (result *Result, err error) {
+	c := &cpu.CPU{Quirks: options.Quirks}
+	c.Boot()
+	if err := c.LoadROM(options.Rom); err != nil {
+		return nil, fmt.Errorf("unable to open ROM, %w", err)
+	}
+	if options.LoadState != "" {
+		f, err := os.Open(options.LoadState)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load state, %w", err)
+		}
+		err = c.LoadState(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to load state, %w", err)
+		}
+	}
+	if options.Trace != "" {
+		f, createErr := os.Create(options.Trace)
+		if createErr != nil {
+			return nil, fmt.Errorf("unable to create trace, %w", createErr)
+		}
+		defer f.Close()
+		writer, writeErr := trace.NewWriter(f, options.TraceFormat)
+		if writeErr != nil {
+			return nil, fmt.Errorf("unable to write trace, %w", writeErr)
+		}
+		// The first write error is kept, the run is not stopped by it as the trace is only a by-product
+		var traceErr error
+		c.TraceCallback = func(programCounter uint16, operationCode uint16) {
+			if traceErr == nil {
+				traceErr = writer.Write(trace.NewEntry(c, programCounter, operationCode))
+			}
+		}
+		defer func() {
+			if traceErr == nil {
+				traceErr = writer.Flush()
+			}
+			// err is the error returned by Run
+			if traceErr != nil && err == nil {
+				err = fmt.Errorf("unable to write trace, %w", traceErr)
+			}
+		}()
+	}
+	breakpointHit := false
+	c.StopForDebuggingCallback = func() {
+		breakpointHit = true
+	}
+
+	result = &Result{Reason: fmt.Sprintf("cycle limit (%d) reached", options.Cycles), ExitStatus: ExitSuccess}
+	if options.hasCondition() {
+		result.ExitStatus = ExitConditionNotMet
+	}
+	screenHash := ScreenHash(c)
+	cyclePerSecond := options.CyclePerSecond
+	if cyclePerSecond < 1 {
+		cyclePerSecond = 60
+	}
+	// Timers are decremented every cyclePerSecond / 60 cycles, same as the emulator's frames
+	frameCredit := 0
+	for result.Cycles < options.Cycles {
+		if options.HasUntilPC && c.ProgramCounter == options.UntilPC {
+			result.Reason = fmt.Sprintf("program counter reached 0x%03x", options.UntilPC)
+			result.ExitStatus = ExitSuccess
+			break
+		}
+
+		err := c.DoCycle()
+		result.Cycles++
+		frameCredit += 60
+		if frameCredit >= cyclePerSecond {
+			frameCredit -= cyclePerSecond
+			c.UpdateTimers()
+		}
+		if err != nil {
+			if errors.Is(err, cpu.ErrProgramExited) {
+				result.Reason = "program exited"
+				break
+			}
+			result.Reason = "CPU error"
+			result.Err = err
+			result.ExitStatus = ExitCPUError
+			break
+		}
+
+		if options.UntilBreakpoint && breakpointHit {
+			result.Reason = fmt.Sprintf("breakpoint hit at 0x%03x", c.ProgramCounter-2)
+			result.ExitStatus = ExitSuccess
+			break
+		}
+		// Hashing the screen is only needed when it has been drawn
+		if c.ShouldDraw {
+			c.ShouldDraw = false
+			screenHash = ScreenHash(c)
+			if options.UntilScreenHash != "" && strings.EqualFold(screenHash, options.UntilScreenHash) {
+				result.Reason = "screen hash matched"
+				result.ExitStatus = ExitSuccess
+				break
+			}
+		}
+	}
+	result.ScreenHash = screenHash
+
+	if options.Screenshot != "" {
+		if err := writeScreenshot(c, options.Screenshot); err != nil {
+			return result, fmt.Errorf("unable to write screenshot, %w", err)
+		}
+	}
+	if options.ASCIIOutput != nil {
+		if _, err := io.WriteString(options.ASCIIOutput, ScreenASCII(c)); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// ScreenHash returns the hex encoded SHA-256 of the visible part of the screen and its resolution.
+func ScreenHash(c *cpu.CPU) string {
+	width, height := c.ScreenWidth(), c.ScreenHeight()
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%dx%d:", width, height)
+	hash.Write(c.Screen[:width*height])
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Characters of the pixels by the planes that are set, same order as the emulator's palette
+var asciiPalette = [4]byte{'.', '#', '+', '@'}
+
+// ScreenASCII returns the visible part of the screen as text, one line per row.
+func ScreenASCII(c *cpu.CPU) string {
+	width, height := c.ScreenWidth(), c.ScreenHeight()
+	builder := strings.Builder{}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			builder.WriteByte(asciiPalette[c.Screen[x+y*width]&0x3])
+		}
+		builder.WriteByte('\n')
+	}
+	return builder.String()
+}
+
+// Colors of the pixels by the planes that are set, same as the emulator's palette
+var palette = [4]color.Color{
+	color.Black,
+	color.White,
+	color.RGBA{0xAA, 0xAA, 0xAA, 0xFF},
+	color.RGBA{0x55, 0x55, 0x55, 0xFF},
+}
+
+func writeScreenshot(c *cpu.CPU, path string) error {
+	width, height := c.ScreenWidth(), c.ScreenHeight()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, palette[c.Screen[x+y*width]&0x3])
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
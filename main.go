@@ -1,10 +1,23 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
+	"github.com/raveltan/chip-fa/asm"
+	"github.com/raveltan/chip-fa/cpu"
+	"github.com/raveltan/chip-fa/dap"
+	"github.com/raveltan/chip-fa/disasm"
 	"github.com/raveltan/chip-fa/emulator"
+	"github.com/raveltan/chip-fa/headless"
+	"github.com/raveltan/chip-fa/trace"
 	"github.com/urfave/cli/v2"
 )
 
@@ -14,57 +27,444 @@ func main() {
 	var romFile string
 	var isDebugging bool
 	var hdpiScale float64
+	var quirksPreset string
+	var stateFile string
+	var rewindSeconds int
+	var rewindInterval int
+	var keymapFile string
+	var debugSymbolsFile string
+	var isHeadless bool
+	var headlessCycles int
+	var untilPC string
+	var untilBreakpoint bool
+	var untilScreenHash string
+	var screenshotFile string
+	var printASCII bool
+	var disasmSyntax string
+	var outputFile string
+	var symbolsFile string
+	var traceFile string
+	var traceFormatName string
+	var gdbAddress string
+	var debugScript string
+	var dapAddress string
 
 	cli.VersionFlag = &cli.BoolFlag{
 		Name:    "version",
 		Aliases: []string{"v"},
 		Usage:   "prints the current version of the chip-fa",
 	}
+	// Flags shared by the emulator and the run command
+	emulationFlags := []cli.Flag{
+		&cli.StringFlag{
+			Aliases:     []string{"r"},
+			Name:        "rom",
+			Usage:       "`PATH` to ROM file that will be run on the Chip8's emulator",
+			Destination: &romFile,
+		},
+		&cli.Float64Flag{
+			Aliases:     []string{"s"},
+			Name:        "scale",
+			Value:       1,
+			Usage:       "Window size scaling",
+			Destination: &scaling,
+		},
+		&cli.Float64Flag{
+			Aliases:     []string{"x"},
+			Name:        "hdi-scale",
+			Value:       1,
+			Usage:       "HDPI Pixel Scaling",
+			Destination: &hdpiScale,
+		},
+		&cli.IntFlag{
+			Aliases:     []string{"c"},
+			Name:        "cycle",
+			Value:       60,
+			Usage:       "Cycle per second for the CPU emulation ",
+			Destination: &cyclePerSecond,
+		},
+		&cli.BoolFlag{
+			Aliases:     []string{"d"},
+			Name:        "debug",
+			Value:       false,
+			Usage:       "Enable debugging",
+			Destination: &isDebugging,
+		},
+		&cli.StringFlag{
+			Name:        "debug-script",
+			Usage:       "Run the debugger commands of `PATH` (one per line) before starting the ROM, enables debugging",
+			Destination: &debugScript,
+		},
+		&cli.StringFlag{
+			Aliases:     []string{"q"},
+			Name:        "quirks",
+			Value:       cpu.DefaultQuirksPreset,
+			Usage:       fmt.Sprintf("Quirks `PRESET` of the emulated interpreter (%s), legacy keeps the behavior of the earlier versions", strings.Join(cpu.QuirksPresetNames(), ", ")),
+			Destination: &quirksPreset,
+		},
+		&cli.StringFlag{
+			Name:        "load-state",
+			Usage:       "`PATH` to a save state that will be loaded when the ROM starts",
+			Destination: &stateFile,
+		},
+		&cli.IntFlag{
+			Name:        "rewind",
+			Usage:       "Enable rewinding (hold backspace) with `SECONDS` of history, disabled by default as it saves the state every few frames",
+			Destination: &rewindSeconds,
+		},
+		&cli.IntFlag{
+			Name:        "rewind-interval",
+			Value:       2,
+			Usage:       "Amount of `FRAMES` between the captured rewind states",
+			Destination: &rewindInterval,
+		},
+		&cli.StringFlag{
+			Aliases:     []string{"k"},
+			Name:        "keymap",
+			Usage:       "`PATH` to a JSON keymap file that binds the keyboard to the keypad and the hotkeys",
+			Destination: &keymapFile,
+		},
+		&cli.StringFlag{
+			Name:        "symbols",
+			Usage:       "`PATH` to a symbol file (as written by chip-fa asm or Octo) used to show and accept labels in the debugger",
+			Destination: &debugSymbolsFile,
+		},
+		&cli.StringFlag{
+			Name:        "trace",
+			Usage:       "Write every executed instruction with the registers after its execution to `PATH`",
+			Destination: &traceFile,
+		},
+		&cli.StringFlag{
+			Name:        "trace-format",
+			Value:       "text",
+			Usage:       "`FORMAT` of the trace (text, binary)",
+			Destination: &traceFormatName,
+		},
+		&cli.StringFlag{
+			Name:        "gdb",
+			Usage:       "Wait for GDB (remote serial protocol) to connect on `ADDRESS` (ex: :1234) before starting the ROM",
+			Destination: &gdbAddress,
+		},
+	}
+	startEmulation := func(c *cli.Context) error {
+		// Required flags can not be used, as they are also required by the subcommands
+		if romFile == "" {
+			return errors.New("Required flag \"rom\" not set")
+		}
+		quirks, err := cpu.QuirksPreset(quirksPreset)
+		if err != nil {
+			return err
+		}
+		traceFormat, err := trace.ParseFormat(traceFormatName)
+		if err != nil {
+			return err
+		}
+		emulator.StartEmulation(emulator.Options{
+			Rom:            romFile,
+			DPIScale:       hdpiScale,
+			DisplayScale:   scaling,
+			CyclePerSecond: cyclePerSecond,
+			Debug:          isDebugging,
+			Quirks:         quirks,
+			LoadState:      stateFile,
+			RewindSeconds:  rewindSeconds,
+			RewindInterval: rewindInterval,
+			Keymap:         keymapFile,
+			Symbols:        debugSymbolsFile,
+			Trace:          traceFile,
+			TraceFormat:    traceFormat,
+			GDB:            gdbAddress,
+			DebugScript:    debugScript,
+		})
+		return nil
+	}
+
 	app := &cli.App{
 		Name:    "Chip-Fa",
 		Usage:   "Chip8's emulator written in GO",
 		Version: "2.0.1",
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Aliases:     []string{"r"},
-				Name:        "rom",
-				Usage:       "`PATH` to ROM file that will be run on the Chip8's emulator",
-				Required:    true,
-				Destination: &romFile,
+		Flags:   emulationFlags,
+		Action:  startEmulation,
+		Commands: []*cli.Command{
+			{
+				Name:      "asm",
+				Usage:     "Assemble a ROM written in Cowgod's syntax, writing the ROM and its symbol map",
+				ArgsUsage: "SOURCE",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Aliases:     []string{"o"},
+						Name:        "output",
+						Usage:       "Write the ROM to `PATH` (default: the source path with the .ch8 extension)",
+						Destination: &outputFile,
+					},
+					&cli.StringFlag{
+						Name:        "symbols",
+						Usage:       "Write the symbol map to `PATH` (default: the ROM path with the .sym extension)",
+						Destination: &symbolsFile,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return errors.New("Expected the path of a single source file")
+					}
+					source := c.Args().First()
+					program, err := asm.Assemble(source)
+					if err != nil {
+						return err
+					}
+					if outputFile == "" {
+						outputFile = strings.TrimSuffix(source, filepath.Ext(source)) + ".ch8"
+					}
+					if symbolsFile == "" {
+						symbolsFile = strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + ".sym"
+					}
+					if err := program.WriteFiles(outputFile, symbolsFile); err != nil {
+						return err
+					}
+					fmt.Fprintf(os.Stderr, "Assembled %d bytes to %s (symbols: %s)\n", len(program.Code), outputFile, symbolsFile)
+					return nil
+				},
 			},
-			&cli.Float64Flag{
-				Aliases:     []string{"s"},
-				Name:        "scale",
-				Value:       1,
-				Usage:       "Window size scaling",
-				Destination: &scaling,
+			{
+				Name:      "disasm",
+				Usage:     "Disassemble a ROM, separating the code from the data",
+				ArgsUsage: "ROM",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "syntax",
+						Value:       "cowgod",
+						Usage:       "`SYNTAX` of the disassembled instructions (cowgod, octo), only cowgod can be assembled back by chip-fa asm",
+						Destination: &disasmSyntax,
+					},
+					&cli.StringFlag{
+						Aliases:     []string{"o"},
+						Name:        "output",
+						Usage:       "Write the disassembly to `PATH` instead of the standard output",
+						Destination: &outputFile,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return errors.New("Expected the path of a single ROM")
+					}
+					syntax := disasm.Cowgod
+					switch strings.ToLower(disasmSyntax) {
+					case "cowgod":
+					case "octo":
+						syntax = disasm.Octo
+					default:
+						return fmt.Errorf("unknown syntax %q, available syntaxes: cowgod, octo", disasmSyntax)
+					}
+					rom, err := ioutil.ReadFile(c.Args().First())
+					if err != nil {
+						return fmt.Errorf("unable to open ROM, %w", err)
+					}
+					output := disasm.Disassemble(rom, syntax)
+					if outputFile != "" {
+						return ioutil.WriteFile(outputFile, []byte(output), 0644)
+					}
+					_, err = fmt.Print(output)
+					return err
+				},
 			},
-			&cli.Float64Flag{
-				Aliases:     []string{"x"},
-				Name:        "hdi-scale",
-				Value:       1,
-				Usage:       "HDPI Pixel Scaling",
-				Destination: &hdpiScale,
+			{
+				Name:  "dap",
+				Usage: "Serve the Debug Adapter Protocol over the standard input and output (or TCP) to debug ROMs from an editor",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "listen",
+						Usage:       "Wait for a single editor connection on `ADDRESS` (ex: :4711) instead of using the standard input and output",
+						Destination: &dapAddress,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					var session *dap.Session
+					if dapAddress != "" {
+						listener, err := net.Listen("tcp", dapAddress)
+						if err != nil {
+							return err
+						}
+						log.Printf("Waiting for the editor on %s", listener.Addr())
+						conn, err := listener.Accept()
+						listener.Close()
+						if err != nil {
+							return err
+						}
+						session = dap.NewSession(conn, conn)
+					} else {
+						session = dap.NewSession(os.Stdin, os.Stdout)
+					}
+					go func() {
+						if err := session.Serve(); err != nil {
+							log.Printf("error: DAP connection closed, %v", err)
+						}
+					}()
+					launch, err := session.WaitForLaunch()
+					if err != nil {
+						return err
+					}
+					// The emulation is paused until the editor sends its breakpoints.
+					// Rewinding is disabled, as it would move the program behind the back of the editor
+					emulator.StartEmulation(emulator.Options{
+						Rom:            launch.Rom,
+						DPIScale:       1,
+						DisplayScale:   launch.DisplayScale,
+						CyclePerSecond: launch.CyclePerSecond,
+						Quirks:         launch.Quirks,
+						Keymap:         launch.Keymap,
+						Symbols:        launch.Symbols,
+						AttachDebugger: session.Attach,
+					})
+					return nil
+				},
 			},
-			&cli.IntFlag{
-				Aliases:     []string{"c"},
-				Name:        "cycle",
-				Value:       60,
-				Usage:       "Cycle per second for the CPU emulation ",
-				Destination: &cyclePerSecond,
+			{
+				Name:      "trace-diff",
+				Usage:     "Compare 2 traces (text or binary) and print the first instruction where they diverge, exits with 1 when they are different",
+				ArgsUsage: "TRACE TRACE",
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 2 {
+						return errors.New("Expected the paths of 2 traces")
+					}
+					readers := [2]*trace.Reader{}
+					for i, path := range c.Args().Slice() {
+						f, err := os.Open(path)
+						if err != nil {
+							return fmt.Errorf("unable to open trace, %w", err)
+						}
+						defer f.Close()
+						if readers[i], err = trace.NewReader(f); err != nil {
+							return fmt.Errorf("unable to read trace, %w", err)
+						}
+					}
+					divergence, err := trace.Diff(readers[0], readers[1])
+					if err != nil {
+						return err
+					}
+					if divergence == nil {
+						fmt.Println("Traces are identical")
+						return nil
+					}
+					fmt.Printf("Traces diverge at entry %d\n", divergence.Index)
+					if divergence.Previous != nil {
+						fmt.Printf("  last match: %s\n", divergence.Previous)
+					}
+					for i, entry := range []*trace.Entry{divergence.A, divergence.B} {
+						if entry == nil {
+							fmt.Printf("  %s: <end of trace>\n", c.Args().Get(i))
+							continue
+						}
+						fmt.Printf("  %s: %s\n", c.Args().Get(i), entry)
+					}
+					if divergence.A != nil && divergence.B != nil {
+						for _, difference := range divergence.A.Differences(*divergence.B) {
+							fmt.Printf("  %s\n", difference)
+						}
+					}
+					return cli.Exit("", 1)
+				},
 			},
-			&cli.BoolFlag{
-				Aliases:     []string{"d"},
-				Name:        "debug",
-				Value:       false,
-				Usage:       "Enable debugging",
-				Destination: &isDebugging,
+			{
+				Name:  "run",
+				Usage: "Run a ROM, optionally without a window (--headless) for automated testing",
+				Flags: append(append([]cli.Flag{}, emulationFlags...),
+					&cli.BoolFlag{
+						Name:        "headless",
+						Usage:       "Run the ROM without a window until a stop condition is met, exits with 0 on success, 1 on CPU errors and 2 when the stop condition is not met",
+						Destination: &isHeadless,
+					},
+					&cli.IntFlag{
+						Name:        "cycles",
+						Value:       1000000,
+						Usage:       "Maximum amount of `CYCLES` executed in headless mode",
+						Destination: &headlessCycles,
+					},
+					&cli.StringFlag{
+						Name:        "until-pc",
+						Usage:       "Stop when the program counter reaches `ADDRESS` (ex: 0x2A4)",
+						Destination: &untilPC,
+					},
+					&cli.BoolFlag{
+						Name:        "until-break",
+						Usage:       "Stop when the breakpoint operation code (0x0001) is executed",
+						Destination: &untilBreakpoint,
+					},
+					&cli.StringFlag{
+						Name:        "until-hash",
+						Usage:       "Stop when the SHA-256 of the screen matches `HASH` (printed at the end of every headless run)",
+						Destination: &untilScreenHash,
+					},
+					&cli.StringFlag{
+						Name:        "screenshot",
+						Usage:       "Write the screen as a PNG to `PATH` when the headless run stops",
+						Destination: &screenshotFile,
+					},
+					&cli.BoolFlag{
+						Name:        "ascii",
+						Usage:       "Print the screen as text when the headless run stops",
+						Destination: &printASCII,
+					},
+				),
+				Action: func(c *cli.Context) error {
+					if !isHeadless {
+						return startEmulation(c)
+					}
+					if romFile == "" {
+						return errors.New("Required flag \"rom\" not set")
+					}
+					// The flags of the window and of the debugger would be silently ignored
+					for _, name := range []string{"scale", "hdi-scale", "debug", "debug-script", "gdb", "rewind", "rewind-interval", "keymap", "symbols"} {
+						if c.IsSet(name) {
+							return fmt.Errorf("--%s is not supported in headless mode", name)
+						}
+					}
+					quirks, err := cpu.QuirksPreset(quirksPreset)
+					if err != nil {
+						return err
+					}
+					traceFormat, err := trace.ParseFormat(traceFormatName)
+					if err != nil {
+						return err
+					}
+					options := headless.Options{
+						Rom:             romFile,
+						Quirks:          quirks,
+						LoadState:       stateFile,
+						Cycles:          headlessCycles,
+						CyclePerSecond:  cyclePerSecond,
+						UntilBreakpoint: untilBreakpoint,
+						UntilScreenHash: untilScreenHash,
+						Screenshot:      screenshotFile,
+						Trace:           traceFile,
+						TraceFormat:     traceFormat,
+					}
+					if untilPC != "" {
+						address, err := strconv.ParseUint(untilPC, 0, 16)
+						if err != nil {
+							return fmt.Errorf("invalid --until-pc address %q, %v", untilPC, err)
+						}
+						options.HasUntilPC, options.UntilPC = true, uint16(address)
+					}
+					if printASCII {
+						options.ASCIIOutput = os.Stdout
+					}
+
+					result, err := headless.Run(options)
+					if err != nil {
+						return err
+					}
+					fmt.Fprintf(os.Stderr, "Stopped after %d cycles: %s\n", result.Cycles, result.Reason)
+					if result.Err != nil {
+						fmt.Fprintf(os.Stderr, "Error: %v\n", result.Err)
+					}
+					fmt.Fprintf(os.Stderr, "Screen hash: %s\n", result.ScreenHash)
+					if result.ExitStatus != headless.ExitSuccess {
+						return cli.Exit("", result.ExitStatus)
+					}
+					return nil
+				},
 			},
 		},
-		Action: func(c *cli.Context) error {
-			emulator.StartEmulation(romFile, hdpiScale, scaling, cyclePerSecond, isDebugging)
-			return nil
-		},
 	}
 
 	err := app.Run(os.Args)
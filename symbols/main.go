@@ -0,0 +1,121 @@
+package symbols
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Table maps the labels of a ROM to their addresses
+type Table struct {
+	addresses map[string]uint16
+	names     map[uint16]string
+	// Sorted addresses of the labels, used to find the closest label
+	sorted []uint16
+}
+
+// Load loads a symbol file, which has a label and its address on each line.
+// -----------
+// Both "0x2A4 label" (as written by chip-fa asm) and "label 0x2A4" / "label = 0x2A4" / "label: 0x2A4"
+// (as written by Octo and most of the assemblers) are supported.
+// Addresses are hexadecimal with or without the 0x or $ prefix. Lines starting with ; or # are ignored.
+// -----------
+func Load(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := &Table{addresses: map[string]uint16{}, names: map[uint16]string{}}
+	scanner := bufio.NewScanner(f)
+	number := 0
+	for scanner.Scan() {
+		number++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == ';' || text[0] == '#' {
+			continue
+		}
+		fields := strings.FieldsFunc(text, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == '=' || r == ':' || r == ','
+		})
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a label and its address", path, number)
+		}
+		// The address may be on either side, the side with the 0x or $ prefix is tried first
+		// as labels may look like hexadecimal numbers (ex: add, beef)
+		name, addressText := fields[1], fields[0]
+		if hasPrefix(fields[1]) && !hasPrefix(fields[0]) {
+			name, addressText = fields[0], fields[1]
+		}
+		address, ok := parseAddress(addressText)
+		if !ok {
+			name, addressText = addressText, name
+			if address, ok = parseAddress(addressText); !ok {
+				return nil, fmt.Errorf("%s:%d: invalid address %q", path, number, addressText)
+			}
+		}
+		t.Add(name, address)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func hasPrefix(text string) bool {
+	return strings.HasPrefix(strings.ToLower(text), "0x") || strings.HasPrefix(text, "$")
+}
+
+func parseAddress(text string) (uint16, bool) {
+	text = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(text), "0x"), "$")
+	address, err := strconv.ParseUint(text, 16, 16)
+	return uint16(address), err == nil
+}
+
+// Add adds a label, the first label of an address is used to name the address.
+func (t *Table) Add(name string, address uint16) {
+	t.addresses[name] = address
+	if _, ok := t.names[address]; !ok {
+		t.names[address] = name
+		t.sorted = append(t.sorted, address)
+		sort.Slice(t.sorted, func(i, j int) bool { return t.sorted[i] < t.sorted[j] })
+	}
+}
+
+// Address returns the address of a label.
+func (t *Table) Address(name string) (uint16, bool) {
+	if t == nil {
+		return 0, false
+	}
+	address, ok := t.addresses[name]
+	return address, ok
+}
+
+// Labels returns the label of every address that has one.
+func (t *Table) Labels() map[uint16]string {
+	if t == nil {
+		return nil
+	}
+	return t.names
+}
+
+// Describe returns the closest label at or before address with the offset to it (ex: main_loop, draw+0x4),
+// or an empty string when there is none.
+func (t *Table) Describe(address uint16) string {
+	if t == nil {
+		return ""
+	}
+	index := sort.Search(len(t.sorted), func(i int) bool { return t.sorted[i] > address }) - 1
+	if index < 0 {
+		return ""
+	}
+	closest := t.sorted[index]
+	if closest == address {
+		return t.names[closest]
+	}
+	return fmt.Sprintf("%s+0x%x", t.names[closest], address-closest)
+}
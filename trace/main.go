@@ -0,0 +1,295 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/raveltan/chip-fa/cpu"
+	"github.com/raveltan/chip-fa/disasm"
+)
+
+// Format of a trace file
+type Format int
+
+const (
+	// One readable line per executed instruction
+	Text Format = iota
+	// Fixed size records, smaller and faster to write for long runs
+	Binary
+)
+
+// ParseFormat returns the format by its name (text or binary).
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "text":
+		return Text, nil
+	case "binary":
+		return Binary, nil
+	}
+	return Text, fmt.Errorf("unknown trace format %q, available formats: text, binary", name)
+}
+
+// Written at the start of the binary traces, the last byte is the version of the records
+var binaryMagic = [8]byte{'C', 'H', 'F', 'A', 'T', 'R', 'C', 1}
+
+// Entry is the state of the CPU after an instruction is executed
+type Entry struct {
+	// Amount of instructions executed before this one
+	Cycle uint64
+	// Address and operationCode of the executed instruction
+	ProgramCounter uint16
+	OperationCode  uint16
+	// 16 bit address stored after the operationCode, only used by F000 NNNN (XO-CHIP)
+	NextWord uint16
+	// Registers after the execution
+	Register      [16]uint8
+	IndexRegister uint16
+	StackPointer  uint16
+}
+
+// NewEntry returns the entry of the instruction that has just been executed by c,
+// it is meant to be called from cpu.CPU.TraceCallback.
+func NewEntry(c *cpu.CPU, programCounter uint16, operationCode uint16) Entry {
+	e := Entry{
+		Cycle:          c.Cycles - 1,
+		ProgramCounter: programCounter,
+		OperationCode:  operationCode,
+		Register:       c.Register,
+		IndexRegister:  c.IndexRegister,
+		StackPointer:   c.StackPointer,
+	}
+	if operationCode == 0xF000 {
+		e.NextWord = uint16(c.Memory[(int(programCounter)+2)%c.MemorySize()])<<8 | uint16(c.Memory[(int(programCounter)+3)%c.MemorySize()])
+	}
+	return e
+}
+
+// instruction returns the decoded executed instruction.
+func (e Entry) instruction() disasm.Instruction {
+	instruction := disasm.Decode(e.OperationCode)
+	instruction.Long = e.NextWord
+	return instruction
+}
+
+// String returns the entry as a line of the text format
+// -----------
+// Example
+// 00000012 0x204 6a02  LD VA, 0x02           V=00 00 00 00 00 00 00 00 00 00 02 00 00 00 00 00 I=0x000 SP=0
+// F000 NNNN is written with its address after the operationCode (ex: f0001234)
+// -----------
+func (e Entry) String() string {
+	operationCode := fmt.Sprintf("%04x", e.OperationCode)
+	if e.instruction().Op == disasm.OpLDILong {
+		operationCode += fmt.Sprintf("%04x", e.NextWord)
+	}
+	registers := make([]string, len(e.Register))
+	for i, v := range e.Register {
+		registers[i] = fmt.Sprintf("%02x", v)
+	}
+	return fmt.Sprintf("%08d 0x%03x %-8s %-20s V=%s I=0x%03x SP=%x",
+		e.Cycle, e.ProgramCounter, operationCode, e.instruction().String(), strings.Join(registers, " "), e.IndexRegister, e.StackPointer)
+}
+
+// parseEntry parses a line of the text format, the disassembly is ignored as it is derived from the operationCode.
+func parseEntry(line string) (Entry, error) {
+	e := Entry{}
+	invalid := fmt.Errorf("invalid trace line %q", line)
+	fields := strings.Fields(line)
+	registersIndex := strings.Index(line, " V=")
+	if len(fields) < 3 || registersIndex < 0 {
+		return e, invalid
+	}
+	cycle, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return e, invalid
+	}
+	programCounter, err := strconv.ParseUint(fields[1], 0, 16)
+	if err != nil {
+		return e, invalid
+	}
+	if len(fields[2]) != 4 && len(fields[2]) != 8 {
+		return e, invalid
+	}
+	operationCode, err := strconv.ParseUint(fields[2], 16, 32)
+	if err != nil {
+		return e, invalid
+	}
+	e.Cycle, e.ProgramCounter = cycle, uint16(programCounter)
+	if len(fields[2]) == 8 {
+		e.OperationCode, e.NextWord = uint16(operationCode>>16), uint16(operationCode)
+	} else {
+		e.OperationCode = uint16(operationCode)
+	}
+
+	// V=00 followed by the 15 other registers, then I=0x000 SP=0
+	state := strings.Fields(line[registersIndex+len(" V="):])
+	if len(state) != len(e.Register)+2 || !strings.HasPrefix(state[16], "I=") || !strings.HasPrefix(state[17], "SP=") {
+		return e, invalid
+	}
+	for i := range e.Register {
+		value, err := strconv.ParseUint(state[i], 16, 8)
+		if err != nil {
+			return e, invalid
+		}
+		e.Register[i] = uint8(value)
+	}
+	indexRegister, err := strconv.ParseUint(state[16][len("I="):], 0, 16)
+	if err != nil {
+		return e, invalid
+	}
+	stackPointer, err := strconv.ParseUint(state[17][len("SP="):], 16, 16)
+	if err != nil {
+		return e, invalid
+	}
+	e.IndexRegister, e.StackPointer = uint16(indexRegister), uint16(stackPointer)
+	return e, nil
+}
+
+// Writer writes the entries of a trace
+type Writer struct {
+	w      *bufio.Writer
+	format Format
+}
+
+// NewWriter returns a writer of the given format, the binary header is written immediately.
+// Flush must be called once the trace is complete.
+func NewWriter(w io.Writer, format Format) (*Writer, error) {
+	writer := &Writer{w: bufio.NewWriter(w), format: format}
+	if format == Binary {
+		if _, err := writer.w.Write(binaryMagic[:]); err != nil {
+			return nil, err
+		}
+	}
+	return writer, nil
+}
+
+// Write writes an entry.
+func (w *Writer) Write(e Entry) error {
+	if w.format == Binary {
+		return binary.Write(w.w, binary.BigEndian, &e)
+	}
+	_, err := w.w.WriteString(e.String() + "\n")
+	return err
+}
+
+// Flush writes the buffered entries.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// Reader reads the entries of a trace of either format
+type Reader struct {
+	r      *bufio.Reader
+	format Format
+	line   int
+}
+
+// NewReader returns a reader of a trace, the format is detected from the binary header.
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{r: bufio.NewReader(r), format: Text}
+	magic, err := reader.r.Peek(len(binaryMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.Equal(magic, binaryMagic[:]) {
+		reader.format = Binary
+		reader.r.Discard(len(binaryMagic))
+	}
+	return reader, nil
+}
+
+// Read returns the next entry, or io.EOF at the end of the trace.
+func (r *Reader) Read() (Entry, error) {
+	e := Entry{}
+	if r.format == Binary {
+		err := binary.Read(r.r, binary.BigEndian, &e)
+		if err == io.ErrUnexpectedEOF {
+			return e, errors.New("truncated binary trace")
+		}
+		return e, err
+	}
+	for {
+		line, err := r.r.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return e, err
+		}
+		r.line++
+		// Empty lines are skipped, to allow editing the traces by hand
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		e, err := parseEntry(strings.TrimSpace(line))
+		if err != nil {
+			return e, fmt.Errorf("line %d: %w", r.line, err)
+		}
+		return e, nil
+	}
+}
+
+// Differences returns the fields that are different between 2 entries (ex: V3: 0x10 != 0x11),
+// the cycles are not compared as the traces may start at different points.
+func (e Entry) Differences(other Entry) (differences []string) {
+	if e.ProgramCounter != other.ProgramCounter {
+		differences = append(differences, fmt.Sprintf("PC: 0x%03x != 0x%03x", e.ProgramCounter, other.ProgramCounter))
+	}
+	if e.OperationCode != other.OperationCode || e.NextWord != other.NextWord {
+		differences = append(differences, fmt.Sprintf("instruction: %s != %s", e.instruction(), other.instruction()))
+	}
+	for i := range e.Register {
+		if e.Register[i] != other.Register[i] {
+			differences = append(differences, fmt.Sprintf("V%X: 0x%02x != 0x%02x", i, e.Register[i], other.Register[i]))
+		}
+	}
+	if e.IndexRegister != other.IndexRegister {
+		differences = append(differences, fmt.Sprintf("I: 0x%03x != 0x%03x", e.IndexRegister, other.IndexRegister))
+	}
+	if e.StackPointer != other.StackPointer {
+		differences = append(differences, fmt.Sprintf("SP: 0x%x != 0x%x", e.StackPointer, other.StackPointer))
+	}
+	return
+}
+
+// Divergence is the first entry that is different between 2 traces
+type Divergence struct {
+	// Position of the entry in both traces, starting at 0
+	Index int
+	// Entries of both traces, nil when the trace ended before the other one
+	A, B *Entry
+	// Last entry that was the same in both traces, nil when the traces diverge on the first entry
+	Previous *Entry
+}
+
+// Diff compares 2 traces entry by entry and returns the first divergence, or nil when they are the same.
+func Diff(a *Reader, b *Reader) (*Divergence, error) {
+	var previous *Entry
+	for index := 0; ; index++ {
+		entryA, errA := a.Read()
+		if errA != nil && errA != io.EOF {
+			return nil, fmt.Errorf("first trace: %w", errA)
+		}
+		entryB, errB := b.Read()
+		if errB != nil && errB != io.EOF {
+			return nil, fmt.Errorf("second trace: %w", errB)
+		}
+		if errA == io.EOF && errB == io.EOF {
+			return nil, nil
+		}
+		if errA == io.EOF || errB == io.EOF || len(entryA.Differences(entryB)) > 0 {
+			divergence := &Divergence{Index: index, Previous: previous}
+			if errA != io.EOF {
+				divergence.A = &entryA
+			}
+			if errB != io.EOF {
+				divergence.B = &entryB
+			}
+			return divergence, nil
+		}
+		previous = &entryA
+	}
+}
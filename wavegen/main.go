@@ -1,15 +1,39 @@
 package wavegen
 
-import "math"
+import (
+	"math"
+	"sync"
+)
+
+// Sample rate of the generated stream
+const SampleRate = 44100
 
 type Stream struct {
 	position  int64
 	remaining []byte
+
+	// XO-CHIP audio pattern, guarded by the mutex as Read is called by the audio player
+	mutex      sync.Mutex
+	pattern    [16]uint8
+	hasPattern bool
+	pitch      uint8
+	// Current sample of the 128 samples pattern
+	patternPosition float64
+}
+
+// SetPattern replaces the sine wave with a 128 samples 1 bit audio pattern (XO-CHIP)
+// played at 4000 * 2^((pitch - 64) / 48) samples per second.
+func (s *Stream) SetPattern(pattern [16]uint8, pitch uint8) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pattern = pattern
+	s.pitch = pitch
+	s.hasPattern = true
 }
 
 // Read is io.Reader's Read.
 //
-// Read fills the data with sine wave samples.
+// Read fills the data with sine wave samples, or the audio pattern samples if it is set.
 func (s *Stream) Read(buf []byte) (int, error) {
 	if len(s.remaining) > 0 {
 		n := copy(buf, s.remaining)
@@ -23,7 +47,24 @@ func (s *Stream) Read(buf []byte) (int, error) {
 		buf = make([]byte, len(origBuf)+4-len(origBuf)%4)
 	}
 
-	const length = int64(44100 / 440)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.hasPattern {
+		s.readPattern(buf)
+	} else {
+		s.readSine(buf)
+	}
+
+	if origBuf != nil {
+		n := copy(origBuf, buf)
+		s.remaining = buf[n:]
+		return n, nil
+	}
+	return len(buf), nil
+}
+
+func (s *Stream) readSine(buf []byte) {
+	const length = int64(SampleRate / 440)
 	p := s.position / 4
 	for i := 0; i < len(buf)/4; i++ {
 		const max = 32767
@@ -37,13 +78,24 @@ func (s *Stream) Read(buf []byte) (int, error) {
 
 	s.position += int64(len(buf))
 	s.position %= length * 4
+}
 
-	if origBuf != nil {
-		n := copy(origBuf, buf)
-		s.remaining = buf[n:]
-		return n, nil
+func (s *Stream) readPattern(buf []byte) {
+	// Amount of pattern samples that is played on each stream sample
+	step := 4000 * math.Pow(2, (float64(s.pitch)-64)/48) / SampleRate
+	for i := 0; i < len(buf)/4; i++ {
+		const max = 16383
+		sample := int(s.patternPosition)
+		b := int16(-max)
+		if s.pattern[sample/8]&(0x80>>(sample%8)) != 0 {
+			b = max
+		}
+		buf[4*i] = byte(b)
+		buf[4*i+1] = byte(b >> 8)
+		buf[4*i+2] = byte(b)
+		buf[4*i+3] = byte(b >> 8)
+		s.patternPosition = math.Mod(s.patternPosition+step, 128)
 	}
-	return len(buf), nil
 }
 
 // Close is io.Closer's Close.